@@ -0,0 +1,44 @@
+package internal
+
+import "time"
+
+// Clock is the source of time for the limiters. It exists so tests can swap in
+// a FakeClock instead of sleeping for real.
+type Clock interface {
+	Now() time.Time
+	Sleep(time.Duration)
+	After(time.Duration) <-chan time.Time
+	NewTimer(time.Duration) Timer
+}
+
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(time.Duration) bool
+}
+
+type RealClock struct{}
+
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+func (RealClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (RealClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (RealClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
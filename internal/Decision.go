@@ -0,0 +1,22 @@
+package internal
+
+import "time"
+
+// Decision describes the outcome of a single admission check together with the
+// key's state right after it, as needed for rate limit response headers.
+type Decision struct {
+	Allowed bool
+
+	Limit     int
+	Remaining int
+
+	// ResetAt is when the key is back at full capacity if left alone.
+	ResetAt time.Time
+	// RetryAfter is how long a denied caller should back off, zero if allowed.
+	RetryAfter time.Duration
+
+	// Binding is, for a limiter made up of several limits, the index of the
+	// one the decision came from: the one that denied, or the tightest one.
+	// It is zero otherwise.
+	Binding int
+}
@@ -0,0 +1,32 @@
+package internal
+
+import "errors"
+
+var ErrWaitExceedsDeadline = errors.New("wait would exceed context deadline")
+
+var (
+	ErrQueueFull       = errors.New("too many callers waiting on the key")
+	ErrMaxWaitExceeded = errors.New("wait would exceed the maximum wait")
+)
+
+var ErrReservationNotOK = errors.New("reservation exceeds the limit")
+
+var ErrExceedsLimit = errors.New("request exceeds the limit")
+
+var ErrUnsupportedOption = errors.New("option not supported by limiter type")
+
+// OptionError reports an Options field that is out of range or does not apply.
+// It unwraps to the sentinel describing the problem.
+type OptionError struct {
+	Field  string
+	Reason string
+	Err    error
+}
+
+func (e *OptionError) Error() string {
+	return "invalid option " + e.Field + ": " + e.Reason
+}
+
+func (e *OptionError) Unwrap() error {
+	return e.Err
+}
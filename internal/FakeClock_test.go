@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClock_Advance(t *testing.T) {
+	start := time.Unix(0, 0)
+	clock := NewFakeClock(start)
+
+	timer := clock.NewTimer(time.Second)
+	after := clock.After(time.Second * 2)
+
+	clock.Advance(time.Millisecond * 999)
+	select {
+	case <-timer.C():
+		t.Fatal("Timer fired before its deadline")
+	default:
+	}
+
+	clock.Advance(time.Millisecond)
+	select {
+	case now := <-timer.C():
+		if !now.Equal(start.Add(time.Second)) {
+			t.Errorf("Expected timer to fire at %v, got %v", start.Add(time.Second), now)
+		}
+	default:
+		t.Fatal("Timer should have fired")
+	}
+
+	if clock.Timers() != 1 {
+		t.Errorf("Expected 1 pending timer, got %d", clock.Timers())
+	}
+
+	clock.Set(start.Add(time.Minute))
+	select {
+	case <-after:
+	default:
+		t.Fatal("After should have fired")
+	}
+}
+
+func TestFakeClock_StopReset(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+
+	timer := clock.NewTimer(time.Second)
+	if !timer.Stop() {
+		t.Error("Stop should report an active timer")
+	}
+	if timer.Stop() {
+		t.Error("Stop should report an already stopped timer")
+	}
+
+	timer.Reset(time.Second * 2)
+	clock.Advance(time.Second)
+	select {
+	case <-timer.C():
+		t.Fatal("Timer fired before its reset deadline")
+	default:
+	}
+
+	clock.Advance(time.Second)
+	select {
+	case <-timer.C():
+	default:
+		t.Fatal("Timer should have fired after reset")
+	}
+}
+
+func TestFakeClock_Sleep(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+
+	done := make(chan struct{})
+	go func() {
+		clock.Sleep(time.Second)
+		close(done)
+	}()
+
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	<-done
+
+	// non-positive durations return right away
+	clock.Sleep(0)
+}
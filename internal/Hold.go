@@ -0,0 +1,53 @@
+package internal
+
+// Holder is implemented by limiters whose keys can be locked together with
+// other limiters' keys, so that a request checked by several limiters at once
+// is admitted by all of them or by none, without any of them taking its units
+// in the meantime.
+type Holder interface {
+	// HoldOrder is unique to the limiter. Callers holding keys of several
+	// limiters hold them in increasing order of it, so that they can't
+	// deadlock.
+	HoldOrder() uint64
+	// Hold locks the entries of keys, sorted and distinct as Tally returns
+	// them, and decides for each whether counts[index] units of priority p
+	// fit, as AllowDetailed would, without taking them yet.
+	Hold(keys []string, counts []int, p Priority) *Held
+}
+
+// PermitHolder is a Holder handing out permits, as Concurrency limiters do.
+type PermitHolder interface {
+	Holder
+	// HoldPermits is Hold for permits that, once committed, are released by
+	// the function returned rather than by Refund.
+	HoldPermits(keys []string, counts []int, p Priority) (*Held, func())
+}
+
+// Held is the keys a Holder locked, along with its decision for each of them.
+// Commit takes the units the decisions were made for, if the caller goes
+// ahead, and Unlock releases the keys in any case.
+type Held struct {
+	Decisions []Decision
+
+	commit func()
+	unlock func()
+}
+
+// Allowed reports whether every key has room for the request.
+func (h *Held) Allowed() bool {
+	for _, d := range h.Decisions {
+		if !d.Allowed {
+			return false
+		}
+	}
+	return true
+}
+
+// Commit takes the units of a request every key has room for.
+func (h *Held) Commit() {
+	h.commit()
+}
+
+func (h *Held) Unlock() {
+	h.unlock()
+}
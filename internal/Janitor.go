@@ -0,0 +1,56 @@
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+// Janitor calls a limiter's sweep every CleanupInterval, from a goroutine of
+// its own, so that keys idle for IdleTTL can be dropped.
+type Janitor struct {
+	done chan struct{}
+	once sync.Once
+}
+
+// StartJanitor starts sweeping on the clock in option, every CleanupInterval
+// or else IdleTTL. It returns nil, which is safe to Stop, when IdleTTL is not
+// set.
+func StartJanitor(option Options, sweep func(now time.Time)) *Janitor {
+	if option.IdleTTL <= 0 {
+		return nil
+	}
+
+	interval := option.CleanupInterval
+	if interval <= 0 {
+		interval = option.IdleTTL
+	}
+
+	j := &Janitor{done: make(chan struct{})}
+	go j.run(option.ClockOrDefault(), interval, sweep)
+	return j
+}
+
+// Stop ends the sweeping. Calling it more than once is a no-op.
+func (j *Janitor) Stop() {
+	if j == nil {
+		return
+	}
+	j.once.Do(func() {
+		close(j.done)
+	})
+}
+
+func (j *Janitor) run(clock Clock, interval time.Duration, sweep func(time.Time)) {
+	timer := clock.NewTimer(interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-j.done:
+			return
+		case <-timer.C():
+			sweep(clock.Now())
+			timer.Reset(interval)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+package internal
+
+// LeakyBucketMode selects what a leaky bucket does with requests arriving
+// faster than it leaks.
+type LeakyBucketMode int
+
+const (
+	// LeakyBucketMeter lets requests through right away while the bucket
+	// has room for them, and rejects them when it would overflow.
+	LeakyBucketMeter LeakyBucketMode = iota
+	// LeakyBucketQueue holds requests in the bucket and releases them at a
+	// constant rate, rejecting them when it is full.
+	LeakyBucketQueue
+)
@@ -9,4 +9,98 @@ type Options struct {
 	Capacity       int
 	RefillAmount   int
 	RefillDuration time.Duration
+
+	LeakyBucketMode LeakyBucketMode
+
+	// Overrides and LimitFunc give keys their own algorithm parameters, see
+	// ForKey.
+	Overrides map[string]Options
+	LimitFunc func(key string) Options
+
+	Clock Clock
+
+	IdleTTL         time.Duration
+	CleanupInterval time.Duration
+	MaxKeys         int
+	Shards          int
+
+	MaxQueue int
+	MaxWait  time.Duration
+
+	PriorityReserve float64
+
+	MaxHold time.Duration
+	OnLeak  func(key string, heldFor time.Duration)
+
+	Strategy NewStrategy
+	MaxLimit int
+}
+
+func (o Options) ClockOrDefault() Clock {
+	if o.Clock == nil {
+		return RealClock{}
+	}
+	return o.Clock
+}
+
+// Keyed reports whether some keys may have parameters of their own.
+func (o Options) Keyed() bool {
+	return len(o.Overrides) > 0 || o.LimitFunc != nil
+}
+
+// ForKey returns the options that apply to key, without overrides. Its entry
+// in Overrides, or else the result of LimitFunc, replaces Limit, Window,
+// Capacity, RefillAmount and RefillDuration with the fields it sets to positive
+// values.
+func (o Options) ForKey(key string) Options {
+	override, ok := o.Overrides[key]
+	if !ok && o.LimitFunc != nil {
+		override = o.LimitFunc(key)
+	}
+	o.Overrides, o.LimitFunc = nil, nil
+
+	if override.Limit > 0 {
+		o.Limit = override.Limit
+	}
+	if override.Window > 0 {
+		o.Window = override.Window
+	}
+	if override.Capacity > 0 {
+		o.Capacity = override.Capacity
+	}
+	if override.RefillAmount > 0 {
+		o.RefillAmount = override.RefillAmount
+	}
+	if override.RefillDuration > 0 {
+		o.RefillDuration = override.RefillDuration
+	}
+	return o
+}
+
+// Tiers resolves the config of each key for a limiter whose keys may have
+// parameters of their own. Limiters keep one in the config built from the
+// same options.
+type Tiers[C any] struct {
+	shared *C
+	option Options
+	build  func(Options) *C
+}
+
+// NewTiers returns the Tiers of shared, the config build made from option.
+func NewTiers[C any](option Options, shared *C, build func(Options) *C) Tiers[C] {
+	return Tiers[C]{shared: shared, option: option, build: build}
+}
+
+// Resolve returns the config that applies to key: shared, unless the key has
+// an override or there is a LimitFunc, in which case it builds a new one from
+// ForKey. That asks LimitFunc every time, so limiters resolve a key's config
+// when they create or migrate its state and keep it there.
+func (t Tiers[C]) Resolve(key string) *C {
+	if !t.option.Keyed() {
+		return t.shared
+	}
+	if _, ok := t.option.Overrides[key]; !ok && t.option.LimitFunc == nil {
+		return t.shared
+	}
+	return t.build(t.option.ForKey(key))
 }
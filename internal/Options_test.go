@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOptions_ForKey(t *testing.T) {
+	o := Options{
+		Limit:  10,
+		Window: time.Second,
+		Overrides: map[string]Options{
+			"pro": {Limit: 100},
+		},
+		LimitFunc: func(key string) Options {
+			if key == "slow" {
+				return Options{Window: time.Minute, Limit: -1}
+			}
+			return Options{}
+		},
+	}
+
+	if !o.Keyed() || (Options{}).Keyed() {
+		t.Error("Expected Keyed to report whether overrides are set")
+	}
+
+	tests := []struct {
+		key    string
+		limit  int
+		window time.Duration
+	}{
+		{"pro", 100, time.Second},
+		{"slow", 10, time.Minute},
+		{"free", 10, time.Second},
+	}
+	for _, tt := range tests {
+		got := o.ForKey(tt.key)
+		if got.Limit != tt.limit || got.Window != tt.window {
+			t.Errorf("%s: expected %d per %v, got %d per %v", tt.key, tt.limit, tt.window, got.Limit, got.Window)
+		}
+		if got.Keyed() {
+			t.Errorf("%s: expected resolved options not to carry overrides", tt.key)
+		}
+	}
+}
+
+func TestTiers(t *testing.T) {
+	build := func(o Options) *int { return &o.Limit }
+
+	shared := 10
+	tiers := NewTiers(Options{Limit: 10}, &shared, build)
+	if tiers.Resolve("any") != &shared {
+		t.Error("Expected keys to share the config without overrides")
+	}
+
+	tiers = NewTiers(Options{Limit: 10, Overrides: map[string]Options{"pro": {Limit: 100}}}, &shared, build)
+	if tiers.Resolve("free") != &shared || *tiers.Resolve("pro") != 100 {
+		t.Error("Expected only the overridden key to get a config of its own")
+	}
+
+	asked := 0
+	tiers = NewTiers(Options{Limit: 10, LimitFunc: func(string) Options {
+		asked++
+		return Options{}
+	}}, &shared, build)
+	if *tiers.Resolve("free") != 10 || asked != 1 {
+		t.Errorf("Expected LimitFunc to be asked once per Resolve, got %d", asked)
+	}
+}
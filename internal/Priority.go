@@ -0,0 +1,21 @@
+package internal
+
+// Priority ranks requests sharing a key. Lower priorities are held back from
+// the share of capacity PriorityReserve keeps for the ones above them, and
+// give way to them in the wait queue.
+type Priority int
+
+const (
+	PriorityLow Priority = iota
+	PriorityNormal
+	PriorityHigh
+)
+
+// Headroom is how many of limit units a request of priority p has to leave
+// untouched for higher priorities: none for PriorityHigh, and reserve of the
+// limit more for each level below it. Rounded down, so every priority can
+// still take a unit from an idle key.
+func Headroom(limit int, reserve float64, p Priority) int {
+	p = min(max(p, PriorityLow), PriorityHigh)
+	return int(float64(limit) * reserve * float64(PriorityHigh-p))
+}
@@ -0,0 +1,26 @@
+package internal
+
+import "testing"
+
+func TestHeadroom(t *testing.T) {
+	tests := []struct {
+		limit    int
+		reserve  float64
+		priority Priority
+		want     int
+	}{
+		{10, 0.2, PriorityHigh, 0},
+		{10, 0.2, PriorityNormal, 2},
+		{10, 0.2, PriorityLow, 4},
+		{10, 0, PriorityLow, 0},
+		{1, 0.4, PriorityLow, 0},
+		{10, 0.2, PriorityLow - 1, 4},
+		{10, 0.2, PriorityHigh + 1, 0},
+	}
+
+	for _, tt := range tests {
+		if got := Headroom(tt.limit, tt.reserve, tt.priority); got != tt.want {
+			t.Errorf("Headroom(%d, %v, %d) = %d, want %d", tt.limit, tt.reserve, tt.priority, got, tt.want)
+		}
+	}
+}
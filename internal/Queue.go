@@ -0,0 +1,173 @@
+package internal
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Queue lines up the callers waiting on the same key so they get their turn in
+// arrival order, rather than racing each other for the key once capacity frees
+// up. A caller of a higher priority goes ahead of those of a lower one, and
+// gets its turn even while one of them is still having theirs. Keys without
+// waiters take no space.
+type Queue struct {
+	clock    Clock
+	maxQueue int
+	maxWait  time.Duration
+
+	mu    sync.Mutex
+	lines map[string]*line
+}
+
+// line holds the callers of a key having their turn and those waiting for it,
+// the latter ordered by priority and then arrival.
+type line struct {
+	active  []waiter
+	waiting []waiter
+}
+
+type waiter struct {
+	turn     chan struct{}
+	priority Priority
+}
+
+// NewQueue creates a queue bounded by the MaxQueue and MaxWait in option.
+func NewQueue(option Options) *Queue {
+	return &Queue{
+		clock:    option.ClockOrDefault(),
+		maxQueue: option.MaxQueue,
+		maxWait:  option.MaxWait,
+		lines:    make(map[string]*line),
+	}
+}
+
+// Do waits for the caller's turn on key and then runs wait, passing the time by
+// which it has to be done on the queue's clock, zero when there is no MaxWait.
+// Callers queue behind whoever is still in wait. Do fails with ErrQueueFull when
+// MaxQueue callers are already lined up, and with ErrMaxWaitExceeded when the
+// turn does not come within MaxWait. The caller queues as PriorityHigh.
+func (q *Queue) Do(ctx context.Context, key string, wait func(deadline time.Time) error) error {
+	return q.DoPriority(ctx, key, PriorityHigh, wait)
+}
+
+// DoPriority is Do for a caller of priority p.
+func (q *Queue) DoPriority(ctx context.Context, key string, p Priority, wait func(deadline time.Time) error) error {
+	var deadline time.Time
+	if q.maxWait > 0 {
+		deadline = q.clock.Now().Add(q.maxWait)
+	}
+
+	turn, err := q.join(key, p)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-turn:
+	default:
+		if err := q.await(ctx, turn); err != nil {
+			q.leave(key, turn)
+			return err
+		}
+	}
+
+	defer q.leave(key, turn)
+	return wait(deadline)
+}
+
+// Len reports the number of callers lined up on key, those having their turn
+// included.
+func (q *Queue) Len(key string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	l, ok := q.lines[key]
+	if !ok {
+		return 0
+	}
+	return len(l.active) + len(l.waiting)
+}
+
+func (q *Queue) join(key string, p Priority) (chan struct{}, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	l, ok := q.lines[key]
+	if !ok {
+		l = &line{}
+		q.lines[key] = l
+	}
+	if q.maxQueue > 0 && len(l.active)+len(l.waiting) >= q.maxQueue {
+		return nil, ErrQueueFull
+	}
+
+	// behind everyone waiting with the same priority or higher, ahead of the
+	// rest
+	index := 0
+	for index < len(l.waiting) && l.waiting[index].priority >= p {
+		index++
+	}
+
+	w := waiter{make(chan struct{}), p}
+	l.waiting = slices.Insert(l.waiting, index, w)
+	l.next()
+	return w.turn, nil
+}
+
+func (q *Queue) await(ctx context.Context, turn chan struct{}) error {
+	var expired <-chan time.Time
+	if q.maxWait > 0 {
+		timer := q.clock.NewTimer(q.maxWait)
+		defer timer.Stop()
+		expired = timer.C()
+	}
+
+	select {
+	case <-turn:
+		return nil
+	case <-expired:
+		return ErrMaxWaitExceeded
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// leave takes turn out of key's line, whether it was having its turn or still
+// waiting for it, and hands the turn on.
+func (q *Queue) leave(key string, turn chan struct{}) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	l := q.lines[key]
+	is := func(w waiter) bool { return w.turn == turn }
+	l.active = slices.DeleteFunc(l.active, is)
+	l.waiting = slices.DeleteFunc(l.waiting, is)
+
+	if len(l.active) == 0 && len(l.waiting) == 0 {
+		delete(q.lines, key)
+		return
+	}
+	l.next()
+}
+
+// next gives the first waiting caller its turn unless a caller of the same
+// priority or higher is having theirs. Only the first can qualify, as the
+// ones behind it have no higher priority.
+func (l *line) next() {
+	if len(l.waiting) == 0 {
+		return
+	}
+
+	first := l.waiting[0]
+	for _, w := range l.active {
+		if w.priority >= first.priority {
+			return
+		}
+	}
+
+	close(first.turn)
+	l.active = append(l.active, first)
+	l.waiting = l.waiting[1:]
+}
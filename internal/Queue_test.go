@@ -0,0 +1,239 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lineUp starts a caller of q on key that records its turn in order, and
+// returns once it is queued.
+func lineUp(q *Queue, key string, id int, order *[]int, mu *sync.Mutex, wg *sync.WaitGroup) {
+	queued := q.Len(key)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		q.Do(context.Background(), key, func(time.Time) error {
+			mu.Lock()
+			*order = append(*order, id)
+			mu.Unlock()
+			return nil
+		})
+	}()
+	for q.Len(key) == queued {
+		runtime.Gosched()
+	}
+}
+
+func TestQueue_Order(t *testing.T) {
+	q := NewQueue(Options{})
+
+	key := "test_key"
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		q.Do(context.Background(), key, func(time.Time) error {
+			<-release
+			return nil
+		})
+	}()
+	for q.Len(key) == 0 {
+		runtime.Gosched()
+	}
+
+	var mu sync.Mutex
+	var order []int
+	for id := range 5 {
+		lineUp(q, key, id, &order, &mu, &wg)
+	}
+	close(release)
+	wg.Wait()
+
+	if !slices.Equal(order, []int{0, 1, 2, 3, 4}) {
+		t.Errorf("Expected callers to be served in arrival order, got %v", order)
+	}
+	if q.Len(key) != 0 || len(q.lines) != 0 {
+		t.Error("Expected the key's line to be dropped once empty")
+	}
+}
+
+func TestQueue_Priority(t *testing.T) {
+	q := NewQueue(Options{})
+
+	key := "test_key"
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		q.DoPriority(context.Background(), key, PriorityHigh, func(time.Time) error {
+			<-release
+			return nil
+		})
+	}()
+	for q.Len(key) == 0 {
+		runtime.Gosched()
+	}
+
+	var mu sync.Mutex
+	var order []int
+	lineUpPriority := func(id int, p Priority) {
+		queued := q.Len(key)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.DoPriority(context.Background(), key, p, func(time.Time) error {
+				mu.Lock()
+				order = append(order, id)
+				mu.Unlock()
+				return nil
+			})
+		}()
+		for q.Len(key) == queued {
+			runtime.Gosched()
+		}
+	}
+	lineUpPriority(0, PriorityLow)
+	lineUpPriority(1, PriorityNormal)
+	lineUpPriority(2, PriorityHigh)
+	lineUpPriority(3, PriorityNormal)
+	close(release)
+	wg.Wait()
+
+	if !slices.Equal(order, []int{2, 1, 3, 0}) {
+		t.Errorf("Expected higher priorities first, then arrival order, got %v", order)
+	}
+}
+
+func TestQueue_PriorityOvertakes(t *testing.T) {
+	q := NewQueue(Options{})
+
+	key := "test_key"
+	release := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- q.DoPriority(context.Background(), key, PriorityLow, func(time.Time) error {
+			<-release
+			return nil
+		})
+	}()
+	for q.Len(key) == 0 {
+		runtime.Gosched()
+	}
+
+	// a higher priority doesn't wait for a lower one to finish its turn
+	err := q.DoPriority(context.Background(), key, PriorityNormal, func(time.Time) error { return nil })
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestQueue_MaxQueue(t *testing.T) {
+	q := NewQueue(Options{MaxQueue: 1})
+
+	key := "test_key"
+	err := q.Do(context.Background(), key, func(time.Time) error {
+		if err := q.Do(context.Background(), key, nil); !errors.Is(err, ErrQueueFull) {
+			t.Errorf("Expected ErrQueueFull, got %v", err)
+		}
+		if err := q.Do(context.Background(), "other_key", func(time.Time) error { return nil }); err != nil {
+			t.Errorf("Expected other keys to have their own line, got %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestQueue_MaxWait(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	q := NewQueue(Options{Clock: clock, MaxWait: time.Second})
+
+	key := "test_key"
+	release := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- q.Do(context.Background(), key, func(deadline time.Time) error {
+			if !deadline.Equal(time.Unix(1, 0)) {
+				t.Errorf("Expected the deadline to be MaxWait away, got %v", deadline)
+			}
+			<-release
+			return nil
+		})
+	}()
+	for q.Len(key) == 0 {
+		runtime.Gosched()
+	}
+
+	go func() {
+		done <- q.Do(context.Background(), key, func(time.Time) error { return nil })
+	}()
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	if err := <-done; !errors.Is(err, ErrMaxWaitExceeded) {
+		t.Errorf("Expected ErrMaxWaitExceeded, got %v", err)
+	}
+	if q.Len(key) != 1 {
+		t.Errorf("Expected the expired caller to leave the line, got %d queued", q.Len(key))
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestQueue_Cancel(t *testing.T) {
+	q := NewQueue(Options{})
+
+	key := "test_key"
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		q.Do(context.Background(), key, func(time.Time) error {
+			<-release
+			return nil
+		})
+	}()
+	for q.Len(key) == 0 {
+		runtime.Gosched()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- q.Do(ctx, key, func(time.Time) error { return nil })
+	}()
+	for q.Len(key) == 1 {
+		runtime.Gosched()
+	}
+
+	var mu sync.Mutex
+	var order []int
+	lineUp(q, key, 1, &order, &mu, &wg)
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	close(release)
+	wg.Wait()
+
+	if !slices.Equal(order, []int{1}) {
+		t.Errorf("Expected the caller behind a cancelled one to get its turn, got %v", order)
+	}
+}
@@ -0,0 +1,122 @@
+package internal
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// InfDuration is the delay reported by a reservation that can never be honoured.
+const InfDuration = time.Duration(math.MaxInt64)
+
+type Reservation struct {
+	clock   Clock
+	ok      bool
+	readyAt time.Time
+	cancel  func()
+	commit  func(actual int)
+	once    sync.Once
+}
+
+func NewReservation(clock Clock, ok bool, readyAt time.Time, cancel func()) *Reservation {
+	return &Reservation{
+		clock:   clock,
+		ok:      ok,
+		readyAt: readyAt,
+		cancel:  cancel,
+	}
+}
+
+// OK reports whether the limiter could grant the reservation at all, which is
+// false when more units were requested than the limit allows.
+func (r *Reservation) OK() bool {
+	return r.ok
+}
+
+// ReadyAt is the moment the reserved units may be used.
+func (r *Reservation) ReadyAt() time.Time {
+	return r.readyAt
+}
+
+// Delay is how long the caller has to wait before acting on the reservation.
+func (r *Reservation) Delay() time.Duration {
+	if !r.ok {
+		return InfDuration
+	}
+	return max(0, r.readyAt.Sub(r.clock.Now()))
+}
+
+// OnCommit sets what Commit does and returns r.
+func (r *Reservation) OnCommit(commit func(actual int)) *Reservation {
+	r.commit = commit
+	return r
+}
+
+// Cancel gives the reserved units back to the limiter, as long as the
+// reservation has not come due yet. Calling it more than once, or after
+// Commit, is a no-op.
+func (r *Reservation) Cancel() {
+	if !r.ok || r.cancel == nil {
+		return
+	}
+	r.once.Do(r.cancel)
+}
+
+// Commit settles the reservation at the number of units actually used, once
+// known: the part of the estimate left unused is refunded, and units used
+// beyond it are charged even past the limit, as they were spent already. Only
+// the first Commit or Cancel has an effect, and a negative actual is ignored.
+func (r *Reservation) Commit(actual int) {
+	if !r.ok || r.commit == nil || actual < 0 {
+		return
+	}
+	r.once.Do(func() { r.commit(actual) })
+}
+
+// Wait blocks until the reservation comes due, on the clock of the limiter it
+// was made with. It returns ErrReservationNotOK straight away for a
+// reservation that is not OK.
+func (r *Reservation) Wait(ctx context.Context) error {
+	if !r.ok {
+		return ErrReservationNotOK
+	}
+	return Wait(ctx, r.clock, r.Delay)
+}
+
+// CombineReservations returns a reservation that comes due once all of rs do.
+// It is OK only if all of rs are, nil entries being ignored. Its Cancel calls
+// cancel, or cancels each of rs when cancel is nil.
+func CombineReservations(rs []*Reservation, cancel func()) *Reservation {
+	combined := &Reservation{clock: RealClock{}, ok: true}
+	first := true
+	for _, r := range rs {
+		if r == nil {
+			continue
+		}
+		combined.ok = combined.ok && r.ok
+		if first || r.readyAt.After(combined.readyAt) {
+			combined.clock, combined.readyAt = r.clock, r.readyAt
+			first = false
+		}
+	}
+
+	combined.commit = func(actual int) {
+		for _, r := range rs {
+			if r != nil {
+				r.Commit(actual)
+			}
+		}
+	}
+	combined.cancel = cancel
+	if cancel == nil {
+		combined.cancel = func() {
+			for _, r := range rs {
+				if r != nil {
+					r.Cancel()
+				}
+			}
+		}
+	}
+	return combined
+}
@@ -0,0 +1,74 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCombineReservations(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	cancelled := 0
+	cancel := func() { cancelled++ }
+
+	combined := CombineReservations([]*Reservation{
+		NewReservation(clock, true, clock.Now().Add(time.Second), cancel),
+		NewReservation(clock, true, clock.Now().Add(time.Minute), cancel),
+		NewReservation(clock, true, clock.Now(), cancel),
+	}, nil)
+	if !combined.OK() || combined.Delay() != time.Minute {
+		t.Errorf("Expected the combined reservation to wait for the latest, got ok=%v delay=%v", combined.OK(), combined.Delay())
+	}
+
+	done := make(chan error)
+	go func() { done <- combined.Wait(context.Background()) }()
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+	if err := <-done; err != nil {
+		t.Errorf("Expected Wait to return once due, got %v", err)
+	}
+
+	combined.Cancel()
+	combined.Cancel()
+	if cancelled != 3 {
+		t.Errorf("Expected every reservation to be cancelled once, got %d", cancelled)
+	}
+
+	notOK := CombineReservations([]*Reservation{
+		NewReservation(clock, true, clock.Now(), nil),
+		NewReservation(clock, false, time.Time{}, nil),
+	}, nil)
+	if notOK.OK() {
+		t.Error("Expected the combined reservation not to be OK")
+	}
+	if err := notOK.Wait(context.Background()); !errors.Is(err, ErrReservationNotOK) {
+		t.Errorf("Expected ErrReservationNotOK, got %v", err)
+	}
+}
+
+func TestReservation_Commit(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	var committed []int
+	cancelled := false
+
+	r := NewReservation(clock, true, clock.Now(), func() { cancelled = true }).OnCommit(func(actual int) {
+		committed = append(committed, actual)
+	})
+	r.Commit(7)
+	r.Commit(9)
+	r.Cancel()
+	if len(committed) != 1 || committed[0] != 7 || cancelled {
+		t.Errorf("Expected only the first Commit to count, got %v cancelled=%v", committed, cancelled)
+	}
+
+	combined := CombineReservations([]*Reservation{
+		NewReservation(clock, true, clock.Now(), nil).OnCommit(func(actual int) { committed = append(committed, actual) }),
+		nil,
+		NewReservation(clock, true, clock.Now(), nil).OnCommit(func(actual int) { committed = append(committed, actual) }),
+	}, nil)
+	combined.Commit(3)
+	if len(committed) != 3 || committed[1] != 3 || committed[2] != 3 {
+		t.Errorf("Expected Commit to reach every reservation, got %v", committed)
+	}
+}
@@ -0,0 +1,35 @@
+package internal
+
+import "time"
+
+// Snapshot is a point in time view of a single key's state. Only the fields
+// used by the limiter's algorithm are set.
+type Snapshot struct {
+	Key string
+	// Remaining is what Token reports for the key.
+	Remaining int
+
+	// Count is the number of units taken in the current fixed window,
+	// including reservations carried over into later ones.
+	Count       int
+	WindowStart time.Time
+
+	// Tokens is the token bucket's level, negative while reservations are
+	// being paid back.
+	Tokens     int
+	LastRefill time.Time
+
+	// Level is what the leaky bucket holds, and EmptyAt when it will have
+	// leaked out. For GCRA, EmptyAt is the theoretical arrival time.
+	Level   int
+	EmptyAt time.Time
+
+	// InFlight is the number of permits held on the key, and Limit the most
+	// it may hold, which adaptive limiters learn per key.
+	InFlight int
+	Limit    int
+
+	// Logs are the sliding window's samples, oldest first. Reservations log
+	// samples in the future.
+	Logs []time.Time
+}
@@ -0,0 +1,356 @@
+package internal
+
+import (
+	"container/list"
+	"hash/maphash"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Store holds the per-key state S of a limiter, each key guarded by its own
+// mutex. Keys are spread over independently locked shards so unrelated keys do
+// not contend with each other.
+//
+// Keys that sat idle for IdleTTL and whose state is as good as fresh are
+// dropped by a background janitor, and MaxKeys caps the number of tracked keys
+// by evicting the least recently used one of a shard. Keys locked at the time
+// are not evicted, so the cap may be exceeded while they all are.
+type Store[S any] struct {
+	order  uint64
+	seed   maphash.Seed
+	shards []*shard[S]
+	mask   uint64
+	count  atomic.Int64
+
+	idleTTL time.Duration
+	maxKeys int
+	fresh   func(string, *S, time.Time) bool
+
+	clock   Clock
+	janitor *Janitor
+}
+
+type shard[S any] struct {
+	mu      sync.Mutex
+	entries map[string]*Entry[S]
+
+	// lru is ordered by last use, most recent first. It is only maintained
+	// when eviction is enabled.
+	lru *list.List
+}
+
+type Entry[S any] struct {
+	mu    sync.Mutex
+	State S
+
+	key      string
+	lastSeen time.Time
+	elem     *list.Element
+	evicted  atomic.Bool
+}
+
+func (e *Entry[S]) Unlock() {
+	e.mu.Unlock()
+}
+
+// stores numbers the stores created, giving each its Order.
+var stores atomic.Uint64
+
+// NewStore creates a store for the sharding and eviction settings in option.
+// fresh reports whether a key's state is equivalent to a newly created one, and
+// may update it to the given time first; it is called with the entry locked.
+func NewStore[S any](option Options, fresh func(string, *S, time.Time) bool) *Store[S] {
+	shards := option.Shards
+	if shards <= 0 {
+		shards = 4 * runtime.GOMAXPROCS(0)
+	}
+	// round up to a power of two so the shard is picked with a mask
+	size := 1
+	for size < shards {
+		size <<= 1
+	}
+
+	s := &Store[S]{
+		order:   stores.Add(1),
+		seed:    maphash.MakeSeed(),
+		shards:  make([]*shard[S], size),
+		mask:    uint64(size - 1),
+		idleTTL: option.IdleTTL,
+		maxKeys: option.MaxKeys,
+		fresh:   fresh,
+		clock:   option.ClockOrDefault(),
+	}
+	for i := range s.shards {
+		s.shards[i] = &shard[S]{
+			entries: make(map[string]*Entry[S]),
+			lru:     list.New(),
+		}
+	}
+
+	s.janitor = StartJanitor(option, s.sweep)
+	return s
+}
+
+// Lock returns the key's entry locked, creating it on first use. Callers must
+// Unlock it when done.
+func (s *Store[S]) Lock(key string) *Entry[S] {
+	for {
+		e := s.get(key)
+		e.mu.Lock()
+		if !e.evicted.Load() {
+			return e
+		}
+		// dropped between lookup and locking, start over with a new entry
+		e.mu.Unlock()
+	}
+}
+
+// LockAll locks the entries of keys, which must be sorted and distinct as
+// Tally returns them. Locking in key order keeps concurrent calls over
+// overlapping keys from deadlocking. Callers must UnlockAll them when done.
+func (s *Store[S]) LockAll(keys []string) []*Entry[S] {
+	entries := make([]*Entry[S], len(keys))
+	for index, key := range keys {
+		entries[index] = s.Lock(key)
+	}
+	return entries
+}
+
+// UnlockAll unlocks entries locked with LockAll.
+func UnlockAll[S any](entries []*Entry[S]) {
+	for _, e := range entries {
+		e.Unlock()
+	}
+}
+
+// Hold locks the entries of keys, sorted and distinct as Tally returns them,
+// for a limiter implementing Holder. admit brings each state up to date and
+// returns the decision for it along with a copy of it with the request's units
+// taken; the copies replace the states on Commit.
+func (s *Store[S]) Hold(keys []string, admit func(index int, state *S) (S, Decision)) *Held {
+	entries := s.LockAll(keys)
+	states := make([]S, len(entries))
+	h := &Held{
+		Decisions: make([]Decision, len(entries)),
+		commit: func() {
+			for index, e := range entries {
+				e.State = states[index]
+			}
+		},
+		unlock: func() {
+			UnlockAll(entries)
+		},
+	}
+	for index, e := range entries {
+		states[index], h.Decisions[index] = admit(index, &e.State)
+	}
+	return h
+}
+
+// Order is unique to the store, for limiters to use as their HoldOrder.
+func (s *Store[S]) Order() uint64 {
+	return s.order
+}
+
+// Tally sorts keys and merges repeated ones, returning the distinct keys along
+// with how often each was listed.
+func Tally(keys []string) ([]string, []int) {
+	sorted := slices.Clone(keys)
+	slices.Sort(sorted)
+
+	distinct := sorted[:0]
+	var counts []int
+	for _, key := range sorted {
+		if len(distinct) > 0 && distinct[len(distinct)-1] == key {
+			counts[len(counts)-1]++
+			continue
+		}
+		distinct = append(distinct, key)
+		counts = append(counts, 1)
+	}
+	return distinct, counts
+}
+
+// Peek returns the key's entry locked if it is tracked, without creating it or
+// counting as use. Callers must Unlock it when found.
+func (s *Store[S]) Peek(key string) (*Entry[S], bool) {
+	sh := s.shardOf(key)
+	for {
+		sh.mu.Lock()
+		e, exists := sh.entries[key]
+		sh.mu.Unlock()
+		if !exists {
+			return nil, false
+		}
+
+		e.mu.Lock()
+		if !e.evicted.Load() {
+			return e, true
+		}
+		e.mu.Unlock()
+	}
+}
+
+// Keys returns the tracked keys in no particular order.
+func (s *Store[S]) Keys() []string {
+	keys := make([]string, 0, s.Len())
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		for key := range sh.entries {
+			keys = append(keys, key)
+		}
+		sh.mu.Unlock()
+	}
+	return keys
+}
+
+// Delete drops the key so its next use starts from a fresh state.
+func (s *Store[S]) Delete(key string) {
+	sh := s.shardOf(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if e, exists := sh.entries[key]; exists {
+		s.removeLocked(sh, e)
+	}
+}
+
+// Clear drops every key.
+func (s *Store[S]) Clear() {
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		for _, e := range sh.entries {
+			s.removeLocked(sh, e)
+		}
+		sh.mu.Unlock()
+	}
+}
+
+// Len reports the number of keys currently tracked.
+func (s *Store[S]) Len() int {
+	return int(s.count.Load())
+}
+
+// Close stops the janitor. The store remains usable afterwards.
+func (s *Store[S]) Close() error {
+	s.janitor.Stop()
+	return nil
+}
+
+func (s *Store[S]) tracking() bool {
+	return s.idleTTL > 0 || s.maxKeys > 0
+}
+
+func (s *Store[S]) shardOf(key string) *shard[S] {
+	return s.shards[maphash.String(s.seed, key)&s.mask]
+}
+
+func (s *Store[S]) get(key string) *Entry[S] {
+	sh := s.shardOf(key)
+	sh.mu.Lock()
+
+	e, exists := sh.entries[key]
+	if exists {
+		if s.tracking() {
+			sh.lru.MoveToFront(e.elem)
+			e.lastSeen = s.clock.Now()
+		}
+		sh.mu.Unlock()
+		return e
+	}
+
+	e = &Entry[S]{key: key}
+	sh.entries[key] = e
+	if s.tracking() {
+		e.elem = sh.lru.PushFront(e)
+		e.lastSeen = s.clock.Now()
+	}
+
+	count := s.count.Add(1)
+	over := s.maxKeys > 0 && count > int64(s.maxKeys)
+	if over {
+		over = !s.evictLocked(sh, e)
+	}
+	sh.mu.Unlock()
+
+	// this shard has no other key to spare, make room in another one
+	if over {
+		s.evictFrom(sh)
+	}
+
+	return e
+}
+
+func (s *Store[S]) evictFrom(skip *shard[S]) {
+	for _, sh := range s.shards {
+		if sh == skip {
+			continue
+		}
+
+		sh.mu.Lock()
+		evicted := s.evictLocked(sh, nil)
+		sh.mu.Unlock()
+		if evicted {
+			return
+		}
+	}
+}
+
+// evictLocked drops the least recently used entry of the shard other than
+// keep, reporting whether there was one. Entries locked right now are skipped,
+// as their holder may be about to commit to them.
+func (s *Store[S]) evictLocked(sh *shard[S], keep *Entry[S]) bool {
+	for elem := sh.lru.Back(); elem != nil; elem = elem.Prev() {
+		e := elem.Value.(*Entry[S])
+		if e == keep || !e.mu.TryLock() {
+			continue
+		}
+		s.removeLocked(sh, e)
+		e.mu.Unlock()
+		return true
+	}
+	return false
+}
+
+// removeLocked drops e from the shard. Whoever holds e at this point finishes
+// its call against the detached state.
+func (s *Store[S]) removeLocked(sh *shard[S], e *Entry[S]) {
+	e.evicted.Store(true)
+	delete(sh.entries, e.key)
+	if e.elem != nil {
+		sh.lru.Remove(e.elem)
+	}
+	s.count.Add(-1)
+}
+
+// sweep drops the keys idle for at least idleTTL whose state is fresh. Keys in
+// use right now are skipped, they are clearly not idle.
+func (s *Store[S]) sweep(now time.Time) {
+	for _, sh := range s.shards {
+		s.sweepShard(sh, now)
+	}
+}
+
+func (s *Store[S]) sweepShard(sh *shard[S], now time.Time) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	for elem := sh.lru.Back(); elem != nil; {
+		e := elem.Value.(*Entry[S])
+		if now.Sub(e.lastSeen) < s.idleTTL {
+			return
+		}
+		elem = elem.Prev()
+
+		if !e.mu.TryLock() {
+			continue
+		}
+		if s.fresh(e.key, &e.State, now) {
+			s.removeLocked(sh, e)
+		}
+		e.mu.Unlock()
+	}
+}
@@ -0,0 +1,317 @@
+package internal
+
+import (
+	"runtime"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type counter struct {
+	n int
+}
+
+func counterFresh(_ string, c *counter, _ time.Time) bool {
+	return c.n == 0
+}
+
+func TestStore_Lock(t *testing.T) {
+	s := NewStore(Options{}, counterFresh)
+
+	e := s.Lock("a")
+	e.State.n++
+	e.Unlock()
+
+	e = s.Lock("a")
+	defer e.Unlock()
+	if e.State.n != 1 {
+		t.Errorf("Expected state to persist between locks, got %d", e.State.n)
+	}
+	if s.Len() != 1 {
+		t.Errorf("Expected 1 key, got %d", s.Len())
+	}
+}
+
+func TestStore_MaxKeys(t *testing.T) {
+	s := NewStore(Options{MaxKeys: 2, Shards: 1}, counterFresh)
+
+	for _, key := range []string{"a", "b"} {
+		e := s.Lock(key)
+		e.State.n++
+		e.Unlock()
+	}
+
+	// touching a makes b the least recently used key
+	s.Lock("a").Unlock()
+	s.Lock("c").Unlock()
+
+	if s.Len() != 2 {
+		t.Fatalf("Expected 2 keys, got %d", s.Len())
+	}
+
+	e := s.Lock("a")
+	if e.State.n != 1 {
+		t.Errorf("Expected a to be kept, got %d", e.State.n)
+	}
+	e.Unlock()
+
+	e = s.Lock("b")
+	if e.State.n != 0 {
+		t.Errorf("Expected b to be evicted and start fresh, got %d", e.State.n)
+	}
+	e.Unlock()
+}
+
+func TestStore_Sweep(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	s := NewStore(Options{IdleTTL: time.Minute, Clock: clock}, counterFresh)
+	defer s.Close()
+
+	s.Lock("idle").Unlock()
+	busy := s.Lock("busy")
+	e := s.Lock("used")
+	e.State.n = 1
+	e.Unlock()
+
+	clock.Advance(time.Second * 30)
+	s.Lock("recent").Unlock()
+	clock.Advance(time.Second * 30)
+
+	s.sweep(clock.Now())
+	busy.Unlock()
+
+	// idle is dropped, busy is locked, used is not fresh and recent is not idle yet
+	if s.Len() != 3 {
+		t.Errorf("Expected 3 keys after sweep, got %d", s.Len())
+	}
+
+	e = s.Lock("used")
+	defer e.Unlock()
+	if e.State.n != 1 {
+		t.Errorf("Expected used to keep its state, got %d", e.State.n)
+	}
+}
+
+func TestStore_Janitor(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	s := NewStore(Options{IdleTTL: time.Minute, CleanupInterval: time.Second, Clock: clock}, counterFresh)
+
+	s.Lock("idle").Unlock()
+
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+
+	deadline := time.Now().Add(time.Second)
+	for s.Len() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if s.Len() != 0 {
+		t.Errorf("Expected janitor to drop the idle key, got %d keys", s.Len())
+	}
+
+	s.Close()
+	s.Close()
+
+	// janitor releases its timer once closed
+	for clock.Timers() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if clock.Timers() != 0 {
+		t.Errorf("Expected janitor timer to be stopped, got %d", clock.Timers())
+	}
+}
+
+func TestStore_EvictedEntry(t *testing.T) {
+	s := NewStore(Options{MaxKeys: 1}, counterFresh)
+
+	stale := s.Lock("a")
+	stale.State.n = 1
+	s.Delete("a")
+
+	if !stale.evicted.Load() {
+		t.Fatal("Expected a to be evicted")
+	}
+	stale.Unlock()
+
+	e := s.Lock("a")
+	defer e.Unlock()
+	if e == stale || e.State.n != 0 {
+		t.Error("Expected a new entry for an evicted key")
+	}
+}
+
+func TestStore_MaxKeysLocked(t *testing.T) {
+	s := NewStore(Options{MaxKeys: 1, Shards: 1}, counterFresh)
+
+	// a is still held when b is created for the same call
+	entries := s.LockAll([]string{"a", "b"})
+	entries[0].State.n = 1
+	UnlockAll(entries)
+
+	if entries[0].evicted.Load() {
+		t.Fatal("Expected a key held by the call not to be evicted")
+	}
+	e := s.Lock("a")
+	defer e.Unlock()
+	if e != entries[0] || e.State.n != 1 {
+		t.Error("Expected the units committed to a to be kept")
+	}
+}
+
+func TestStore_MaxKeysAcrossShards(t *testing.T) {
+	s := NewStore(Options{MaxKeys: 10, Shards: 8}, counterFresh)
+
+	for i := 0; i < 100; i++ {
+		s.Lock(strconv.Itoa(i)).Unlock()
+	}
+
+	if s.Len() != 10 {
+		t.Errorf("Expected the cap of 10 keys to hold across shards, got %d", s.Len())
+	}
+}
+
+func TestStore_Shards(t *testing.T) {
+	if n := len(NewStore(Options{Shards: 5}, counterFresh).shards); n != 8 {
+		t.Errorf("Expected shards rounded up to 8, got %d", n)
+	}
+	if n := len(NewStore(Options{}, counterFresh).shards); n < runtime.GOMAXPROCS(0) {
+		t.Errorf("Expected at least GOMAXPROCS shards by default, got %d", n)
+	}
+}
+
+// Run with -cpu 1,2,4,8 to compare how the single shard, which is what a
+// global mutex amounts to, and the default sharding scale.
+func TestStore_Peek(t *testing.T) {
+	s := NewStore(Options{}, counterFresh)
+
+	if _, ok := s.Peek("a"); ok || s.Len() != 0 {
+		t.Error("Expected Peek not to create the key")
+	}
+
+	for _, key := range []string{"a", "b", "c"} {
+		e := s.Lock(key)
+		e.State.n++
+		e.Unlock()
+	}
+
+	e, ok := s.Peek("a")
+	if !ok || e.State.n != 1 {
+		t.Fatal("Expected Peek to find the key")
+	}
+	e.Unlock()
+
+	s.Delete("a")
+	if _, ok := s.Peek("a"); ok || s.Len() != 2 || len(s.Keys()) != 2 {
+		t.Errorf("Expected Delete to drop the key, got %v", s.Keys())
+	}
+
+	s.Clear()
+	if s.Len() != 0 || len(s.Keys()) != 0 {
+		t.Errorf("Expected Clear to drop every key, got %v", s.Keys())
+	}
+}
+
+func TestStore_Hold(t *testing.T) {
+	s := NewStore(Options{}, counterFresh)
+	// takes up to 2 per key
+	admit := func(_ int, c *counter) (counter, Decision) {
+		held := *c
+		if held.n+1 > 2 {
+			return held, Decision{}
+		}
+		held.n++
+		return held, Decision{Allowed: true}
+	}
+
+	h := s.Hold([]string{"a", "b"}, admit)
+	if !h.Allowed() {
+		t.Fatal("Expected both keys to have room")
+	}
+	if s.Order() == NewStore(Options{}, counterFresh).Order() {
+		t.Error("Expected every store to have its own order")
+	}
+	h.Commit()
+	h.Unlock()
+
+	e := s.Lock("b")
+	e.State.n = 2
+	e.Unlock()
+
+	h = s.Hold([]string{"a", "b"}, admit)
+	if h.Allowed() || !h.Decisions[0].Allowed {
+		t.Errorf("Expected only b to deny, got %+v", h.Decisions)
+	}
+	h.Unlock()
+
+	e, _ = s.Peek("a")
+	defer e.Unlock()
+	if e.State.n != 1 {
+		t.Errorf("Expected nothing to be taken without Commit, got %d", e.State.n)
+	}
+}
+
+func TestTally(t *testing.T) {
+	keys, counts := Tally([]string{"b", "a", "c", "a"})
+	if !slices.Equal(keys, []string{"a", "b", "c"}) || !slices.Equal(counts, []int{2, 1, 1}) {
+		t.Errorf("Expected sorted distinct keys with counts, got %v %v", keys, counts)
+	}
+	if keys, counts := Tally(nil); len(keys) != 0 || len(counts) != 0 {
+		t.Errorf("Expected nothing for no keys, got %v %v", keys, counts)
+	}
+}
+
+func TestStore_LockAll(t *testing.T) {
+	s := NewStore(Options{}, counterFresh)
+
+	// overlapping key sets locked from many goroutines must not deadlock
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			keys, _ := Tally([]string{"c", "a", "b"}[i%3:])
+			entries := s.LockAll(keys)
+			for _, e := range entries {
+				e.State.n++
+			}
+			UnlockAll(entries)
+		}()
+	}
+	wg.Wait()
+
+	if s.Len() != 3 {
+		t.Errorf("Expected 3 keys, got %d", s.Len())
+	}
+}
+
+func BenchmarkStore_Lock(b *testing.B) {
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = "key-" + strconv.Itoa(i)
+	}
+
+	for _, shards := range []int{1, 0} {
+		name := "shards=" + strconv.Itoa(shards)
+		if shards == 0 {
+			name = "shards=default"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			s := NewStore(Options{Shards: shards}, counterFresh)
+			var next atomic.Uint64
+
+			b.RunParallel(func(pb *testing.PB) {
+				i := next.Add(1) * 7919
+				for pb.Next() {
+					e := s.Lock(keys[i%uint64(len(keys))])
+					e.State.n++
+					e.Unlock()
+					i++
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package internal
+
+import (
+	"math"
+	"time"
+)
+
+// Sample is the outcome of one request, as reported to an adaptive limiter.
+type Sample struct {
+	// Latency is how long the request took, zero when it was dropped.
+	Latency time.Duration
+	// InFlight is the number of permits held on the key when it was
+	// reported.
+	InFlight int
+	// Dropped is set for requests that failed or timed out because the
+	// service behind the limiter was overloaded.
+	Dropped bool
+}
+
+// Strategy computes a key's limit from the outcomes of its requests. Each key
+// gets its own, so implementations may keep state and need not be safe for
+// concurrent use.
+type Strategy interface {
+	// Update returns the limit following s, given the current one. The
+	// limiter keeps it within [1, MaxLimit].
+	Update(limit float64, s Sample) float64
+}
+
+// NewStrategy returns a fresh Strategy for a key.
+type NewStrategy func() Strategy
+
+// AIMD grows the limit by increase every limit samples, about once per round
+// trip, and multiplies it by backoff on a drop. Zero or out of range values
+// pick the defaults, an increase of 1 and a backoff of 0.9.
+func AIMD(increase, backoff float64) NewStrategy {
+	if increase <= 0 {
+		increase = 1
+	}
+	if backoff <= 0 || backoff >= 1 {
+		backoff = 0.9
+	}
+	return func() Strategy {
+		return &aimd{increase, backoff}
+	}
+}
+
+type aimd struct {
+	increase float64
+	backoff  float64
+}
+
+func (a *aimd) Update(limit float64, s Sample) float64 {
+	if s.Dropped {
+		return limit * a.backoff
+	}
+	if applicationLimited(limit, s) {
+		return limit
+	}
+	return limit + a.increase/limit
+}
+
+// Vegas estimates how many requests are queued behind the limit from how much
+// slower they are than the fastest one seen, as TCP Vegas does. It grows the
+// limit while fewer than alpha are queued and shrinks it while more than beta
+// are, by one every limit samples, and multiplies it by 0.9 on a drop. Zero or
+// out of range values pick the defaults, 3 and 6.
+//
+// The fastest latency is forgotten every 1000 samples, so that the limit
+// follows a service that got lastingly slower rather than shrink for good.
+func Vegas(alpha, beta float64) NewStrategy {
+	if alpha <= 0 || beta <= alpha {
+		alpha, beta = 3, 6
+	}
+	return func() Strategy {
+		return &vegas{alpha: alpha, beta: beta}
+	}
+}
+
+// vegasProbe is the number of samples after which Vegas forgets the fastest
+// latency.
+const vegasProbe = 1000
+
+type vegas struct {
+	alpha, beta float64
+
+	fastest time.Duration
+	samples int
+}
+
+func (v *vegas) Update(limit float64, s Sample) float64 {
+	if s.Dropped {
+		return limit * 0.9
+	}
+	if s.Latency <= 0 {
+		return limit
+	}
+
+	v.samples++
+	if v.fastest == 0 || s.Latency < v.fastest || v.samples >= vegasProbe {
+		v.fastest, v.samples = s.Latency, 0
+	}
+
+	queued := limit * (1 - float64(v.fastest)/float64(s.Latency))
+	switch {
+	case queued > v.beta:
+		return limit - 1/limit
+	case queued < v.alpha && !applicationLimited(limit, s):
+		return limit + 1/limit
+	}
+	return limit
+}
+
+// Gradient scales the limit by the ratio between the long-term average latency
+// and the latest one, between 0.5 and 1, and adds the square root of the limit
+// as room for a queue, so the limit grows while latency holds steady and
+// shrinks as it rises. The result is blended into the current limit by
+// smoothing, which defaults to 0.2 when zero or out of range. A drop counts as
+// a ratio of 0.5.
+func Gradient(smoothing float64) NewStrategy {
+	if smoothing <= 0 || smoothing > 1 {
+		smoothing = 0.2
+	}
+	return func() Strategy {
+		return &gradient{smoothing: smoothing}
+	}
+}
+
+// gradientWindow is the number of samples the long-term average latency is
+// taken over.
+const gradientWindow = 100
+
+type gradient struct {
+	smoothing float64
+	// average is the exponential moving average of the latency, in
+	// nanoseconds
+	average float64
+}
+
+func (g *gradient) Update(limit float64, s Sample) float64 {
+	ratio := 0.5
+	if !s.Dropped {
+		if s.Latency <= 0 {
+			return limit
+		}
+
+		latency := float64(s.Latency)
+		if g.average == 0 {
+			g.average = latency
+		} else {
+			g.average += (latency - g.average) / gradientWindow
+		}
+		ratio = min(1, max(0.5, g.average/latency))
+	}
+
+	next := limit*ratio + math.Sqrt(limit)
+	if next > limit && applicationLimited(limit, s) {
+		return limit
+	}
+	return limit*(1-g.smoothing) + next*g.smoothing
+}
+
+// applicationLimited reports whether so few permits were held that the limit
+// can't have been what held requests back, in which case it shouldn't grow.
+func applicationLimited(limit float64, s Sample) bool {
+	return float64(s.InFlight)*2 < limit
+}
@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAIMD(t *testing.T) {
+	strategy := AIMD(0, 0)()
+
+	limit := 10.0
+	for range 10 {
+		limit = strategy.Update(limit, Sample{Latency: time.Millisecond, InFlight: 10})
+	}
+	if limit < 10.9 || limit > 11 {
+		t.Errorf("Expected the limit to grow by about 1 over a round trip, got %v", limit)
+	}
+
+	if got := strategy.Update(limit, Sample{Latency: time.Millisecond, InFlight: 2}); got != limit {
+		t.Errorf("Expected no growth while few permits are held, got %v", got)
+	}
+	if got := strategy.Update(10, Sample{Dropped: true}); got != 9 {
+		t.Errorf("Expected a drop to back off by 10%%, got %v", got)
+	}
+}
+
+func TestVegas(t *testing.T) {
+	strategy := Vegas(0, 0)()
+
+	limit := 20.0
+	limit = strategy.Update(limit, Sample{Latency: time.Millisecond * 10, InFlight: 20})
+	if limit <= 20 {
+		t.Errorf("Expected growth while nothing is queued, got %v", limit)
+	}
+
+	// twice as slow: half of the 20 requests are queued
+	if got := strategy.Update(20, Sample{Latency: time.Millisecond * 20, InFlight: 20}); got >= 20 {
+		t.Errorf("Expected the limit to shrink with more than beta queued, got %v", got)
+	}
+	// 10% slower: 2 queued, within alpha
+	if got := strategy.Update(20, Sample{Latency: time.Millisecond * 11, InFlight: 5}); got != 20 {
+		t.Errorf("Expected no growth while few permits are held, got %v", got)
+	}
+	if got := strategy.Update(20, Sample{Dropped: true}); got != 18 {
+		t.Errorf("Expected a drop to back off by 10%%, got %v", got)
+	}
+}
+
+func TestVegas_Probe(t *testing.T) {
+	strategy := Vegas(3, 6)()
+
+	strategy.Update(20, Sample{Latency: time.Millisecond, InFlight: 20})
+	for range vegasProbe {
+		strategy.Update(20, Sample{Latency: time.Millisecond * 5, InFlight: 20})
+	}
+
+	// the slower latency is now the baseline
+	if got := strategy.Update(20, Sample{Latency: time.Millisecond * 5, InFlight: 20}); got <= 20 {
+		t.Errorf("Expected growth once the fastest latency was forgotten, got %v", got)
+	}
+}
+
+func TestGradient(t *testing.T) {
+	strategy := Gradient(0)()
+
+	// steady latency: the limit grows by smoothing × √limit
+	limit := strategy.Update(16, Sample{Latency: time.Millisecond, InFlight: 16})
+	if limit != 16.8 {
+		t.Errorf("Expected 16.8, got %v", limit)
+	}
+
+	// latency spiking well above the average halves the target
+	if got := strategy.Update(100, Sample{Latency: time.Second, InFlight: 100}); got != 92 {
+		t.Errorf("Expected 92, got %v", got)
+	}
+	if got := strategy.Update(100, Sample{Dropped: true}); got != 92 {
+		t.Errorf("Expected a drop to count as a ratio of 0.5, got %v", got)
+	}
+	if got := strategy.Update(100, Sample{Latency: time.Millisecond, InFlight: 10}); got != 100 {
+		t.Errorf("Expected no growth while few permits are held, got %v", got)
+	}
+}
@@ -0,0 +1,49 @@
+package internal
+
+import (
+	"context"
+	"time"
+)
+
+// Wait blocks until delay reports that no further waiting is needed, or ctx is
+// done. delay is re-evaluated after every sleep since other callers may have
+// consumed the capacity in the meantime.
+func Wait(ctx context.Context, clock Clock, delay func() time.Duration) error {
+	return WaitUntil(ctx, clock, time.Time{}, delay)
+}
+
+// WaitUntil is Wait for a caller that has to be done by deadline on clock. It
+// returns ErrMaxWaitExceeded rather than sleep past it, unless deadline is zero.
+// delay reports InfDuration when the wait can never end, as when the limit went
+// down below what the caller waits for, and WaitUntil returns ErrExceedsLimit.
+func WaitUntil(ctx context.Context, clock Clock, deadline time.Time, delay func() time.Duration) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		d := delay()
+		if d <= 0 {
+			return nil
+		}
+		if d == InfDuration {
+			return ErrExceedsLimit
+		}
+
+		if !deadline.IsZero() && clock.Now().Add(d).After(deadline) {
+			return ErrMaxWaitExceeded
+		}
+		// deadlines are wall clock time, whatever clock the limiter runs on
+		if deadline, ok := ctx.Deadline(); ok && d > time.Until(deadline) {
+			return ErrWaitExceedsDeadline
+		}
+
+		timer := clock.NewTimer(d)
+		select {
+		case <-timer.C():
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
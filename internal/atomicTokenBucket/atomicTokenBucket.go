@@ -0,0 +1,518 @@
+package atomicTokenBucket
+
+import (
+	"context"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	internal "github.com/sirius1b/go-rate-limit/internal"
+)
+
+// AtomicTokenBucket is a lock-free TokenBucket. Each key's bucket is a single
+// word updated with compare-and-swap, so hot keys never block on a mutex.
+// Refills happen on RefillDuration boundaries counted from the limiter's
+// creation rather than from each key's first use.
+//
+// A full bucket is as good as new. With IdleTTL, the keys whose bucket is full
+// and was last taken from that long ago are dropped.
+type AtomicTokenBucket struct {
+	config  atomic.Pointer[config]
+	buckets sync.Map
+	count   atomic.Int64
+	queue   *internal.Queue
+
+	clock   internal.Clock
+	idleTTL time.Duration
+	janitor *internal.Janitor
+}
+
+// dropped is the token count of a bucket being dropped, one take never goes
+// down to. Callers that find it start over with the key's next bucket.
+const dropped = math.MinInt32
+
+// config holds the parameters that Reconfigure can swap out at runtime. The
+// epoch and refillDuration define what the periods stored in bucket words mean,
+// so they stay fixed for the limiter's lifetime.
+type config struct {
+	capacity       int64
+	refillDuration time.Duration
+	refillAmount   int64
+	reserve        float64
+	epoch          time.Time
+}
+
+func NewAtomicTokenBucketLimiter(option internal.Options) *AtomicTokenBucket {
+	f := &AtomicTokenBucket{
+		clock:   option.ClockOrDefault(),
+		idleTTL: option.IdleTTL,
+		queue:   internal.NewQueue(option),
+	}
+	f.config.Store(&config{
+		capacity:       int64(option.Capacity),
+		refillDuration: option.RefillDuration,
+		refillAmount:   int64(option.RefillAmount),
+		reserve:        option.PriorityReserve,
+		epoch:          f.clock.Now(),
+	})
+	f.janitor = internal.StartJanitor(option, f.sweep)
+	return f
+}
+
+// A bucket word holds the token count in its upper 32 bits, signed so that
+// reservations can put the bucket into debt, and the refill period it was last
+// topped up in, counted from epoch, in its lower 32 bits. Only the low bits of
+// the period are kept, so it wraps around every 2^32 periods.
+func pack(tokens int64, period int64) uint64 {
+	return uint64(uint32(int32(tokens)))<<32 | uint64(uint32(period))
+}
+
+func unpack(word uint64) (int64, uint32) {
+	return int64(int32(word >> 32)), uint32(word)
+}
+
+func (f *AtomicTokenBucket) Allow(key string) bool {
+	return f.AllowN(key, 1)
+}
+
+func (f *AtomicTokenBucket) AllowN(key string, n int) bool {
+	c := f.config.Load()
+	if n <= 0 || int64(n) > c.capacity {
+		return false
+	}
+
+	_, _, ok := f.take(c, key, int64(n), 0, f.clock.Now(), false)
+	return ok
+}
+
+// AllowAll takes a token from each of keys, two from a key listed twice, but
+// only if every one of them has it. Every bucket is checked before any token
+// is taken, so a key coming up short takes nothing from the others. Buckets
+// can't be updated together though: when a concurrent call gets to a
+// bucket's tokens between the check and the take, the tokens taken from the
+// buckets before it are refunded, and another call may briefly find them
+// missing.
+func (f *AtomicTokenBucket) AllowAll(keys ...string) bool {
+	keys, counts := internal.Tally(keys)
+	c, now := f.config.Load(), f.clock.Now()
+	for index, key := range keys {
+		if !f.has(c, key, int64(counts[index]), now) {
+			return false
+		}
+	}
+
+	for index, key := range keys {
+		if _, _, ok := f.take(c, key, int64(counts[index]), 0, now, false); !ok {
+			f.refundAll(keys[:index], counts)
+			return false
+		}
+	}
+	return true
+}
+
+// AllowPriority is Allow for a request of priority p, denied while taking the
+// token would eat into the share of the capacity PriorityReserve keeps for
+// higher priorities.
+func (f *AtomicTokenBucket) AllowPriority(key string, p internal.Priority) bool {
+	c := f.config.Load()
+	_, _, ok := f.take(c, key, 1, c.headroom(p), f.clock.Now(), false)
+	return ok
+}
+
+func (f *AtomicTokenBucket) AllowDetailed(key string) internal.Decision {
+	c := f.config.Load()
+	now := f.clock.Now()
+	tokens, readyAt, ok := f.take(c, key, 1, 0, now, false)
+
+	decision := internal.Decision{
+		Allowed:   ok,
+		Limit:     int(c.capacity),
+		Remaining: int(max(0, tokens)),
+		ResetAt:   c.next(tokens, c.capacity, c.period(now), now),
+	}
+	if !ok {
+		decision.RetryAfter = readyAt.Sub(now)
+	}
+
+	return decision
+}
+
+// Wait blocks until a token is there and takes it. It returns false when the
+// key's queue is full or the wait would exceed MaxWait. Only waiters queue, so
+// taking tokens stays lock-free.
+func (f *AtomicTokenBucket) Wait(key string) bool {
+	return f.WaitN(key, 1)
+}
+
+func (f *AtomicTokenBucket) WaitN(key string, n int) bool {
+	if n <= 0 || int64(n) > f.config.Load().capacity {
+		return false
+	}
+
+	return f.waitN(context.Background(), key, int64(n), internal.PriorityHigh) == nil
+}
+
+// WaitPriority is Wait for a request of priority p, which goes ahead of lower
+// priorities in the key's queue.
+func (f *AtomicTokenBucket) WaitPriority(key string, p internal.Priority) bool {
+	return f.waitN(context.Background(), key, 1, p) == nil
+}
+
+func (f *AtomicTokenBucket) WaitContext(ctx context.Context, key string) error {
+	return f.waitN(ctx, key, 1, internal.PriorityHigh)
+}
+
+// waitN queues up for the key and then waits until n tokens are there on top of
+// priority p's headroom, taking them.
+func (f *AtomicTokenBucket) waitN(ctx context.Context, key string, n int64, p internal.Priority) error {
+	return f.queue.DoPriority(ctx, key, p, func(deadline time.Time) error {
+		return internal.WaitUntil(ctx, f.clock, deadline, func() time.Duration {
+			c, now := f.config.Load(), f.clock.Now()
+			if n > c.capacity {
+				// the capacity went down below n since the wait started
+				return internal.InfDuration
+			}
+			_, readyAt, _ := f.take(c, key, n, c.headroom(p), now, false)
+			return readyAt.Sub(now)
+		})
+	})
+}
+
+func (f *AtomicTokenBucket) Reserve(key string, n int) *internal.Reservation {
+	c := f.config.Load()
+	if n <= 0 || int64(n) > c.capacity {
+		return internal.NewReservation(f.clock, false, time.Time{}, nil)
+	}
+
+	now := f.clock.Now()
+	b := f.bucket(key)
+	tokens, readyAt, ok := c.take(b, int64(n), 0, now, true)
+	for tokens == dropped {
+		f.drop(key, b)
+		b = f.bucket(key)
+		tokens, readyAt, ok = c.take(b, int64(n), 0, now, true)
+	}
+	if !ok {
+		return internal.NewReservation(f.clock, false, time.Time{}, nil)
+	}
+
+	return internal.NewReservation(f.clock, true, readyAt, func() {
+		f.cancel(b, int64(n), readyAt)
+	}).OnCommit(func(actual int) {
+		f.commit(key, b, int64(actual-n))
+	})
+}
+
+// Refund puts n tokens back into the key's bucket, up to its capacity, as when
+// a request turned out not to count.
+func (f *AtomicTokenBucket) Refund(key string, n int) {
+	if n <= 0 {
+		return
+	}
+
+	if b, ok := f.buckets.Load(key); ok {
+		f.refund(b.(*atomic.Uint64), int64(n))
+	}
+}
+
+func (f *AtomicTokenBucket) Rate() float64 {
+	c := f.config.Load()
+	return float64(c.refillAmount) / float64(c.refillDuration.Seconds())
+}
+
+func (f *AtomicTokenBucket) Token(key string) int {
+	c := f.config.Load()
+	word, ok := f.load(key)
+	if !ok {
+		return int(c.capacity)
+	}
+
+	period := c.period(f.clock.Now())
+	tokens, last := unpack(word)
+	return int(max(0, c.refill(tokens, last, period)))
+}
+
+func (f *AtomicTokenBucket) Keys() []string {
+	keys := make([]string, 0, f.Len())
+	f.buckets.Range(func(key, _ any) bool {
+		keys = append(keys, key.(string))
+		return true
+	})
+	return keys
+}
+
+func (f *AtomicTokenBucket) Len() int {
+	return int(f.count.Load())
+}
+
+func (f *AtomicTokenBucket) Snapshot(key string) (internal.Snapshot, bool) {
+	c := f.config.Load()
+	word, ok := f.load(key)
+	if !ok {
+		return internal.Snapshot{}, false
+	}
+
+	period := c.period(f.clock.Now())
+	tokens, last := unpack(word)
+	lastRefill := period - c.elapsed(last, period)
+	if refilled := c.refill(tokens, last, period); refilled != tokens {
+		tokens, lastRefill = refilled, period
+	}
+
+	return internal.Snapshot{
+		Key:        key,
+		Remaining:  int(max(0, tokens)),
+		Tokens:     int(tokens),
+		LastRefill: c.epoch.Add(time.Duration(lastRefill) * c.refillDuration),
+	}, true
+}
+
+// Reset drops the key's bucket. Outstanding reservations cancelled afterwards
+// refund the dropped bucket, not the new one.
+func (f *AtomicTokenBucket) Reset(key string) {
+	if _, loaded := f.buckets.LoadAndDelete(key); loaded {
+		f.count.Add(-1)
+	}
+}
+
+func (f *AtomicTokenBucket) ResetAll() {
+	f.buckets.Range(func(key, _ any) bool {
+		f.Reset(key.(string))
+		return true
+	})
+}
+
+// Reconfigure switches to the Capacity, RefillAmount and PriorityReserve in
+// option. Tokens above a reduced capacity are dropped the next time the key is
+// used. RefillDuration can't be changed, as buckets count refills in periods of
+// it.
+func (f *AtomicTokenBucket) Reconfigure(option internal.Options) error {
+	for {
+		old := f.config.Load()
+		if option.RefillDuration != old.refillDuration {
+			return &internal.OptionError{
+				Field:  "RefillDuration",
+				Reason: "can't be changed on a running AtomicTokenBucket",
+				Err:    internal.ErrUnsupportedOption,
+			}
+		}
+
+		c := *old
+		c.capacity = int64(option.Capacity)
+		c.refillAmount = int64(option.RefillAmount)
+		c.reserve = option.PriorityReserve
+		if f.config.CompareAndSwap(old, &c) {
+			return nil
+		}
+	}
+}
+
+// Close stops the janitor dropping idle keys.
+func (f *AtomicTokenBucket) Close() error {
+	f.janitor.Stop()
+	return nil
+}
+
+func (f *AtomicTokenBucket) bucket(key string) *atomic.Uint64 {
+	if b, ok := f.buckets.Load(key); ok {
+		return b.(*atomic.Uint64)
+	}
+
+	c := f.config.Load()
+	b := new(atomic.Uint64)
+	b.Store(pack(c.capacity, c.period(f.clock.Now())))
+	actual, loaded := f.buckets.LoadOrStore(key, b)
+	if !loaded {
+		f.count.Add(1)
+	}
+	return actual.(*atomic.Uint64)
+}
+
+// load returns the word of the key's bucket, unless there is none or it is
+// being dropped.
+func (f *AtomicTokenBucket) load(key string) (uint64, bool) {
+	b, ok := f.buckets.Load(key)
+	if !ok {
+		return 0, false
+	}
+
+	word := b.(*atomic.Uint64).Load()
+	if tokens, _ := unpack(word); tokens == dropped {
+		return 0, false
+	}
+	return word, true
+}
+
+// has reports whether the key's bucket holds n tokens, without creating it.
+func (f *AtomicTokenBucket) has(c *config, key string, n int64, now time.Time) bool {
+	if n > c.capacity {
+		return false
+	}
+
+	word, ok := f.load(key)
+	if !ok {
+		return true
+	}
+	period := c.period(now)
+	tokens, last := unpack(word)
+	return !c.next(c.refill(tokens, last, period), n, period, now).After(now)
+}
+
+// take is config.take on the key's bucket, starting over with a new one when
+// the bucket turns out to be dropped.
+func (f *AtomicTokenBucket) take(c *config, key string, n, headroom int64, now time.Time, debt bool) (int64, time.Time, bool) {
+	for {
+		b := f.bucket(key)
+		if tokens, readyAt, ok := c.take(b, n, headroom, now, debt); tokens != dropped {
+			return tokens, readyAt, ok
+		}
+		f.drop(key, b)
+	}
+}
+
+// take removes n tokens from the bucket if they are there on top of headroom,
+// or unconditionally when debt is allowed. It returns the tokens left and when
+// the n tokens are, or were, available, or dropped if the bucket was.
+func (c *config) take(b *atomic.Uint64, n, headroom int64, now time.Time, debt bool) (int64, time.Time, bool) {
+	period := c.period(now)
+	for {
+		old := b.Load()
+		tokens, last := unpack(old)
+		if tokens == dropped {
+			return dropped, time.Time{}, false
+		}
+		tokens = c.refill(tokens, last, period)
+
+		readyAt := c.next(tokens, n+headroom, period, now)
+		if (readyAt.After(now) && !debt) || tokens-n <= dropped {
+			return tokens, readyAt, false
+		}
+
+		if b.CompareAndSwap(old, pack(tokens-n, period)) {
+			return tokens - n, readyAt, true
+		}
+	}
+}
+
+// refundAll gives back the tokens AllowAll took from keys.
+func (f *AtomicTokenBucket) refundAll(keys []string, counts []int) {
+	for index, key := range keys {
+		f.Refund(key, counts[index])
+	}
+}
+
+func (f *AtomicTokenBucket) cancel(b *atomic.Uint64, n int64, readyAt time.Time) {
+	if readyAt.After(f.clock.Now()) {
+		f.refund(b, n)
+	}
+}
+
+// commit takes delta more tokens for a committed reservation, into debt if
+// need be, or refunds them when negative. Tokens are taken from the key's next
+// bucket if its own was dropped in the meantime.
+func (f *AtomicTokenBucket) commit(key string, b *atomic.Uint64, delta int64) {
+	if delta < 0 {
+		f.refund(b, -delta)
+		return
+	}
+
+	c, now := f.config.Load(), f.clock.Now()
+	if tokens, _, _ := c.take(b, delta, 0, now, true); tokens == dropped {
+		f.take(c, key, delta, 0, now, true)
+	}
+}
+
+// refund puts n tokens back into the bucket, up to its capacity. A dropped
+// bucket was full, and so is left alone.
+func (f *AtomicTokenBucket) refund(b *atomic.Uint64, n int64) {
+	c := f.config.Load()
+	period := c.period(f.clock.Now())
+	for {
+		old := b.Load()
+		tokens, last := unpack(old)
+		if tokens == dropped {
+			return
+		}
+		tokens = min(c.capacity, c.refill(tokens, last, period)+n)
+
+		if b.CompareAndSwap(old, pack(tokens, period)) {
+			return
+		}
+	}
+}
+
+// drop forgets the key's bucket, if it is still b.
+func (f *AtomicTokenBucket) drop(key string, b *atomic.Uint64) {
+	if f.buckets.CompareAndDelete(key, b) {
+		f.count.Add(-1)
+	}
+}
+
+// sweep drops the keys whose bucket is full and was last taken from at least
+// idleTTL ago. Marking the bucket dropped first keeps a concurrent take from
+// landing on it unseen.
+func (f *AtomicTokenBucket) sweep(now time.Time) {
+	c := f.config.Load()
+	period := c.period(now)
+	f.buckets.Range(func(key, value any) bool {
+		b := value.(*atomic.Uint64)
+		old := b.Load()
+		tokens, last := unpack(old)
+
+		// the period last ends when the bucket was last taken from, at the latest
+		takenBy := c.epoch.Add(time.Duration(period-c.elapsed(last, period)+1) * c.refillDuration)
+		if tokens == dropped || c.refill(tokens, last, period) < c.capacity || now.Sub(takenBy) < f.idleTTL {
+			return true
+		}
+
+		if b.CompareAndSwap(old, pack(dropped, 0)) {
+			f.drop(key.(string), b)
+		}
+		return true
+	})
+}
+
+// headroom is how much of the capacity priority p has to leave untouched.
+func (c *config) headroom(p internal.Priority) int64 {
+	return int64(internal.Headroom(int(c.capacity), c.reserve, p))
+}
+
+// period returns the refill period now falls in, counted from epoch.
+func (c *config) period(now time.Time) int64 {
+	return int64(max(0, now.Sub(c.epoch)) / c.refillDuration)
+}
+
+// elapsed returns the number of periods from last, as stored in a bucket word,
+// to period. Stored periods wrap around, so a bucket left alone for 2^32
+// periods or more is taken to be fewer periods old; it is full by then unless
+// RefillAmount is tiny next to Capacity.
+func (c *config) elapsed(last uint32, period int64) int64 {
+	return int64(uint32(period) - last)
+}
+
+// refill tops tokens up for the periods passed since last, or clamps them
+// after the capacity was reduced.
+func (c *config) refill(tokens int64, last uint32, period int64) int64 {
+	missing := c.capacity - tokens
+	if missing <= 0 {
+		return c.capacity
+	}
+
+	elapsed := c.elapsed(last, period)
+	if elapsed >= (missing+c.refillAmount-1)/c.refillAmount {
+		return c.capacity
+	}
+	return tokens + elapsed*c.refillAmount
+}
+
+// next returns when a bucket holding tokens in the given period will hold n.
+func (c *config) next(tokens, n int64, period int64, now time.Time) time.Time {
+	missing := n - tokens
+	if missing <= 0 {
+		return now
+	}
+
+	refills := (missing + c.refillAmount - 1) / c.refillAmount
+	return c.epoch.Add(time.Duration(period+refills) * c.refillDuration)
+}
@@ -0,0 +1,524 @@
+package atomicTokenBucket
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	internal "github.com/sirius1b/go-rate-limit/internal"
+	tb "github.com/sirius1b/go-rate-limit/internal/tokenBucket"
+)
+
+func TestAtomicTokenBucket_Pack(t *testing.T) {
+	for _, tokens := range []int64{0, 1, -1, math.MaxInt32, -math.MaxInt32} {
+		got, period := unpack(pack(tokens, 4242))
+		if got != tokens || period != 4242 {
+			t.Errorf("Expected (%d, 4242) after packing, got (%d, %d)", tokens, got, period)
+		}
+	}
+}
+
+func TestAtomicTokenBucket_Allow(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewAtomicTokenBucketLimiter(internal.Options{
+		Capacity:       3,
+		RefillDuration: time.Second,
+		RefillAmount:   1,
+		Clock:          clock,
+	})
+
+	key := "test_key"
+
+	if !limiter.AllowN(key, 3) {
+		t.Errorf("Expected full bucket to allow 3")
+	}
+	if limiter.Allow(key) {
+		t.Errorf("Expected empty bucket to deny")
+	}
+	if limiter.AllowN(key, 4) {
+		t.Errorf("Expected request larger than capacity to be denied")
+	}
+
+	clock.Advance(time.Second * 2)
+	if tokens := limiter.Token(key); tokens != 2 {
+		t.Errorf("Expected 2 tokens after two refills, got %d", tokens)
+	}
+
+	clock.Advance(time.Hour)
+	if tokens := limiter.Token(key); tokens != 3 {
+		t.Errorf("Expected tokens to be capped at capacity, got %d", tokens)
+	}
+}
+
+func TestAtomicTokenBucket_PeriodWraparound(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewAtomicTokenBucketLimiter(internal.Options{
+		Capacity:       1,
+		RefillDuration: time.Millisecond,
+		RefillAmount:   1,
+		Clock:          clock,
+	})
+
+	key := "test_key"
+
+	// the last period before the stored one wraps around to 0, about 49.7
+	// days in
+	clock.Advance(time.Millisecond * math.MaxUint32)
+	if !limiter.Allow(key) {
+		t.Fatal("Expected a fresh bucket to allow")
+	}
+
+	clock.Advance(time.Millisecond)
+	if !limiter.Allow(key) {
+		t.Error("Expected the refill across the wraparound to allow")
+	}
+	if limiter.Allow(key) {
+		t.Error("Expected the empty bucket to deny after the wraparound")
+	}
+	if d := limiter.AllowDetailed(key); d.RetryAfter != time.Millisecond {
+		t.Errorf("Expected to retry in a period, got %v", d.RetryAfter)
+	}
+
+	snapshot, _ := limiter.Snapshot(key)
+	if !snapshot.LastRefill.Equal(clock.Now()) {
+		t.Errorf("Expected the last refill to be now, got %v", snapshot.LastRefill.Sub(clock.Now()))
+	}
+}
+
+func TestAtomicTokenBucket_AllowDetailed(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewAtomicTokenBucketLimiter(internal.Options{
+		Capacity:       2,
+		RefillDuration: time.Second,
+		RefillAmount:   1,
+		Clock:          clock,
+	})
+
+	key := "test_key"
+	limiter.Allow(key)
+	clock.Advance(time.Millisecond * 300)
+
+	d := limiter.AllowDetailed(key)
+	if !d.Allowed || d.Remaining != 0 || d.Limit != 2 {
+		t.Errorf("Unexpected decision: %+v", d)
+	}
+	if want := clock.Now().Add(time.Millisecond * 1700); !d.ResetAt.Equal(want) {
+		t.Errorf("Expected ResetAt %v, got %v", want, d.ResetAt)
+	}
+
+	d = limiter.AllowDetailed(key)
+	if d.Allowed || d.RetryAfter != time.Millisecond*700 {
+		t.Errorf("Expected denial until the next refill boundary: %+v", d)
+	}
+}
+
+func TestAtomicTokenBucket_Reserve(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewAtomicTokenBucketLimiter(internal.Options{
+		Capacity:       2,
+		RefillDuration: time.Millisecond * 100,
+		RefillAmount:   1,
+		Clock:          clock,
+	})
+
+	key := "test_key"
+	limiter.AllowN(key, 2)
+
+	r := limiter.Reserve(key, 2)
+	if !r.OK() || r.Delay() != time.Millisecond*200 {
+		t.Errorf("Expected reservation two refills out, got ok=%v delay=%v", r.OK(), r.Delay())
+	}
+
+	r.Cancel()
+	clock.Advance(time.Millisecond * 100)
+	if tokens := limiter.Token(key); tokens != 1 {
+		t.Errorf("Expected cancelled reservation to pay back its debt, got %d tokens", tokens)
+	}
+
+	if r := limiter.Reserve(key, 3); r.OK() {
+		t.Errorf("Expected reservation larger than capacity not to be OK")
+	}
+}
+
+func TestAtomicTokenBucket_WaitN(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewAtomicTokenBucketLimiter(internal.Options{
+		Capacity:       2,
+		RefillDuration: time.Millisecond * 100,
+		RefillAmount:   1,
+		Clock:          clock,
+	})
+
+	key := "test_key"
+	limiter.AllowN(key, 2)
+
+	if limiter.WaitN(key, 3) {
+		t.Errorf("Expected WaitN larger than capacity to return false")
+	}
+
+	go func() {
+		clock.BlockUntil(1)
+		clock.Advance(time.Millisecond * 200)
+	}()
+	if !limiter.WaitN(key, 2) {
+		t.Errorf("Expected WaitN to return true")
+	}
+	if tokens := limiter.Token(key); tokens != 0 {
+		t.Errorf("Expected WaitN to consume the refilled tokens, got %d", tokens)
+	}
+}
+
+func TestAtomicTokenBucket_WaitContext(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewAtomicTokenBucketLimiter(internal.Options{
+		Capacity:       1,
+		RefillAmount:   1,
+		RefillDuration: time.Second,
+		Clock:          clock,
+	})
+
+	key := "test_key"
+	limiter.Allow(key)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- limiter.WaitContext(ctx, key)
+	}()
+	clock.BlockUntil(1)
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+
+	go func() {
+		clock.BlockUntil(1)
+		clock.Advance(time.Second)
+	}()
+	if err := limiter.WaitContext(context.Background(), key); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if limiter.Allow(key) {
+		t.Error("Expected WaitContext to take the token it waited for")
+	}
+}
+
+func TestAtomicTokenBucket_Concurrency(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewAtomicTokenBucketLimiter(internal.Options{
+		Capacity:       1000,
+		RefillDuration: time.Second,
+		RefillAmount:   1,
+		Clock:          clock,
+	})
+
+	key := "test_key"
+	var allowed atomic.Int64
+	var wg sync.WaitGroup
+
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if limiter.Allow(key) {
+					allowed.Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed.Load() != 1000 {
+		t.Errorf("Expected exactly the capacity to be allowed, got %d", allowed.Load())
+	}
+}
+
+func TestAtomicTokenBucket_AllowAllocs(t *testing.T) {
+	limiter := NewAtomicTokenBucketLimiter(internal.Options{
+		Capacity:       10,
+		RefillDuration: time.Millisecond,
+		RefillAmount:   10,
+	})
+
+	key := "test_key"
+	limiter.Allow(key)
+
+	if allocs := testing.AllocsPerRun(1000, func() { limiter.Allow(key) }); allocs != 0 {
+		t.Errorf("Expected Allow not to allocate, got %v allocs", allocs)
+	}
+}
+
+func TestAtomicTokenBucket_Snapshot(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewAtomicTokenBucketLimiter(internal.Options{
+		Capacity:       5,
+		RefillDuration: time.Second,
+		RefillAmount:   1,
+		Clock:          clock,
+	})
+
+	if limiter.Token("user1") != 5 || limiter.Len() != 0 {
+		t.Error("Expected Token not to start tracking the key")
+	}
+	if _, ok := limiter.Snapshot("user1"); ok {
+		t.Error("Expected no snapshot for an untracked key")
+	}
+
+	limiter.AllowN("user1", 5)
+	clock.Advance(time.Millisecond * 2500)
+	limiter.Allow("user2")
+
+	snapshot, ok := limiter.Snapshot("user1")
+	if !ok || snapshot.Tokens != 2 || snapshot.Remaining != 2 || !snapshot.LastRefill.Equal(clock.Now().Add(-time.Millisecond*500)) {
+		t.Errorf("Unexpected snapshot: %+v", snapshot)
+	}
+	if keys := limiter.Keys(); len(keys) != 2 || limiter.Len() != 2 {
+		t.Errorf("Expected 2 keys, got %v", keys)
+	}
+
+	limiter.Reset("user1")
+	if limiter.Len() != 1 || limiter.Token("user1") != 5 {
+		t.Error("Expected Reset to forget the key")
+	}
+
+	limiter.ResetAll()
+	if limiter.Len() != 0 || len(limiter.Keys()) != 0 {
+		t.Error("Expected ResetAll to forget every key")
+	}
+}
+
+func TestAtomicTokenBucket_Reconfigure(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewAtomicTokenBucketLimiter(internal.Options{
+		Capacity:       10,
+		RefillDuration: time.Second,
+		RefillAmount:   1,
+		Clock:          clock,
+	})
+
+	key := "test_key"
+	limiter.AllowN(key, 2)
+
+	if err := limiter.Reconfigure(internal.Options{Capacity: 5, RefillDuration: time.Second, RefillAmount: 2}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if tokens := limiter.Token(key); tokens != 5 {
+		t.Errorf("Expected tokens to be clamped to the new capacity, got %d", tokens)
+	}
+
+	limiter.AllowN(key, 5)
+	clock.Advance(time.Second)
+	if tokens := limiter.Token(key); tokens != 2 {
+		t.Errorf("Expected a refill of the new amount, got %d", tokens)
+	}
+
+	err := limiter.Reconfigure(internal.Options{Capacity: 5, RefillDuration: time.Minute, RefillAmount: 2})
+	if !errors.Is(err, internal.ErrUnsupportedOption) {
+		t.Errorf("Expected changing RefillDuration to be unsupported, got %v", err)
+	}
+}
+
+func TestAtomicTokenBucket_AllowAll(t *testing.T) {
+	limiter := NewAtomicTokenBucketLimiter(internal.Options{
+		Capacity:       2,
+		RefillAmount:   1,
+		RefillDuration: time.Minute,
+	})
+
+	if !limiter.AllowAll("ip", "api_key", "ip") {
+		t.Fatal("Expected every key to have tokens")
+	}
+	if limiter.AllowAll("api_key", "ip") {
+		t.Error("Expected the empty ip bucket to deny")
+	}
+	if tokens := limiter.Token("api_key"); tokens != 1 {
+		t.Errorf("Expected the api_key token to be refunded, got %d left", tokens)
+	}
+
+	// checked before anything is taken, so the new key isn't even created
+	if limiter.AllowAll("account", "ip") || limiter.Len() != 2 {
+		t.Errorf("Expected a denied AllowAll not to touch the other keys, got %d keys", limiter.Len())
+	}
+}
+
+func TestAtomicTokenBucket_AllowPriority(t *testing.T) {
+	limiter := NewAtomicTokenBucketLimiter(internal.Options{
+		Capacity:        10,
+		RefillAmount:    1,
+		RefillDuration:  time.Minute,
+		PriorityReserve: 0.2,
+	})
+
+	key := "test_key"
+	allowed := map[internal.Priority]int{}
+	for _, p := range []internal.Priority{internal.PriorityLow, internal.PriorityNormal, internal.PriorityHigh} {
+		for limiter.AllowPriority(key, p) {
+			allowed[p]++
+		}
+	}
+	if allowed[internal.PriorityLow] != 6 || allowed[internal.PriorityNormal] != 2 || allowed[internal.PriorityHigh] != 2 {
+		t.Errorf("Expected low to stop at 4 left and normal at 2, got %v", allowed)
+	}
+}
+
+func TestAtomicTokenBucket_Commit(t *testing.T) {
+	limiter := NewAtomicTokenBucketLimiter(internal.Options{
+		Capacity:       10,
+		RefillDuration: time.Minute,
+		RefillAmount:   1,
+	})
+
+	key := "test_key"
+	limiter.Reserve(key, 5).Commit(2)
+	if tokens := limiter.Token(key); tokens != 8 {
+		t.Errorf("Expected the unused estimate to be refunded, got %d left", tokens)
+	}
+
+	limiter.Reserve(key, 2).Commit(12)
+	if tokens := limiter.Token(key); tokens != 0 || limiter.Allow(key) {
+		t.Errorf("Expected usage beyond the estimate to be charged, got %d left", tokens)
+	}
+}
+
+func TestAtomicTokenBucket_Refund(t *testing.T) {
+	limiter := NewAtomicTokenBucketLimiter(internal.Options{
+		Capacity:       3,
+		RefillDuration: time.Minute,
+		RefillAmount:   1,
+	})
+
+	key := "test_key"
+	limiter.Refund(key, 1)
+	if limiter.Len() != 0 {
+		t.Error("Expected Refund not to track an unknown key")
+	}
+
+	limiter.AllowN(key, 3)
+	limiter.Refund(key, 2)
+	if tokens := limiter.Token(key); tokens != 2 {
+		t.Errorf("Expected 2 tokens back, got %d", tokens)
+	}
+
+	limiter.Refund(key, 5)
+	if tokens := limiter.Token(key); tokens != 3 {
+		t.Errorf("Expected refunds not to exceed the capacity, got %d", tokens)
+	}
+}
+
+// Compares against the mutex based TokenBucket, both on a single hot key and
+// spread over many keys. Run with -cpu 1,2,4,8.
+func TestAtomicTokenBucket_Janitor(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewAtomicTokenBucketLimiter(internal.Options{
+		Capacity:        3,
+		RefillAmount:    1,
+		RefillDuration:  time.Minute,
+		IdleTTL:         time.Minute,
+		CleanupInterval: time.Second,
+		Clock:           clock,
+	})
+
+	limiter.AllowN("busy", 3)
+	limiter.Allow("idle")
+
+	clock.BlockUntil(1)
+	clock.Advance(2 * time.Minute)
+
+	deadline := time.Now().Add(time.Second)
+	for limiter.Len() != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if limiter.Len() != 1 {
+		t.Fatalf("Expected the janitor to drop the full bucket only, got %d keys", limiter.Len())
+	}
+	if _, ok := limiter.Snapshot("busy"); !ok {
+		t.Error("Expected the bucket still refilling to be kept")
+	}
+
+	limiter.Close()
+	limiter.Close()
+
+	for clock.Timers() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if clock.Timers() != 0 {
+		t.Errorf("Expected janitor timer to be stopped, got %d", clock.Timers())
+	}
+}
+
+func TestAtomicTokenBucket_Dropped(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewAtomicTokenBucketLimiter(internal.Options{
+		Capacity:       1,
+		RefillAmount:   1,
+		RefillDuration: time.Minute,
+		Clock:          clock,
+	})
+
+	// a sweep marked the bucket but has yet to delete it
+	key := "test_key"
+	limiter.bucket(key).Store(pack(dropped, 0))
+
+	if _, ok := limiter.Snapshot(key); ok {
+		t.Error("Expected a dropped bucket not to be reported")
+	}
+	if !limiter.Allow(key) {
+		t.Error("Expected a dropped key to start over")
+	}
+	if limiter.Allow(key) {
+		t.Error("Expected the new bucket to be taken from")
+	}
+	if limiter.Len() != 1 {
+		t.Errorf("Expected the dropped bucket to be replaced, got %d keys", limiter.Len())
+	}
+}
+
+func BenchmarkAtomicTokenBucket_Allow(b *testing.B) {
+	options := internal.Options{
+		Capacity:       1_000_000,
+		RefillDuration: time.Millisecond,
+		RefillAmount:   1_000_000,
+	}
+
+	limiters := []struct {
+		name    string
+		limiter interface{ Allow(string) bool }
+	}{
+		{"mutex", tb.NewTokenBucketLimiter(options)},
+		{"atomic", NewAtomicTokenBucketLimiter(options)},
+	}
+
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = "key-" + strconv.Itoa(i)
+	}
+
+	for _, l := range limiters {
+		b.Run(l.name+"/single-key", func(b *testing.B) {
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					l.limiter.Allow("global")
+				}
+			})
+		})
+
+		b.Run(l.name+"/many-keys", func(b *testing.B) {
+			var next atomic.Uint64
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				i := next.Add(1) * 7919
+				for pb.Next() {
+					l.limiter.Allow(keys[i%uint64(len(keys))])
+					i++
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,681 @@
+package concurrency
+
+import (
+	"context"
+	"math"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	internal "github.com/sirius1b/go-rate-limit/internal"
+)
+
+// Concurrency limits the number of requests in flight per key, whatever their
+// rate, to Limit. Requests hold a permit until they release it: through the
+// function Acquire and TryAcquire return, or with Refund for the units taken
+// by Allow, Wait and Reserve. Permits held for longer than MaxHold are taken
+// to have leaked; they are reclaimed, so a forgotten release can't block the
+// key for good, and reported to OnLeak.
+//
+// With a Strategy, each key's limit adapts to the outcomes of its requests,
+// reported with OnSuccess and OnDrop, starting from Limit and staying within
+// [1, MaxLimit].
+type Concurrency struct {
+	config atomic.Pointer[config]
+	store  *internal.Store[permits]
+	queue  *internal.Queue
+	ids    atomic.Uint64
+
+	clock   internal.Clock
+	maxHold time.Duration
+	onLeak  func(key string, heldFor time.Duration)
+}
+
+// config holds a key's limit, or how its limit is learned, as of the last
+// Reconfigure.
+type config struct {
+	limit   int
+	reserve float64
+
+	// strategy adapts the limit of each key, starting from limit, when set
+	strategy internal.NewStrategy
+	maxLimit int
+
+	tiers internal.Tiers[config]
+}
+
+type permits struct {
+	// held is ordered by acquisition, oldest first
+	held []permit
+	// freed is closed when a permit is released, made by the first caller
+	// to wait for one, and dropped once the waiters on it all left
+	freed   chan struct{}
+	waiters int
+
+	// estimate is the limit learned by strategy, when the config has one
+	strategy internal.Strategy
+	estimate float64
+
+	// config the state was last brought up to date with, resolved from the
+	// limiter's config root; both nil while fresh
+	config *config
+	root   *config
+}
+
+// permit is one unit in flight. Those taken by Acquire and TryAcquire have an
+// id for their release function to find them by, the others share id 0.
+type permit struct {
+	id uint64
+	at time.Time
+}
+
+func NewConcurrencyLimiter(option internal.Options) *Concurrency {
+	f := &Concurrency{
+		clock:   option.ClockOrDefault(),
+		maxHold: option.MaxHold,
+		onLeak:  option.OnLeak,
+	}
+	f.config.Store(newConfig(option))
+	f.store = internal.NewStore(option, f.fresh)
+	f.queue = internal.NewQueue(option)
+	return f
+}
+
+func newConfig(option internal.Options) *config {
+	c := &config{
+		limit:    option.Limit,
+		reserve:  option.PriorityReserve,
+		strategy: option.Strategy,
+		maxLimit: option.MaxLimit,
+	}
+	c.tiers = internal.NewTiers(option, c, newConfig)
+	return c
+}
+
+// headroom is how much of limit priority p has to leave untouched.
+func (c *config) headroom(limit int, p internal.Priority) int {
+	return internal.Headroom(limit, c.reserve, p)
+}
+
+// limitOf returns the limit of the key in state s, the one its strategy
+// learned if the config has one.
+func (c *config) limitOf(s *permits) int {
+	if c.strategy == nil {
+		return c.limit
+	}
+	return int(c.clamp(s.estimate))
+}
+
+// clamp keeps a learned limit within [1, maxLimit].
+func (c *config) clamp(limit float64) float64 {
+	if c.maxLimit > 0 {
+		limit = min(limit, float64(c.maxLimit))
+	}
+	return max(1, limit)
+}
+
+// Acquire waits for a permit on key and returns the function that releases
+// it, which may be called more than once. It fails with ctx's error, or with
+// ErrQueueFull or ErrMaxWaitExceeded as WaitContext does.
+func (f *Concurrency) Acquire(ctx context.Context, key string) (func(), error) {
+	id := f.ids.Add(1)
+	if err := f.wait(ctx, key, 1, internal.PriorityHigh, id); err != nil {
+		return nil, err
+	}
+	return f.releaser(key, id), nil
+}
+
+// TryAcquire is Acquire without waiting, reporting false when no permit is
+// free.
+func (f *Concurrency) TryAcquire(key string) (func(), bool) {
+	e, c := f.lock(key)
+	defer e.Unlock()
+	s := &e.State
+
+	id := f.ids.Add(1)
+	if !f.take(key, c, s, 1, 0, id) {
+		return nil, false
+	}
+	return f.releaser(key, id), true
+}
+
+func (f *Concurrency) Allow(key string) bool {
+	return f.AllowN(key, 1)
+}
+
+// AllowN takes n permits if they are free. Give them back with Refund.
+func (f *Concurrency) AllowN(key string, n int) bool {
+	if n <= 0 {
+		return false
+	}
+
+	e, c := f.lock(key)
+	defer e.Unlock()
+
+	return f.take(key, c, &e.State, n, 0, 0)
+}
+
+// AllowAll takes a permit on each of keys, two on a key listed twice, but only
+// if every one of them has them free.
+func (f *Concurrency) AllowAll(keys ...string) bool {
+	keys, counts := internal.Tally(keys)
+	entries := f.store.LockAll(keys)
+	defer internal.UnlockAll(entries)
+
+	now := f.clock.Now()
+	for index, e := range entries {
+		s := &e.State
+		c := f.sync(keys[index], s, now)
+		f.reclaim(keys[index], s, now)
+
+		if len(s.held)+counts[index] > c.limitOf(s) {
+			return false
+		}
+	}
+
+	for index, e := range entries {
+		e.State.hold(counts[index], 0, now)
+	}
+	return true
+}
+
+// AllowPriority is Allow for a request of priority p, denied while taking the
+// permit would eat into the share of the limit PriorityReserve keeps for
+// higher priorities.
+func (f *Concurrency) AllowPriority(key string, p internal.Priority) bool {
+	e, c := f.lock(key)
+	defer e.Unlock()
+
+	s := &e.State
+	return f.take(key, c, s, 1, c.headroom(c.limitOf(s), p), 0)
+}
+
+// AllowDetailed can only tell when permits come free if MaxHold is set, as the
+// time the oldest one is reclaimed for RetryAfter and the newest for ResetAt.
+// Otherwise both are zero while permits are held.
+func (f *Concurrency) AllowDetailed(key string) internal.Decision {
+	e, c := f.lock(key)
+	defer e.Unlock()
+	s := &e.State
+
+	now := f.clock.Now()
+	f.reclaim(key, s, now)
+
+	return f.admit(c, s, 1, internal.PriorityHigh, 0, now)
+}
+
+// HoldOrder implements internal.Holder.
+func (f *Concurrency) HoldOrder() uint64 {
+	return f.store.Order()
+}
+
+// Hold implements internal.Holder, deciding for each key as AllowDetailed does.
+// The permits are released with Refund.
+func (f *Concurrency) Hold(keys []string, counts []int, p internal.Priority) *internal.Held {
+	return f.holdUnder(keys, counts, p, 0)
+}
+
+// HoldPermits implements internal.PermitHolder, holding permits of a new id as
+// TryAcquire does.
+func (f *Concurrency) HoldPermits(keys []string, counts []int, p internal.Priority) (*internal.Held, func()) {
+	id := f.ids.Add(1)
+	releases := make([]func(), len(keys))
+	for index, key := range keys {
+		releases[index] = f.releaser(key, id)
+	}
+
+	return f.holdUnder(keys, counts, p, id), func() {
+		for _, release := range releases {
+			release()
+		}
+	}
+}
+
+// holdUnder is Hold for permits taken under id.
+func (f *Concurrency) holdUnder(keys []string, counts []int, p internal.Priority, id uint64) *internal.Held {
+	now := f.clock.Now()
+	return f.store.Hold(keys, func(index int, s *permits) (permits, internal.Decision) {
+		c := f.sync(keys[index], s, now)
+		f.reclaim(keys[index], s, now)
+
+		// a copy of the permits, the held ones may share their backing array
+		held := *s
+		held.held = slices.Clip(held.held)
+		decision := f.admit(c, &held, counts[index], p, id, now)
+		return held, decision
+	})
+}
+
+// admit holds n permits under id for a request of priority p if they are free,
+// and describes s afterwards.
+func (f *Concurrency) admit(c *config, s *permits, n int, p internal.Priority, id uint64, now time.Time) internal.Decision {
+	limit := c.limitOf(s)
+	decision := internal.Decision{Limit: limit}
+
+	if len(s.held)+n+c.headroom(limit, p) <= limit {
+		s.hold(n, id, now)
+		decision.Allowed = true
+	}
+
+	decision.Remaining = max(0, limit-len(s.held))
+	decision.ResetAt = now
+	if len(s.held) > 0 {
+		decision.ResetAt = f.expiry(s.held[len(s.held)-1])
+	}
+	// more than the limit is never free, there is no point retrying
+	if !decision.Allowed && n <= limit && len(s.held) > 0 {
+		if expiry := f.expiry(s.held[0]); !expiry.IsZero() {
+			decision.RetryAfter = expiry.Sub(now)
+		}
+	}
+
+	return decision
+}
+
+// Wait blocks until a permit is free and takes it. Give it back with Refund.
+// It returns false when the key's queue is full or the wait would exceed
+// MaxWait.
+func (f *Concurrency) Wait(key string) bool {
+	return f.WaitN(key, 1)
+}
+
+func (f *Concurrency) WaitN(key string, n int) bool {
+	if n <= 0 {
+		return false
+	}
+
+	return f.wait(context.Background(), key, n, internal.PriorityHigh, 0) == nil
+}
+
+// WaitContext is Wait, giving up with ctx's error once ctx is done.
+func (f *Concurrency) WaitContext(ctx context.Context, key string) error {
+	return f.wait(ctx, key, 1, internal.PriorityHigh, 0)
+}
+
+// WaitPriority is Wait for a request of priority p, which goes ahead of lower
+// priorities in the key's queue.
+func (f *Concurrency) WaitPriority(key string, p internal.Priority) bool {
+	return f.wait(context.Background(), key, 1, p, 0) == nil
+}
+
+// Reserve takes n permits if they are free, and is not OK otherwise, as there
+// is no telling when permits will be released. Cancel gives them back.
+func (f *Concurrency) Reserve(key string, n int) *internal.Reservation {
+	e, c := f.lock(key)
+	defer e.Unlock()
+
+	if n <= 0 || !f.take(key, c, &e.State, n, 0, 0) {
+		return internal.NewReservation(f.clock, false, time.Time{}, nil)
+	}
+
+	return internal.NewReservation(f.clock, true, f.clock.Now(), func() {
+		f.Refund(key, n)
+	}).OnCommit(func(actual int) {
+		f.commit(key, actual-n)
+	})
+}
+
+// Refund releases up to n of the permits taken on key by Allow, Wait and
+// Reserve, oldest first. Permits from Acquire and TryAcquire are only released
+// by their own release function.
+func (f *Concurrency) Refund(key string, n int) {
+	if n <= 0 {
+		return
+	}
+
+	e, _ := f.lock(key)
+	defer e.Unlock()
+	s := &e.State
+
+	released := 0
+	s.held = slices.DeleteFunc(s.held, func(p permit) bool {
+		if p.id != 0 || released == n {
+			return false
+		}
+		released++
+		return true
+	})
+	if released > 0 {
+		s.notify()
+	}
+}
+
+// Rate is infinite, as only the number of requests in flight is limited.
+func (f *Concurrency) Rate() float64 {
+	return math.Inf(1)
+}
+
+// Token reports how many permits are free on key.
+func (f *Concurrency) Token(key string) int {
+	e, ok := f.store.Peek(key)
+	if !ok {
+		return f.config.Load().tiers.Resolve(key).limit
+	}
+	defer e.Unlock()
+	s := &e.State
+
+	now := f.clock.Now()
+	c := f.sync(key, s, now)
+	f.reclaim(key, s, now)
+	return max(0, c.limitOf(s)-len(s.held))
+}
+
+// Limit reports the most permits key may hold, as learned so far when the
+// limiter has a Strategy.
+func (f *Concurrency) Limit(key string) int {
+	e, ok := f.store.Peek(key)
+	if !ok {
+		return f.config.Load().tiers.Resolve(key).limit
+	}
+	defer e.Unlock()
+
+	return f.sync(key, &e.State, f.clock.Now()).limitOf(&e.State)
+}
+
+// OnSuccess reports that a request on key completed after latency, to be
+// called before its permit is released. It only matters with a Strategy.
+func (f *Concurrency) OnSuccess(key string, latency time.Duration) {
+	f.adapt(key, latency, false)
+}
+
+// OnDrop reports that a request on key failed or timed out because of
+// overload, to be called before its permit is released. It only matters with
+// a Strategy.
+func (f *Concurrency) OnDrop(key string) {
+	f.adapt(key, 0, true)
+}
+
+func (f *Concurrency) Keys() []string {
+	return f.store.Keys()
+}
+
+func (f *Concurrency) Len() int {
+	return f.store.Len()
+}
+
+func (f *Concurrency) Snapshot(key string) (internal.Snapshot, bool) {
+	e, ok := f.store.Peek(key)
+	if !ok {
+		return internal.Snapshot{}, false
+	}
+	defer e.Unlock()
+	s := &e.State
+
+	now := f.clock.Now()
+	c := f.sync(key, s, now)
+	f.reclaim(key, s, now)
+
+	limit := c.limitOf(s)
+	return internal.Snapshot{
+		Key:       key,
+		Remaining: max(0, limit-len(s.held)),
+		InFlight:  len(s.held),
+		Limit:     limit,
+	}, true
+}
+
+// Reset drops the key and the permits held on it, and the limit it learned.
+// Releasing them afterwards is a no-op.
+func (f *Concurrency) Reset(key string) {
+	f.store.Delete(key)
+}
+
+func (f *Concurrency) ResetAll() {
+	f.store.Clear()
+}
+
+// Reconfigure switches to the Limit and overrides in option. Keys whose limit
+// went down keep the permits they hold above it until released. With a
+// Strategy, Limit is only where new keys start; the others restart the new
+// Strategy from the limit they learned, within the new MaxLimit.
+func (f *Concurrency) Reconfigure(option internal.Options) error {
+	f.config.Store(newConfig(option))
+	return nil
+}
+
+func (f *Concurrency) Close() error {
+	return f.store.Close()
+}
+
+// lock returns the key's entry locked, with its state migrated to the current
+// config.
+func (f *Concurrency) lock(key string) (*internal.Entry[permits], *config) {
+	e := f.store.Lock(key)
+	return e, f.sync(key, &e.State, f.clock.Now())
+}
+
+// sync brings s up to date with the key's current config and returns it.
+// Permits don't depend on the limit, so there is only the strategy to renew,
+// keeping the limit it learned.
+func (f *Concurrency) sync(key string, s *permits, now time.Time) *config {
+	root := f.config.Load()
+	if s.root != root {
+		s.config, s.root = root.tiers.Resolve(key), root
+
+		if c := s.config; c.strategy != nil {
+			s.strategy = c.strategy()
+			if s.estimate == 0 {
+				s.estimate = float64(c.limit)
+			}
+			s.estimate = c.clamp(s.estimate)
+		}
+	}
+	return s.config
+}
+
+// take holds n permits under id if they are free on top of headroom, after
+// reclaiming the leaked ones.
+func (f *Concurrency) take(key string, c *config, s *permits, n, headroom int, id uint64) bool {
+	now := f.clock.Now()
+	f.reclaim(key, s, now)
+
+	if len(s.held)+n+headroom > c.limitOf(s) {
+		return false
+	}
+	s.hold(n, id, now)
+	return true
+}
+
+// wait queues up for the key and then waits until n permits are free on top of
+// priority p's headroom, taking them under id. The key is not locked while
+// waiting, which ends when a permit is released, or reclaimed, or MaxWait runs
+// out.
+func (f *Concurrency) wait(ctx context.Context, key string, n int, p internal.Priority, id uint64) error {
+	return f.queue.DoPriority(ctx, key, p, func(deadline time.Time) error {
+		for {
+			freed, expiry, ok := f.poll(key, n, p, id)
+			if ok {
+				return nil
+			}
+			if freed == nil {
+				return internal.ErrExceedsLimit
+			}
+
+			err := f.sleep(ctx, freed, earliest(expiry, deadline))
+			f.leave(key, freed)
+			if err != nil {
+				return err
+			}
+			if !deadline.IsZero() && !f.clock.Now().Before(deadline) {
+				return internal.ErrMaxWaitExceeded
+			}
+		}
+	})
+}
+
+// sleep blocks until freed is closed, the clock reaches until unless it is
+// zero, or ctx is done.
+func (f *Concurrency) sleep(ctx context.Context, freed chan struct{}, until time.Time) error {
+	var timeout <-chan time.Time
+	if !until.IsZero() {
+		timer := f.clock.NewTimer(until.Sub(f.clock.Now()))
+		defer timer.Stop()
+		timeout = timer.C()
+	}
+
+	select {
+	case <-freed:
+		return nil
+	case <-timeout:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// poll takes the permits wait is after if they are free. Otherwise it returns
+// the channel closed on the next release and when the oldest permit is due to
+// be reclaimed, zero without MaxHold, or a nil channel once the limit went down
+// below n.
+func (f *Concurrency) poll(key string, n int, p internal.Priority, id uint64) (chan struct{}, time.Time, bool) {
+	e, c := f.lock(key)
+	defer e.Unlock()
+	s := &e.State
+
+	now := f.clock.Now()
+	f.reclaim(key, s, now)
+
+	limit := c.limitOf(s)
+	if len(s.held)+n+c.headroom(limit, p) <= limit {
+		s.hold(n, id, now)
+		return nil, time.Time{}, true
+	}
+	if n > limit {
+		return nil, time.Time{}, false
+	}
+
+	if s.freed == nil {
+		s.freed = make(chan struct{})
+	}
+	s.waiters++
+	if len(s.held) == 0 {
+		return s.freed, time.Time{}, false
+	}
+	return s.freed, f.expiry(s.held[0]), false
+}
+
+// leave counts out a caller done waiting on freed, dropping the channel when
+// it was the last one, so the key can go fresh again. A closed channel was
+// replaced already, along with its count.
+func (f *Concurrency) leave(key string, freed chan struct{}) {
+	e, _ := f.lock(key)
+	defer e.Unlock()
+	s := &e.State
+
+	if s.freed != freed {
+		return
+	}
+	s.waiters--
+	if s.waiters == 0 {
+		s.freed = nil
+	}
+}
+
+// releaser returns the function releasing the permit taken under id.
+func (f *Concurrency) releaser(key string, id uint64) func() {
+	return sync.OnceFunc(func() {
+		e, _ := f.lock(key)
+		defer e.Unlock()
+		s := &e.State
+
+		held := len(s.held)
+		s.held = slices.DeleteFunc(s.held, func(p permit) bool { return p.id == id })
+		if len(s.held) < held {
+			s.notify()
+		}
+	})
+}
+
+// adapt feeds the outcome of a request to the key's strategy, waking up the
+// callers waiting for a permit when the limit grows.
+func (f *Concurrency) adapt(key string, latency time.Duration, dropped bool) {
+	e, c := f.lock(key)
+	defer e.Unlock()
+	s := &e.State
+
+	if c.strategy == nil {
+		return
+	}
+
+	limit := c.limitOf(s)
+	s.estimate = c.clamp(s.strategy.Update(s.estimate, internal.Sample{
+		Latency:  latency,
+		InFlight: len(s.held),
+		Dropped:  dropped,
+	}))
+	if c.limitOf(s) > limit {
+		s.notify()
+	}
+}
+
+// commit holds delta more permits for a committed reservation, past the limit
+// if need be, or releases them when negative.
+func (f *Concurrency) commit(key string, delta int) {
+	if delta < 0 {
+		f.Refund(key, -delta)
+		return
+	}
+
+	e, _ := f.lock(key)
+	defer e.Unlock()
+	e.State.hold(delta, 0, f.clock.Now())
+}
+
+// reclaim releases the permits held for MaxHold or longer, reporting each to
+// OnLeak.
+func (f *Concurrency) reclaim(key string, s *permits, now time.Time) {
+	if f.maxHold <= 0 {
+		return
+	}
+
+	leaked := 0
+	for leaked < len(s.held) && !f.expiry(s.held[leaked]).After(now) {
+		if f.onLeak != nil {
+			f.onLeak(key, now.Sub(s.held[leaked].at))
+		}
+		leaked++
+	}
+	if leaked > 0 {
+		s.held = slices.Delete(s.held, 0, leaked)
+		s.notify()
+	}
+}
+
+// expiry is when p is due to be reclaimed, zero without MaxHold.
+func (f *Concurrency) expiry(p permit) time.Time {
+	if f.maxHold <= 0 {
+		return time.Time{}
+	}
+	return p.at.Add(f.maxHold)
+}
+
+// fresh reports whether no permit is held nor waited for, allowing the store
+// to drop the key, along with the limit it learned.
+func (f *Concurrency) fresh(key string, s *permits, now time.Time) bool {
+	f.sync(key, s, now)
+	f.reclaim(key, s, now)
+	return len(s.held) == 0 && s.freed == nil
+}
+
+func (s *permits) hold(n int, id uint64, now time.Time) {
+	for range n {
+		s.held = append(s.held, permit{id, now})
+	}
+}
+
+// notify wakes up the callers waiting for a permit.
+func (s *permits) notify() {
+	if s.freed != nil {
+		close(s.freed)
+		s.freed, s.waiters = nil, 0
+	}
+}
+
+// earliest returns the earlier of two times, ignoring zero ones.
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,589 @@
+package concurrency
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	internal "github.com/sirius1b/go-rate-limit/internal"
+)
+
+func TestConcurrency_TryAcquire(t *testing.T) {
+	limiter := NewConcurrencyLimiter(internal.Options{Limit: 2})
+
+	key := "test_key"
+	first, ok := limiter.TryAcquire(key)
+	if !ok {
+		t.Fatal("Expected the first permit")
+	}
+	if _, ok := limiter.TryAcquire(key); !ok {
+		t.Fatal("Expected the second permit")
+	}
+	if _, ok := limiter.TryAcquire(key); ok {
+		t.Error("Expected no third permit")
+	}
+	if _, ok := limiter.TryAcquire("other_key"); !ok {
+		t.Error("Expected other keys to have their own permits")
+	}
+
+	first()
+	first()
+	if limiter.Token(key) != 1 {
+		t.Errorf("Expected a release to free exactly one permit, got %d free", limiter.Token(key))
+	}
+	if limiter.Rate() <= 1e300 {
+		t.Errorf("Expected no rate limit, got %v", limiter.Rate())
+	}
+}
+
+func TestConcurrency_Acquire(t *testing.T) {
+	limiter := NewConcurrencyLimiter(internal.Options{Limit: 1})
+
+	key := "test_key"
+	release, err := limiter.Acquire(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	done := make(chan error)
+	go func() {
+		r, err := limiter.Acquire(context.Background(), key)
+		if err == nil {
+			r()
+		}
+		done <- err
+	}()
+	for limiter.queue.Len(key) == 0 {
+		runtime.Gosched()
+	}
+
+	select {
+	case <-done:
+		t.Fatal("Expected Acquire to wait for the permit to be released")
+	case <-time.After(time.Millisecond * 10):
+	}
+
+	release()
+	if err := <-done; err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if limiter.Token(key) != 1 {
+		t.Error("Expected every permit to be released")
+	}
+}
+
+func TestConcurrency_AcquireContext(t *testing.T) {
+	limiter := NewConcurrencyLimiter(internal.Options{Limit: 1})
+
+	key := "test_key"
+	limiter.TryAcquire(key)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := limiter.Acquire(ctx, key)
+		done <- err
+	}()
+	for limiter.queue.Len(key) == 0 {
+		runtime.Gosched()
+	}
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
+
+func TestConcurrency_MaxWait(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewConcurrencyLimiter(internal.Options{
+		Limit:   1,
+		MaxWait: time.Second,
+		Clock:   clock,
+	})
+
+	key := "test_key"
+	limiter.Allow(key)
+
+	done := make(chan error)
+	go func() {
+		_, err := limiter.Acquire(context.Background(), key)
+		done <- err
+	}()
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	if err := <-done; !errors.Is(err, internal.ErrMaxWaitExceeded) {
+		t.Errorf("Expected ErrMaxWaitExceeded, got %v", err)
+	}
+}
+
+func TestConcurrency_Concurrency(t *testing.T) {
+	limiter := NewConcurrencyLimiter(internal.Options{Limit: 3})
+
+	key := "test_key"
+	var inFlight, peak atomic.Int64
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := limiter.Acquire(context.Background(), key)
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+				return
+			}
+			defer release()
+
+			current := inFlight.Add(1)
+			for {
+				old := peak.Load()
+				if current <= old || peak.CompareAndSwap(old, current) {
+					break
+				}
+			}
+			runtime.Gosched()
+			inFlight.Add(-1)
+		}()
+	}
+	wg.Wait()
+
+	if peak.Load() > 3 {
+		t.Errorf("Expected at most 3 in flight, saw %d", peak.Load())
+	}
+	if limiter.Token(key) != 3 {
+		t.Errorf("Expected every permit back, got %d free", limiter.Token(key))
+	}
+}
+
+func TestConcurrency_Leak(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	var leaks []time.Duration
+	limiter := NewConcurrencyLimiter(internal.Options{
+		Limit:   1,
+		MaxHold: time.Minute,
+		OnLeak: func(key string, heldFor time.Duration) {
+			leaks = append(leaks, heldFor)
+		},
+		Clock: clock,
+	})
+
+	key := "test_key"
+	release, _ := limiter.TryAcquire(key)
+
+	done := make(chan error)
+	go func() {
+		_, err := limiter.Acquire(context.Background(), key)
+		done <- err
+	}()
+
+	// the waiter gets the permit once it is reclaimed
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+	if err := <-done; err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if len(leaks) != 1 || leaks[0] != time.Minute {
+		t.Errorf("Expected the leak to be reported, got %v", leaks)
+	}
+
+	// releasing a reclaimed permit frees nothing
+	release()
+	if limiter.Token(key) != 0 {
+		t.Error("Expected a late release not to free the waiter's permit")
+	}
+}
+
+func TestConcurrency_AllowDetailed(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewConcurrencyLimiter(internal.Options{
+		Limit:   2,
+		MaxHold: time.Minute,
+		Clock:   clock,
+	})
+
+	key := "test_key"
+	start := clock.Now()
+
+	d := limiter.AllowDetailed(key)
+	if !d.Allowed || d.Limit != 2 || d.Remaining != 1 || !d.ResetAt.Equal(start.Add(time.Minute)) {
+		t.Errorf("Unexpected first decision: %+v", d)
+	}
+
+	clock.Advance(time.Second)
+	limiter.Allow(key)
+	d = limiter.AllowDetailed(key)
+	if d.Allowed || d.Remaining != 0 || d.RetryAfter != time.Second*59 {
+		t.Errorf("Expected to retry once the oldest permit is reclaimed: %+v", d)
+	}
+}
+
+func TestConcurrency_Wait(t *testing.T) {
+	limiter := NewConcurrencyLimiter(internal.Options{Limit: 2})
+
+	key := "test_key"
+	limiter.AllowN(key, 2)
+	if limiter.WaitN(key, 3) {
+		t.Error("Expected WaitN above the limit to return false")
+	}
+
+	done := make(chan bool)
+	go func() {
+		done <- limiter.Wait(key)
+	}()
+	for limiter.queue.Len(key) == 0 {
+		runtime.Gosched()
+	}
+
+	limiter.Refund(key, 1)
+	if !<-done {
+		t.Fatal("Expected Wait to succeed once a permit was given back")
+	}
+	if limiter.Allow(key) {
+		t.Error("Expected Wait to take the permit")
+	}
+
+	if err := limiter.WaitContext(context.Background(), "other_key"); err != nil || limiter.Token("other_key") != 1 {
+		t.Errorf("Expected WaitContext to take a permit, got %v", err)
+	}
+}
+
+func TestConcurrency_Reserve(t *testing.T) {
+	limiter := NewConcurrencyLimiter(internal.Options{Limit: 2})
+
+	key := "test_key"
+	r := limiter.Reserve(key, 2)
+	if !r.OK() || r.Delay() != 0 {
+		t.Fatal("Expected a reservation of free permits to be usable right away")
+	}
+	if limiter.Reserve(key, 1).OK() {
+		t.Error("Expected no reservation while every permit is held")
+	}
+
+	r.Commit(1)
+	if limiter.Token(key) != 1 {
+		t.Errorf("Expected Commit to settle the permits held, got %d free", limiter.Token(key))
+	}
+
+	r = limiter.Reserve(key, 1)
+	r.Cancel()
+	if limiter.Token(key) != 1 {
+		t.Errorf("Expected Cancel to give the permit back, got %d free", limiter.Token(key))
+	}
+}
+
+func TestConcurrency_Refund(t *testing.T) {
+	limiter := NewConcurrencyLimiter(internal.Options{Limit: 3})
+
+	key := "test_key"
+	limiter.TryAcquire(key)
+	limiter.AllowN(key, 2)
+
+	limiter.Refund(key, 5)
+	if limiter.Token(key) != 2 {
+		t.Errorf("Expected Refund to release only the permits Allow took, got %d free", limiter.Token(key))
+	}
+}
+
+func TestConcurrency_Snapshot(t *testing.T) {
+	limiter := NewConcurrencyLimiter(internal.Options{Limit: 3})
+
+	key := "test_key"
+	if _, ok := limiter.Snapshot(key); ok {
+		t.Error("Expected no snapshot for an unknown key")
+	}
+
+	limiter.AllowN(key, 2)
+	if s, ok := limiter.Snapshot(key); !ok || s.InFlight != 2 || s.Remaining != 1 {
+		t.Errorf("Expected 2 permits in flight, got %+v", s)
+	}
+
+	limiter.Reset(key)
+	if limiter.Len() != 0 {
+		t.Error("Expected Reset to drop the key")
+	}
+}
+
+func TestConcurrency_Fresh(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewConcurrencyLimiter(internal.Options{
+		Limit:   1,
+		MaxHold: time.Minute,
+		Clock:   clock,
+	})
+
+	key := "test_key"
+	now := clock.Now()
+	s := &permits{held: []permit{{0, now}}}
+
+	if limiter.fresh(key, s, now) {
+		t.Error("Key with a permit held should not be fresh")
+	}
+	if !limiter.fresh(key, s, now.Add(time.Minute)) {
+		t.Error("Key should be fresh once its permit was reclaimed")
+	}
+}
+
+func TestConcurrency_AbandonedWaiter(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewConcurrencyLimiter(internal.Options{
+		Limit:           2,
+		PriorityReserve: 0.4,
+		IdleTTL:         time.Minute,
+		CleanupInterval: time.Second,
+		Clock:           clock,
+	})
+	defer limiter.Close()
+
+	// two permits at low priority eat into the reserve, so it waits for good
+	key := "test_key"
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- limiter.wait(ctx, key, 2, internal.PriorityLow, 0)
+	}()
+	for waiting := false; !waiting; {
+		runtime.Gosched()
+		if e, ok := limiter.store.Peek(key); ok {
+			waiting = e.State.waiters == 1
+			e.Unlock()
+		}
+	}
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+
+	deadline := time.Now().Add(time.Second)
+	for limiter.Len() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if limiter.Len() != 0 {
+		t.Error("Expected the janitor to drop the key its waiter gave up on")
+	}
+}
+
+func TestConcurrency_Reconfigure(t *testing.T) {
+	limiter := NewConcurrencyLimiter(internal.Options{Limit: 3})
+
+	key := "test_key"
+	limiter.AllowN(key, 3)
+
+	limiter.Reconfigure(internal.Options{Limit: 2})
+	if limiter.Token(key) != 0 {
+		t.Error("Expected the permits above the new limit to stay held")
+	}
+	limiter.Refund(key, 2)
+	if !limiter.Allow(key) || limiter.Allow(key) {
+		t.Error("Expected the new limit to apply")
+	}
+}
+
+func TestConcurrency_WaitNReconfigured(t *testing.T) {
+	limiter := NewConcurrencyLimiter(internal.Options{Limit: 4})
+
+	key := "test_key"
+	limiter.AllowN(key, 2)
+
+	done := make(chan bool)
+	go func() {
+		done <- limiter.WaitN(key, 3)
+	}()
+	for limiter.queue.Len(key) == 0 {
+		runtime.Gosched()
+	}
+
+	limiter.Reconfigure(internal.Options{Limit: 2})
+	limiter.Refund(key, 1)
+	if <-done {
+		t.Error("Expected WaitN to fail once the limit went below n")
+	}
+}
+
+func TestConcurrency_Overrides(t *testing.T) {
+	limiter := NewConcurrencyLimiter(internal.Options{
+		Limit: 1,
+		Overrides: map[string]internal.Options{
+			"batch": {Limit: 4},
+		},
+	})
+
+	if !limiter.AllowN("batch", 4) || limiter.Allow("batch") {
+		t.Error("Expected the override to apply to its key")
+	}
+	if limiter.AllowN("web", 2) {
+		t.Error("Expected other keys to keep the default limit")
+	}
+}
+
+func TestConcurrency_AllowAll(t *testing.T) {
+	limiter := NewConcurrencyLimiter(internal.Options{Limit: 2})
+
+	if !limiter.AllowAll("a", "b", "b") {
+		t.Error("Expected keys with free permits to be allowed")
+	}
+	if limiter.AllowAll("a", "b") {
+		t.Error("Expected denial when one key has none free")
+	}
+	if limiter.Token("a") != 1 {
+		t.Error("Expected a denied AllowAll to take nothing")
+	}
+}
+
+func TestConcurrency_HoldPermits(t *testing.T) {
+	limiter := NewConcurrencyLimiter(internal.Options{Limit: 2})
+
+	keys := []string{"a", "b"}
+	held, release := limiter.HoldPermits(keys, []int{1, 2}, internal.PriorityHigh)
+	if !held.Allowed() {
+		t.Fatal("Expected both keys to have the permits")
+	}
+	held.Commit()
+	held.Unlock()
+
+	if limiter.Token("a") != 1 || limiter.Token("b") != 0 {
+		t.Errorf("Expected the permits to be taken on Commit, got %d and %d free", limiter.Token("a"), limiter.Token("b"))
+	}
+	limiter.Refund("b", 2)
+	if limiter.Token("b") != 0 {
+		t.Error("Expected Refund to leave held permits alone")
+	}
+
+	held = limiter.Hold(keys, []int{1, 1}, internal.PriorityHigh)
+	if held.Allowed() || !held.Decisions[0].Allowed {
+		t.Errorf("Expected only b to deny, got %+v", held.Decisions)
+	}
+	held.Unlock()
+
+	release()
+	if limiter.Token("a") != 2 || limiter.Token("b") != 2 {
+		t.Errorf("Expected the release to free every permit, got %d and %d free", limiter.Token("a"), limiter.Token("b"))
+	}
+}
+
+func TestConcurrency_AllowPriority(t *testing.T) {
+	limiter := NewConcurrencyLimiter(internal.Options{
+		Limit:           10,
+		PriorityReserve: 0.2,
+	})
+
+	key := "test_key"
+	for range 6 {
+		limiter.AllowPriority(key, internal.PriorityLow)
+	}
+	if limiter.Token(key) != 4 {
+		t.Errorf("Expected low priority to leave 4 permits, got %d", limiter.Token(key))
+	}
+	if !limiter.AllowPriority(key, internal.PriorityNormal) || !limiter.AllowPriority(key, internal.PriorityNormal) {
+		t.Error("Expected normal priority to use its share")
+	}
+	if limiter.AllowPriority(key, internal.PriorityNormal) || !limiter.AllowPriority(key, internal.PriorityHigh) {
+		t.Error("Expected the last permits to be kept for high priority")
+	}
+}
+
+func TestConcurrency_Adaptive(t *testing.T) {
+	limiter := NewConcurrencyLimiter(internal.Options{
+		Limit:    2,
+		Strategy: internal.AIMD(1, 0.5),
+		MaxLimit: 3,
+	})
+
+	key := "test_key"
+	if limiter.Limit(key) != 2 {
+		t.Errorf("Expected keys to start from Limit, got %d", limiter.Limit(key))
+	}
+
+	limiter.AllowN(key, 2)
+	for range 3 {
+		limiter.OnSuccess(key, time.Millisecond)
+	}
+	if limiter.Limit(key) != 3 || !limiter.Allow(key) {
+		t.Errorf("Expected the limit to grow under load, got %d", limiter.Limit(key))
+	}
+	for range 10 {
+		limiter.OnSuccess(key, time.Millisecond)
+	}
+	if limiter.Limit(key) != 3 {
+		t.Errorf("Expected the limit to stay within MaxLimit, got %d", limiter.Limit(key))
+	}
+
+	limiter.OnDrop(key)
+	if s, _ := limiter.Snapshot(key); s.Limit != 1 || s.Remaining != 0 {
+		t.Errorf("Expected a drop to halve the limit, got %+v", s)
+	}
+	limiter.OnDrop(key)
+	if limiter.Limit(key) != 1 {
+		t.Errorf("Expected the limit not to go below 1, got %d", limiter.Limit(key))
+	}
+
+	if limiter.Limit("other_key") != 2 {
+		t.Error("Expected other keys to learn limits of their own")
+	}
+}
+
+func TestConcurrency_AdaptiveWait(t *testing.T) {
+	limiter := NewConcurrencyLimiter(internal.Options{
+		Limit:    1,
+		Strategy: internal.AIMD(1, 0.5),
+	})
+
+	key := "test_key"
+	limiter.Allow(key)
+
+	done := make(chan error)
+	go func() {
+		_, err := limiter.Acquire(context.Background(), key)
+		done <- err
+	}()
+	for limiter.queue.Len(key) == 0 {
+		runtime.Gosched()
+	}
+
+	// the permit stays held, but the limit grows
+	limiter.OnSuccess(key, time.Millisecond)
+	if err := <-done; err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if limiter.Limit(key) != 2 {
+		t.Errorf("Expected a limit of 2, got %d", limiter.Limit(key))
+	}
+}
+
+func TestConcurrency_AdaptiveReconfigure(t *testing.T) {
+	limiter := NewConcurrencyLimiter(internal.Options{
+		Limit:    4,
+		Strategy: internal.AIMD(1, 0.5),
+	})
+
+	key := "test_key"
+	limiter.OnDrop(key)
+
+	limiter.Reconfigure(internal.Options{Limit: 8, Strategy: internal.AIMD(1, 0.9), MaxLimit: 10})
+	if limiter.Limit(key) != 2 {
+		t.Errorf("Expected the key to keep its learned limit, got %d", limiter.Limit(key))
+	}
+	if limiter.Limit("other_key") != 8 {
+		t.Error("Expected new keys to start from the new Limit")
+	}
+
+	limiter.AllowN(key, 2)
+	for range 2 {
+		limiter.OnSuccess(key, time.Millisecond)
+	}
+	limiter.OnDrop(key)
+	if limiter.Limit(key) != 2 {
+		t.Errorf("Expected the new strategy to back off by 10%%, got %d", limiter.Limit(key))
+	}
+
+	plain := NewConcurrencyLimiter(internal.Options{Limit: 4})
+	plain.OnDrop(key)
+	if plain.Limit(key) != 4 {
+		t.Error("Expected reports to be ignored without a Strategy")
+	}
+}
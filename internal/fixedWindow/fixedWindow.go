@@ -1,106 +1,432 @@
 package fixedWindow
 
 import (
-	"sync"
+	"context"
+	"sync/atomic"
 	"time"
 
 	internal "github.com/sirius1b/go-rate-limit/internal"
 )
 
 type FixedWindowLimiter struct {
-	limit     int
-	limits    map[string]int
-	startTime map[string]time.Time
-	window    time.Duration
-	mus       map[string]*sync.Mutex
-	globalMu  *sync.Mutex
+	config atomic.Pointer[config]
+	store  *internal.Store[window]
+	queue  *internal.Queue
+
+	clock internal.Clock
 }
 
-func (s *FixedWindowLimiter) getMutex(key string) *sync.Mutex {
-	s.globalMu.Lock()
-	defer s.globalMu.Unlock()
-	if _, exists := s.mus[key]; !exists {
-		s.mus[key] = &sync.Mutex{}
-	}
-	return s.mus[key]
+// config holds the Limit, Window and PriorityReserve of a key, swapped out as
+// a whole by Reconfigure.
+type config struct {
+	limit   int
+	window  time.Duration
+	reserve float64
+
+	tiers internal.Tiers[config]
+}
+
+type window struct {
+	count     int
+	startTime time.Time
+
+	// config the state was last brought up to date with, resolved from the
+	// limiter's config root; both nil while fresh
+	config *config
+	root   *config
 }
 
 func NewFixedWindowLimiter(option internal.Options) *FixedWindowLimiter {
-	return &FixedWindowLimiter{
-		limit:     option.Limit,
-		startTime: make(map[string]time.Time),
-		window:    option.Window,
-		limits:    make(map[string]int),
-		mus:       make(map[string]*sync.Mutex),
-		globalMu:  &sync.Mutex{},
+	f := &FixedWindowLimiter{
+		clock: option.ClockOrDefault(),
 	}
+	f.config.Store(newConfig(option))
+	f.store = internal.NewStore(option, f.fresh)
+	f.queue = internal.NewQueue(option)
+	return f
+}
+
+// headroom is how much of the limit priority p has to leave untouched.
+func (c *config) headroom(p internal.Priority) int {
+	return internal.Headroom(c.limit, c.reserve, p)
+}
+
+func newConfig(option internal.Options) *config {
+	c := &config{limit: option.Limit, window: option.Window, reserve: option.PriorityReserve}
+	c.tiers = internal.NewTiers(option, c, newConfig)
+	return c
 }
 
 func (f *FixedWindowLimiter) Allow(key string) bool {
-	mu := f.getMutex(key)
-	mu.Lock()
-	defer mu.Unlock()
+	return f.AllowN(key, 1)
+}
+
+func (f *FixedWindowLimiter) AllowN(key string, n int) bool {
+	e, c := f.lock(key)
+	defer e.Unlock()
+	w := &e.State
+
+	if n <= 0 || n > c.limit {
+		return false
+	}
 
-	now := time.Now()
+	c.roll(w, f.clock.Now())
 
-	if _, exists := f.limits[key]; !exists {
-		f.limits[key] = 0
-		f.startTime[key] = now
+	if w.count+n <= c.limit {
+		w.count += n
+		return true
+	}
+
+	return false
+}
+
+// AllowAll takes a unit from each of keys, two from a key listed twice, but
+// only if every one of them has it.
+func (f *FixedWindowLimiter) AllowAll(keys ...string) bool {
+	keys, counts := internal.Tally(keys)
+	entries := f.store.LockAll(keys)
+	defer internal.UnlockAll(entries)
+
+	now := f.clock.Now()
+	for index, e := range entries {
+		w := &e.State
+		c := f.sync(keys[index], w, now)
+		c.roll(w, now)
+
+		if w.count+counts[index] > c.limit {
+			return false
+		}
 	}
 
-	if now.Sub(f.startTime[key]) >= f.window {
-		f.startTime[key] = now
-		f.limits[key] = 0
+	for index, e := range entries {
+		e.State.count += counts[index]
 	}
+	return true
+}
+
+// AllowPriority is Allow for a request of priority p, denied while taking the
+// unit would eat into the share of the limit PriorityReserve keeps for
+// higher priorities.
+func (f *FixedWindowLimiter) AllowPriority(key string, p internal.Priority) bool {
+	e, c := f.lock(key)
+	defer e.Unlock()
+	w := &e.State
 
-	if f.limits[key] < f.limit {
-		f.limits[key]++
+	c.roll(w, f.clock.Now())
+
+	if w.count+1+c.headroom(p) <= c.limit {
+		w.count++
 		return true
 	}
 
 	return false
 }
 
+func (f *FixedWindowLimiter) AllowDetailed(key string) internal.Decision {
+	e, c := f.lock(key)
+	defer e.Unlock()
+	w := &e.State
+
+	now := f.clock.Now()
+	c.roll(w, now)
+
+	return c.admit(w, 1, internal.PriorityHigh, now)
+}
+
+// HoldOrder implements internal.Holder.
+func (f *FixedWindowLimiter) HoldOrder() uint64 {
+	return f.store.Order()
+}
+
+// Hold implements internal.Holder, deciding for each key as AllowDetailed does.
+func (f *FixedWindowLimiter) Hold(keys []string, counts []int, p internal.Priority) *internal.Held {
+	now := f.clock.Now()
+	return f.store.Hold(keys, func(index int, w *window) (window, internal.Decision) {
+		c := f.sync(keys[index], w, now)
+		c.roll(w, now)
+
+		held := *w
+		decision := c.admit(&held, counts[index], p, now)
+		return held, decision
+	})
+}
+
+// Wait blocks until a unit is free and takes it. The key is not locked while
+// sleeping, and the unit is claimed on waking up, starting over if another
+// caller got to it first. It returns false when the key's queue is full or the
+// wait would exceed MaxWait.
 func (f *FixedWindowLimiter) Wait(key string) bool {
-	mu := f.getMutex(key)
-	mu.Lock()
-	defer mu.Unlock()
+	return f.WaitN(key, 1)
+}
+
+func (f *FixedWindowLimiter) WaitN(key string, n int) bool {
+	if n <= 0 {
+		return false
+	}
 
-	now := time.Now()
+	return f.wait(context.Background(), key, n, internal.PriorityHigh) == nil
+}
 
-	if _, exists := f.limits[key]; !exists {
-		f.limits[key] = 0
-		f.startTime[key] = now
+func (f *FixedWindowLimiter) WaitContext(ctx context.Context, key string) error {
+	return f.wait(ctx, key, 1, internal.PriorityHigh)
+}
+
+// WaitPriority is Wait for a request of priority p, which goes ahead of lower
+// priorities in the key's queue.
+func (f *FixedWindowLimiter) WaitPriority(key string, p internal.Priority) bool {
+	return f.wait(context.Background(), key, 1, p) == nil
+}
+
+func (f *FixedWindowLimiter) Reserve(key string, n int) *internal.Reservation {
+	e, c := f.lock(key)
+	defer e.Unlock()
+	w := &e.State
+
+	if n <= 0 || n > c.limit {
+		return internal.NewReservation(f.clock, false, time.Time{}, nil)
 	}
 
-	elapsed := now.Sub(f.startTime[key])
+	now := f.clock.Now()
+	c.roll(w, now)
 
-	if f.limits[key] >= f.limit {
-		sleepTime := f.window - elapsed
-		time.Sleep(sleepTime)
+	// units beyond the current window's limit are carried into the next ones
+	readyAt := c.next(w, n, now)
+	w.count += n
+
+	return internal.NewReservation(f.clock, true, readyAt, func() {
+		f.cancel(key, n, readyAt)
+	}).OnCommit(func(actual int) {
+		f.commit(key, actual-n)
+	})
+}
 
-		f.startTime[key] = time.Now()
-		f.limits[key] = 0
+// Refund gives n units back to the key's current window, as when a request
+// turned out not to count.
+func (f *FixedWindowLimiter) Refund(key string, n int) {
+	if n <= 0 {
+		return
 	}
 
-	return true
+	e, c := f.lock(key)
+	defer e.Unlock()
+	w := &e.State
+
+	c.roll(w, f.clock.Now())
+	w.count = max(0, w.count-n)
 }
 
 func (f *FixedWindowLimiter) Rate() float64 {
-	return float64(f.limit) / float64(f.window.Seconds())
+	c := f.config.Load()
+	return float64(c.limit) / float64(c.window.Seconds())
 }
 
 func (f *FixedWindowLimiter) Token(key string) int {
-	mu := f.getMutex(key)
-	mu.Lock()
-	defer mu.Unlock()
+	e, ok := f.store.Peek(key)
+	if !ok {
+		return f.config.Load().tiers.Resolve(key).limit
+	}
+	defer e.Unlock()
 
-	now := time.Now()
+	now := f.clock.Now()
+	c := f.sync(key, &e.State, now)
+
+	w := e.State
+	c.roll(&w, now)
+	return max(0, c.limit-w.count)
+}
+
+func (f *FixedWindowLimiter) Keys() []string {
+	return f.store.Keys()
+}
+
+func (f *FixedWindowLimiter) Len() int {
+	return f.store.Len()
+}
 
-	if _, exists := f.limits[key]; !exists {
-		f.limits[key] = 0
-		f.startTime[key] = now
+func (f *FixedWindowLimiter) Snapshot(key string) (internal.Snapshot, bool) {
+	e, ok := f.store.Peek(key)
+	if !ok {
+		return internal.Snapshot{}, false
 	}
+	defer e.Unlock()
+
+	now := f.clock.Now()
+	w := e.State
+	c := f.sync(key, &w, now)
+	c.roll(&w, now)
+
+	return internal.Snapshot{
+		Key:         key,
+		Remaining:   max(0, c.limit-w.count),
+		Count:       w.count,
+		WindowStart: w.startTime,
+	}, true
+}
+
+func (f *FixedWindowLimiter) Reset(key string) {
+	f.store.Delete(key)
+}
+
+func (f *FixedWindowLimiter) ResetAll() {
+	f.store.Clear()
+}
+
+// Reconfigure switches to the Limit, Window and overrides in option. Each key's
+// count is rescaled to its new limit the next time the key is used, keeping the
+// share of the window already spent.
+func (f *FixedWindowLimiter) Reconfigure(option internal.Options) error {
+	f.config.Store(newConfig(option))
+	return nil
+}
+
+func (f *FixedWindowLimiter) Close() error {
+	return f.store.Close()
+}
+
+// lock returns the key's entry locked, with its state migrated to the current
+// config.
+func (f *FixedWindowLimiter) lock(key string) (*internal.Entry[window], *config) {
+	e := f.store.Lock(key)
+	return e, f.sync(key, &e.State, f.clock.Now())
+}
+
+// sync brings w up to date with the key's current config and returns it.
+func (f *FixedWindowLimiter) sync(key string, w *window, now time.Time) *config {
+	root := f.config.Load()
+	if w.root == root {
+		return w.config
+	}
+
+	c := root.tiers.Resolve(key)
+	if old := w.config; old != nil {
+		old.roll(w, now)
+		// rounded up so that shrinking the limit never frees up units
+		w.count = (w.count*c.limit + old.limit - 1) / old.limit
+	}
+	w.config, w.root = c, root
+	return c
+}
+
+// wait queues up for the key and then waits until delay reports no more
+// waiting is needed.
+func (f *FixedWindowLimiter) wait(ctx context.Context, key string, n int, p internal.Priority) error {
+	return f.queue.DoPriority(ctx, key, p, func(deadline time.Time) error {
+		return internal.WaitUntil(ctx, f.clock, deadline, func() time.Duration {
+			return f.delay(key, n, p)
+		})
+	})
+}
+
+// delay reports how long until n units fit in the key's window, consuming them
+// right away when they already fit. Priority p has to leave its headroom
+// untouched.
+func (f *FixedWindowLimiter) delay(key string, n int, p internal.Priority) time.Duration {
+	e, c := f.lock(key)
+	defer e.Unlock()
+	w := &e.State
+
+	if n > c.limit {
+		// the limit went down below n since the wait started
+		return internal.InfDuration
+	}
+
+	now := f.clock.Now()
+	c.roll(w, now)
+
+	readyAt := c.next(w, n+c.headroom(p), now)
+	if readyAt.After(now) {
+		return readyAt.Sub(now)
+	}
+
+	w.count += n
+	return 0
+}
+
+// admit takes n units from w for a request of priority p if they fit, and
+// describes w afterwards. More than the limit never fits, so that is denied
+// without a RetryAfter.
+func (c *config) admit(w *window, n int, p internal.Priority, now time.Time) internal.Decision {
+	decision := internal.Decision{Limit: c.limit}
+
+	readyAt := c.next(w, n+c.headroom(p), now)
+	switch {
+	case n > c.limit:
+	case readyAt.After(now):
+		decision.RetryAfter = readyAt.Sub(now)
+	default:
+		w.count += n
+		decision.Allowed = true
+	}
+
+	// reserved units spilling into later windows push the reset back
+	windows := 1 + max(0, w.count-1)/c.limit
+	decision.Remaining = max(0, c.limit-w.count)
+	decision.ResetAt = w.startTime.Add(time.Duration(windows) * c.window)
+
+	return decision
+}
+
+// next returns the start of the window in which n more units fit, assuming
+// nothing else is taken from the key in the meantime.
+func (c *config) next(w *window, n int, now time.Time) time.Time {
+	windows := (w.count + n - 1) / c.limit
+	if windows == 0 {
+		return now
+	}
+
+	return w.startTime.Add(time.Duration(windows) * c.window)
+}
+
+func (f *FixedWindowLimiter) cancel(key string, n int, readyAt time.Time) {
+	e, c := f.lock(key)
+	defer e.Unlock()
+	w := &e.State
+
+	now := f.clock.Now()
+	if !readyAt.After(now) {
+		return
+	}
+
+	c.roll(w, now)
+	w.count = max(0, w.count-n)
+}
+
+// commit charges the key delta more units for a committed reservation, or
+// refunds them when negative.
+func (f *FixedWindowLimiter) commit(key string, delta int) {
+	e, c := f.lock(key)
+	defer e.Unlock()
+	w := &e.State
+
+	c.roll(w, f.clock.Now())
+	w.count = max(0, w.count+delta)
+}
+
+func (c *config) roll(w *window, now time.Time) {
+	if w.startTime.IsZero() {
+		w.startTime = now
+	}
+
+	elapsed := now.Sub(w.startTime)
+	if elapsed < c.window {
+		return
+	}
+
+	// reserved units spill over into the windows following the current one
+	windows := int(elapsed / c.window)
+	if w.count > windows*c.limit {
+		w.startTime = w.startTime.Add(time.Duration(windows) * c.window)
+		w.count -= windows * c.limit
+		return
+	}
+
+	w.startTime = now
+	w.count = 0
+}
 
-	return f.limit - f.limits[key]
+// fresh reports whether the window is as good as a new one, allowing the store
+// to drop the key.
+func (f *FixedWindowLimiter) fresh(key string, w *window, now time.Time) bool {
+	f.sync(key, w, now).roll(w, now)
+	return w.count == 0
 }
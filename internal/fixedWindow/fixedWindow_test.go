@@ -1,7 +1,11 @@
 package fixedWindow
 
 import (
+	"context"
+	"errors"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -9,9 +13,11 @@ import (
 )
 
 func TestFixedWindowLimiter_Allow(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
 	limiter := NewFixedWindowLimiter(internal.Options{
 		Limit:  2,
 		Window: time.Second,
+		Clock:  clock,
 	})
 
 	key := "test_key"
@@ -30,7 +36,7 @@ func TestFixedWindowLimiter_Allow(t *testing.T) {
 	}
 
 	// Wait for the window to pass
-	time.Sleep(time.Second)
+	clock.Advance(time.Second)
 
 	// Request after the window should be allowed again
 	if !limiter.Allow(key) {
@@ -47,6 +53,7 @@ func TestFixedWindowLimiter_Allow_Concurrency(t *testing.T) {
 	key := "test_key"
 	numRequests := 20
 	var allowedCount int
+	var mu sync.Mutex // Protects allowedCount
 	var wg sync.WaitGroup
 
 	for i := 0; i < numRequests; i++ {
@@ -54,7 +61,9 @@ func TestFixedWindowLimiter_Allow_Concurrency(t *testing.T) {
 		go func() {
 			defer wg.Done()
 			if limiter.Allow(key) {
+				mu.Lock()
 				allowedCount++
+				mu.Unlock()
 			}
 		}()
 	}
@@ -67,9 +76,11 @@ func TestFixedWindowLimiter_Allow_Concurrency(t *testing.T) {
 }
 
 func TestFixedWindowLimiter_Wait(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
 	limiter := NewFixedWindowLimiter(internal.Options{
 		Limit:  1,
 		Window: time.Millisecond * 100,
+		Clock:  clock,
 	})
 
 	key := "test_key"
@@ -79,23 +90,56 @@ func TestFixedWindowLimiter_Wait(t *testing.T) {
 		t.Error("First request should be allowed")
 	}
 
-	startTime := time.Now()
+	go func() {
+		clock.BlockUntil(1)
+		clock.Advance(time.Millisecond * 100)
+	}()
+
+	startTime := clock.Now()
 	// Second request should be block
 	if !limiter.Wait(key) {
 		t.Error("Second request should return true")
 	}
-	elapsedTime := time.Since(startTime)
+	elapsedTime := clock.Now().Sub(startTime)
 
 	// Check the waiting time to be roughly within the window
 	if elapsedTime < time.Millisecond*100 {
-		t.Errorf("Wait time should be around the window %v, was: %v", limiter.window, elapsedTime)
+		t.Errorf("Wait time should be around the window %v, was: %v", limiter.config.Load().window, elapsedTime)
 	}
 
-	// Allow should now return true because of Wait
-	if !limiter.Allow(key) {
-		t.Error("Should be allowed, as waited")
+	// Wait took the unit of the new window
+	if limiter.Allow(key) {
+		t.Error("Should be denied, as Wait consumed the unit")
+	}
+}
+
+func TestFixedWindowLimiter_WaitUnlocked(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewFixedWindowLimiter(internal.Options{
+		Limit:  1,
+		Window: time.Minute,
+		Clock:  clock,
+	})
+
+	key := "test_key"
+	limiter.Allow(key)
+
+	done := make(chan bool)
+	go func() { done <- limiter.Wait(key) }()
+	clock.BlockUntil(1)
+
+	// the key stays usable while Wait sleeps
+	if limiter.Token(key) != 0 || limiter.Allow(key) {
+		t.Error("Expected the window to stay exhausted while waiting")
 	}
 
+	clock.Advance(time.Minute)
+	if !<-done {
+		t.Error("Expected Wait to return true")
+	}
+	if limiter.Token(key) != 0 {
+		t.Error("Expected Wait to take the unit of the new window")
+	}
 }
 
 func TestFixedWindowLimiter_Limit(t *testing.T) {
@@ -111,9 +155,11 @@ func TestFixedWindowLimiter_Limit(t *testing.T) {
 }
 
 func TestFixedWindowLimiter_Token(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
 	limiter := NewFixedWindowLimiter(internal.Options{
 		Limit:  3,
 		Window: time.Second,
+		Clock:  clock,
 	})
 
 	key := "test_key"
@@ -141,11 +187,11 @@ func TestFixedWindowLimiter_Token(t *testing.T) {
 	}
 
 	// Wait for the window to pass
-	time.Sleep(time.Second)
+	clock.Advance(time.Second)
 
-	// Token count should still be 3 because the startTime and limits are only updated inside the Allow function
-	if limiter.Token(key) != 0 {
-		t.Errorf("Token count should be 0 after waiting since it does not update on token call, but was %d", limiter.Token(key))
+	// Token sees the new window, as Snapshot does, without starting it
+	if snapshot, _ := limiter.Snapshot(key); limiter.Token(key) != 3 || snapshot.Remaining != 3 {
+		t.Errorf("Token count should be 3 once the window passed, but was %d", limiter.Token(key))
 	}
 
 	// Call Allow one more time to reset the window and counter
@@ -180,3 +226,523 @@ func TestFixedWindowLimiter_MultipleKeys(t *testing.T) {
 		t.Error("key2: Second request should be denied")
 	}
 }
+
+func TestFixedWindowLimiter_WaitContext(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewFixedWindowLimiter(internal.Options{
+		Limit:  1,
+		Window: time.Millisecond * 100,
+		Clock:  clock,
+	})
+
+	key := "test_key"
+
+	// Capacity available, should return immediately and take it
+	if err := limiter.WaitContext(context.Background(), key); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if limiter.Allow(key) {
+		t.Error("Should be denied, as WaitContext took the unit")
+	}
+
+	// Deadline shorter than the remaining window should fail fast
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	if err := limiter.WaitContext(ctx, key); !errors.Is(err, internal.ErrWaitExceedsDeadline) {
+		t.Errorf("Expected ErrWaitExceedsDeadline, got %v", err)
+	}
+	if clock.Timers() != 0 {
+		t.Error("WaitContext should fail fast without starting a timer")
+	}
+
+	// Cancellation should unblock the waiter
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		clock.BlockUntil(1)
+		cancel()
+	}()
+	if err := limiter.WaitContext(ctx, key); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+
+	// Without a deadline it should wait for the window to pass
+	go func() {
+		clock.BlockUntil(1)
+		clock.Advance(time.Millisecond * 100)
+	}()
+	if err := limiter.WaitContext(context.Background(), key); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if limiter.Allow(key) {
+		t.Error("Should be denied, as WaitContext took the unit it waited for")
+	}
+}
+
+func TestFixedWindowLimiter_AllowN(t *testing.T) {
+	limiter := NewFixedWindowLimiter(internal.Options{
+		Limit:  5,
+		Window: time.Second,
+	})
+
+	key := "test_key"
+
+	if !limiter.AllowN(key, 3) {
+		t.Error("Request of 3 should be allowed")
+	}
+	if limiter.AllowN(key, 3) {
+		t.Error("Request of 3 should be denied, only 2 left")
+	}
+	if limiter.Token(key) != 2 {
+		t.Errorf("Denied request should not consume, tokens: %d", limiter.Token(key))
+	}
+	if !limiter.AllowN(key, 2) {
+		t.Error("Request of 2 should be allowed")
+	}
+	if limiter.AllowN(key, 6) {
+		t.Error("Request larger than the limit should be denied")
+	}
+}
+
+func TestFixedWindowLimiter_WaitN(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewFixedWindowLimiter(internal.Options{
+		Limit:  3,
+		Window: time.Millisecond * 100,
+		Clock:  clock,
+	})
+
+	key := "test_key"
+
+	if limiter.WaitN(key, 4) {
+		t.Error("WaitN larger than the limit should return false instead of blocking")
+	}
+
+	limiter.AllowN(key, 2)
+
+	go func() {
+		clock.BlockUntil(1)
+		clock.Advance(time.Millisecond * 100)
+	}()
+
+	start := clock.Now()
+	if !limiter.WaitN(key, 2) {
+		t.Error("WaitN should return true")
+	}
+	elapsedTime := clock.Now().Sub(start)
+
+	if elapsedTime != time.Millisecond*100 {
+		t.Errorf("WaitN should wait for the next window, waited %v", elapsedTime)
+	}
+	if limiter.Token(key) != 1 {
+		t.Errorf("WaitN should consume 2 tokens, tokens left: %d", limiter.Token(key))
+	}
+}
+
+func TestFixedWindowLimiter_Reserve(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewFixedWindowLimiter(internal.Options{
+		Limit:  2,
+		Window: time.Millisecond * 100,
+		Clock:  clock,
+	})
+
+	key := "test_key"
+	start := clock.Now()
+
+	r := limiter.Reserve(key, 2)
+	if !r.OK() || r.Delay() != 0 {
+		t.Errorf("First reservation should be usable right away, delay: %v", r.Delay())
+	}
+
+	// Next reservation lands in the following window
+	r = limiter.Reserve(key, 1)
+	if !r.OK() {
+		t.Fatal("Second reservation should be OK")
+	}
+	if r.Delay() != time.Millisecond*100 {
+		t.Errorf("Second reservation should be delayed by a window, was: %v", r.Delay())
+	}
+	if limiter.Allow(key) {
+		t.Error("Allow should be denied while capacity is reserved")
+	}
+
+	// Cancelling hands the unit back to the following window
+	r.Cancel()
+	r.Cancel()
+	r = limiter.Reserve(key, 2)
+	if !r.ReadyAt().Equal(start.Add(limiter.config.Load().window)) {
+		t.Errorf("Reservation should be ready at the start of the next window, was: %v", r.ReadyAt())
+	}
+
+	clock.Advance(r.Delay())
+	if limiter.Allow(key) {
+		t.Error("Reserved window should have no capacity left")
+	}
+
+	if r := limiter.Reserve(key, 3); r.OK() || r.Delay() != internal.InfDuration {
+		t.Error("Reservation larger than the limit should not be OK")
+	}
+}
+
+func TestFixedWindowLimiter_AllowDetailed(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewFixedWindowLimiter(internal.Options{
+		Limit:  2,
+		Window: time.Second,
+		Clock:  clock,
+	})
+
+	key := "test_key"
+	resetAt := clock.Now().Add(time.Second)
+
+	d := limiter.AllowDetailed(key)
+	if !d.Allowed || d.Limit != 2 || d.Remaining != 1 || d.RetryAfter != 0 {
+		t.Errorf("Unexpected first decision: %+v", d)
+	}
+	if !d.ResetAt.Equal(resetAt) {
+		t.Errorf("ResetAt should be the end of the window %v, was: %v", resetAt, d.ResetAt)
+	}
+
+	clock.Advance(time.Millisecond * 400)
+	limiter.Allow(key)
+
+	d = limiter.AllowDetailed(key)
+	if d.Allowed || d.Remaining != 0 {
+		t.Errorf("Third request should be denied with nothing remaining: %+v", d)
+	}
+	if d.RetryAfter != time.Millisecond*600 {
+		t.Errorf("RetryAfter should be the rest of the window, was: %v", d.RetryAfter)
+	}
+	if !d.ResetAt.Equal(resetAt) {
+		t.Errorf("Denied request should not move ResetAt, was: %v", d.ResetAt)
+	}
+}
+
+func TestFixedWindowLimiter_MaxKeys(t *testing.T) {
+	limiter := NewFixedWindowLimiter(internal.Options{
+		Limit:   1,
+		Window:  time.Second,
+		MaxKeys: 1,
+	})
+	defer limiter.Close()
+
+	limiter.Allow("key1")
+	limiter.Allow("key2")
+
+	// key1 was evicted to make room for key2 and starts over
+	if !limiter.Allow("key1") {
+		t.Error("key1: Request after eviction should be allowed")
+	}
+}
+
+func TestFixedWindowLimiter_Fresh(t *testing.T) {
+	limiter := NewFixedWindowLimiter(internal.Options{
+		Limit:  1,
+		Window: time.Second,
+	})
+
+	key := "test_key"
+	now := time.Now()
+	w := &window{count: 1, startTime: now}
+
+	if limiter.fresh(key, w, now.Add(time.Millisecond*500)) {
+		t.Error("Window with requests should not be fresh")
+	}
+	if !limiter.fresh(key, w, now.Add(time.Second)) {
+		t.Error("Window should be fresh once it passed")
+	}
+
+	// reservations carried into the next window keep it alive
+	w = &window{count: 2, startTime: now}
+	if limiter.fresh(key, w, now.Add(time.Second)) {
+		t.Error("Window with carried reservations should not be fresh")
+	}
+}
+
+func TestFixedWindowLimiter_Snapshot(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewFixedWindowLimiter(internal.Options{
+		Limit:  5,
+		Window: time.Second,
+		Clock:  clock,
+	})
+
+	if limiter.Token("user1") != 5 || limiter.Len() != 0 {
+		t.Error("Expected Token not to start tracking the key")
+	}
+	if _, ok := limiter.Snapshot("user1"); ok {
+		t.Error("Expected no snapshot for an untracked key")
+	}
+
+	start := clock.Now()
+	limiter.AllowN("user1", 3)
+	limiter.Allow("user2")
+
+	snapshot, ok := limiter.Snapshot("user1")
+	if !ok || snapshot.Count != 3 || snapshot.Remaining != 2 || !snapshot.WindowStart.Equal(start) {
+		t.Errorf("Unexpected snapshot: %+v", snapshot)
+	}
+	if keys := limiter.Keys(); len(keys) != 2 || limiter.Len() != 2 {
+		t.Errorf("Expected 2 keys, got %v", keys)
+	}
+
+	limiter.Reset("user1")
+	if limiter.Len() != 1 || limiter.Token("user1") != 5 {
+		t.Error("Expected Reset to forget the key")
+	}
+
+	limiter.ResetAll()
+	if limiter.Len() != 0 || len(limiter.Keys()) != 0 {
+		t.Error("Expected ResetAll to forget every key")
+	}
+}
+
+func TestFixedWindowLimiter_Reconfigure(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewFixedWindowLimiter(internal.Options{
+		Limit:  10,
+		Window: time.Second,
+		Clock:  clock,
+	})
+
+	key := "test_key"
+	limiter.AllowN(key, 5)
+
+	limiter.Reconfigure(internal.Options{Limit: 4, Window: time.Minute})
+	if tokens := limiter.Token(key); tokens != 2 {
+		t.Errorf("Expected count to be rescaled to 2 of 4, leaving 2, got %d", tokens)
+	}
+	if rate := limiter.Rate(); rate != 4.0/60 {
+		t.Errorf("Expected rate of the new config, got %v", rate)
+	}
+
+	limiter.Reconfigure(internal.Options{Limit: 8, Window: time.Minute})
+	if tokens := limiter.Token(key); tokens != 4 {
+		t.Errorf("Expected count to be rescaled to 4 of 8, leaving 4, got %d", tokens)
+	}
+
+	// the window started before the change keeps its start, but now lasts a minute
+	clock.Advance(time.Second * 30)
+	if !limiter.AllowN(key, 4) || limiter.Allow(key) {
+		t.Error("Expected the longer window to still be running")
+	}
+	clock.Advance(time.Second * 30)
+	if !limiter.AllowN(key, 8) {
+		t.Error("Expected a new window after a minute")
+	}
+}
+
+func TestFixedWindowLimiter_Overrides(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	options := internal.Options{
+		Limit:  2,
+		Window: time.Second,
+		Clock:  clock,
+		Overrides: map[string]internal.Options{
+			"pro": {Limit: 10},
+		},
+		LimitFunc: func(key string) internal.Options {
+			if key == "enterprise" {
+				return internal.Options{Limit: 100, Window: time.Minute}
+			}
+			return internal.Options{}
+		},
+	}
+	limiter := NewFixedWindowLimiter(options)
+
+	for key, limit := range map[string]int{"free": 2, "pro": 10, "enterprise": 100} {
+		if limiter.Token(key) != limit {
+			t.Errorf("%s: expected %d tokens before first use, got %d", key, limit, limiter.Token(key))
+		}
+		if !limiter.AllowN(key, limit) || limiter.Allow(key) {
+			t.Errorf("%s: expected a limit of %d", key, limit)
+		}
+		if d := limiter.AllowDetailed(key); d.Limit != limit {
+			t.Errorf("%s: expected AllowDetailed to report %d, got %d", key, limit, d.Limit)
+		}
+	}
+
+	clock.Advance(time.Second)
+	if !limiter.Allow("pro") || limiter.Allow("enterprise") {
+		t.Error("Expected the enterprise window to last a minute")
+	}
+
+	// upgrading free to pro at runtime keeps the share already used
+	options.Overrides = map[string]internal.Options{"free": {Limit: 10}}
+	limiter.Reconfigure(options)
+	if tokens := limiter.Token("free"); tokens != 10 {
+		t.Errorf("Expected free to move to the new override in the new window, got %d", tokens)
+	}
+	if tokens := limiter.Token("pro"); tokens != 1 {
+		t.Errorf("Expected pro to fall back to the default limit, got %d", tokens)
+	}
+}
+
+func TestFixedWindowLimiter_Refund(t *testing.T) {
+	limiter := NewFixedWindowLimiter(internal.Options{
+		Limit:  3,
+		Window: time.Minute,
+	})
+
+	key := "test_key"
+	limiter.AllowN(key, 3)
+	limiter.Refund(key, 2)
+	if tokens := limiter.Token(key); tokens != 2 {
+		t.Errorf("Expected 2 units back, got %d", tokens)
+	}
+
+	limiter.Refund(key, 5)
+	if tokens := limiter.Token(key); tokens != 3 {
+		t.Errorf("Expected refunds not to exceed the limit, got %d", tokens)
+	}
+}
+
+func TestFixedWindowLimiter_AllowAll(t *testing.T) {
+	limiter := NewFixedWindowLimiter(internal.Options{
+		Limit:  2,
+		Window: time.Minute,
+	})
+
+	if !limiter.AllowAll("ip", "api_key", "ip") {
+		t.Fatal("Expected every key to have room")
+	}
+	if limiter.AllowAll("api_key", "ip") {
+		t.Error("Expected the exhausted ip to deny")
+	}
+	if tokens := limiter.Token("api_key"); tokens != 1 {
+		t.Errorf("Expected nothing taken from api_key on denial, got %d left", tokens)
+	}
+	if !limiter.AllowAll() {
+		t.Error("Expected a request without keys to be admitted")
+	}
+}
+
+func TestFixedWindowLimiter_AllowAll_Concurrency(t *testing.T) {
+	limiter := NewFixedWindowLimiter(internal.Options{
+		Limit:  10,
+		Window: time.Minute,
+	})
+
+	// every request takes the shared key and one of the others, locked in
+	// opposite orders, so a wrong lock order would deadlock
+	var allowed atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 40; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			keys := []string{"shared", "key-" + strconv.Itoa(i%4)}
+			if i%2 == 0 {
+				keys[0], keys[1] = keys[1], keys[0]
+			}
+			if limiter.AllowAll(keys...) {
+				allowed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed.Load() != 10 || limiter.Token("shared") != 0 {
+		t.Errorf("Expected exactly the shared limit to be admitted, got %d", allowed.Load())
+	}
+}
+
+func TestFixedWindowLimiter_MaxWait(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewFixedWindowLimiter(internal.Options{
+		Limit:   1,
+		Window:  time.Minute,
+		Clock:   clock,
+		MaxWait: time.Second,
+	})
+
+	key := "test_key"
+	limiter.Allow(key)
+	if limiter.Wait(key) {
+		t.Error("Expected Wait to give up on a window a minute away")
+	}
+	if limiter.WaitN(key, 1) {
+		t.Error("Expected WaitN to give up on a window a minute away")
+	}
+	err := limiter.WaitContext(context.Background(), key)
+	if !errors.Is(err, internal.ErrMaxWaitExceeded) {
+		t.Errorf("Expected ErrMaxWaitExceeded, got %v", err)
+	}
+}
+
+func TestFixedWindowLimiter_Priority(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewFixedWindowLimiter(internal.Options{
+		Limit:           10,
+		Window:          time.Minute,
+		Clock:           clock,
+		PriorityReserve: 0.2,
+	})
+
+	key := "test_key"
+	allowed := map[internal.Priority]int{}
+	for _, p := range []internal.Priority{internal.PriorityLow, internal.PriorityNormal, internal.PriorityHigh} {
+		for limiter.AllowPriority(key, p) {
+			allowed[p]++
+		}
+	}
+	if allowed[internal.PriorityLow] != 6 || allowed[internal.PriorityNormal] != 2 || allowed[internal.PriorityHigh] != 2 {
+		t.Errorf("Expected low to stop at 4 left and normal at 2, got %v", allowed)
+	}
+
+	clock.Advance(time.Minute)
+	limiter.AllowN(key, 8)
+	done := make(chan bool)
+	go func() { done <- limiter.WaitPriority(key, internal.PriorityNormal) }()
+	clock.BlockUntil(1)
+	if !limiter.WaitPriority(key, internal.PriorityHigh) {
+		t.Error("Expected high priority to get the reserved units without waiting")
+	}
+
+	clock.Advance(time.Minute)
+	if !<-done {
+		t.Error("Expected normal priority to get through in the next window")
+	}
+}
+
+func TestFixedWindowLimiter_Commit(t *testing.T) {
+	limiter := NewFixedWindowLimiter(internal.Options{
+		Limit:  10,
+		Window: time.Minute,
+	})
+
+	key := "test_key"
+	limiter.Reserve(key, 5).Commit(2)
+	if tokens := limiter.Token(key); tokens != 8 {
+		t.Errorf("Expected the unused estimate to be refunded, got %d left", tokens)
+	}
+
+	r := limiter.Reserve(key, 2)
+	r.Commit(9)
+	r.Cancel()
+	if tokens := limiter.Token(key); tokens != 0 || limiter.Allow(key) {
+		t.Errorf("Expected usage beyond the estimate to be charged, got %d left", tokens)
+	}
+}
+
+// Run with -cpu 1,2,4,8 to see throughput scale over distinct keys.
+func BenchmarkFixedWindowLimiter_Allow(b *testing.B) {
+	limiter := NewFixedWindowLimiter(internal.Options{
+		Limit:  1000,
+		Window: time.Second,
+	})
+
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = "key-" + strconv.Itoa(i)
+	}
+	var next atomic.Uint64
+
+	b.RunParallel(func(pb *testing.PB) {
+		i := next.Add(1) * 7919
+		for pb.Next() {
+			limiter.Allow(keys[i%uint64(len(keys))])
+			i++
+		}
+	})
+}
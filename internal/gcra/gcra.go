@@ -0,0 +1,425 @@
+package gcra
+
+import (
+	"context"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	internal "github.com/sirius1b/go-rate-limit/internal"
+)
+
+// GCRA is the generic cell rate algorithm. Each key is a single theoretical
+// arrival time (TAT): when the key would be back at full capacity, every unit
+// taken pushing it one emission interval further out. A request fits while
+// the TAT it leaves stays within Capacity intervals of now, which gives token
+// bucket semantics with bursts of up to Capacity. The TAT is updated with
+// compare-and-swap, so keys never block on a mutex.
+//
+// A key whose TAT is in the past is as good as new. With IdleTTL, the keys
+// whose TAT has been for that long are dropped.
+type GCRA struct {
+	config atomic.Pointer[config]
+	tats   sync.Map
+	count  atomic.Int64
+	queue  *internal.Queue
+
+	clock   internal.Clock
+	idleTTL time.Duration
+	janitor *internal.Janitor
+}
+
+// dropped is the TAT of a key being dropped. Callers that find it start over
+// with the key's next TAT.
+const dropped = math.MinInt64
+
+// config holds the parameters that Reconfigure can swap out at runtime. TATs
+// are absolute times, so they keep their meaning across changes.
+type config struct {
+	capacity int64
+	// interval is the emission interval, the time one unit takes to come
+	// back, and tolerance the burst it allows, capacity intervals
+	interval  int64
+	tolerance int64
+	rate      float64
+	reserve   float64
+}
+
+func NewGCRALimiter(option internal.Options) *GCRA {
+	f := &GCRA{
+		clock:   option.ClockOrDefault(),
+		idleTTL: option.IdleTTL,
+		queue:   internal.NewQueue(option),
+	}
+	f.config.Store(newConfig(option))
+	f.janitor = internal.StartJanitor(option, f.sweep)
+	return f
+}
+
+func newConfig(option internal.Options) *config {
+	interval := max(1, int64(option.RefillDuration)/int64(option.RefillAmount))
+	return &config{
+		capacity:  int64(option.Capacity),
+		interval:  interval,
+		tolerance: int64(option.Capacity) * interval,
+		rate:      float64(option.RefillAmount) / option.RefillDuration.Seconds(),
+		reserve:   option.PriorityReserve,
+	}
+}
+
+func (f *GCRA) Allow(key string) bool {
+	return f.AllowN(key, 1)
+}
+
+func (f *GCRA) AllowN(key string, n int) bool {
+	c := f.config.Load()
+	if n <= 0 || int64(n) > c.capacity {
+		return false
+	}
+
+	_, _, ok := f.take(c, key, int64(n), 0, f.clock.Now().UnixNano(), false)
+	return ok
+}
+
+// AllowAll takes a unit from each of keys, two from a key listed twice, but
+// only if every one of them has it. Every key is checked before any unit is
+// taken, so a key coming up short takes nothing from the others. TATs can't be updated together
+// though: when a concurrent call gets to a key's units between the check and
+// the take, the units taken from the keys before it are refunded, and another
+// call may briefly find them missing.
+func (f *GCRA) AllowAll(keys ...string) bool {
+	keys, counts := internal.Tally(keys)
+	c, now := f.config.Load(), f.clock.Now().UnixNano()
+	for index, key := range keys {
+		if !f.has(c, key, int64(counts[index]), now) {
+			return false
+		}
+	}
+
+	for index, key := range keys {
+		if _, _, ok := f.take(c, key, int64(counts[index]), 0, now, false); !ok {
+			f.refundAll(keys[:index], counts)
+			return false
+		}
+	}
+	return true
+}
+
+// AllowPriority is Allow for a request of priority p, denied while taking the
+// unit would eat into the share of the capacity PriorityReserve keeps for
+// higher priorities.
+func (f *GCRA) AllowPriority(key string, p internal.Priority) bool {
+	c := f.config.Load()
+	_, _, ok := f.take(c, key, 1, c.headroom(p), f.clock.Now().UnixNano(), false)
+	return ok
+}
+
+// AllowDetailed reports the exact time a denied request fits as RetryAfter,
+// and when the key is back at full capacity as ResetAt.
+func (f *GCRA) AllowDetailed(key string) internal.Decision {
+	c := f.config.Load()
+	now := f.clock.Now().UnixNano()
+	tat, readyAt, ok := f.take(c, key, 1, 0, now, false)
+
+	decision := internal.Decision{
+		Allowed:   ok,
+		Limit:     int(c.capacity),
+		Remaining: c.remaining(tat, now),
+		ResetAt:   time.Unix(0, max(tat, now)),
+	}
+	if !ok {
+		decision.RetryAfter = time.Duration(readyAt - now)
+	}
+
+	return decision
+}
+
+// Wait blocks until a unit is there and takes it. It returns false when the
+// key's queue is full or the wait would exceed MaxWait. Only waiters queue, so
+// taking units stays lock-free.
+func (f *GCRA) Wait(key string) bool {
+	return f.WaitN(key, 1)
+}
+
+func (f *GCRA) WaitN(key string, n int) bool {
+	if n <= 0 || int64(n) > f.config.Load().capacity {
+		return false
+	}
+
+	return f.waitN(context.Background(), key, int64(n), internal.PriorityHigh) == nil
+}
+
+// WaitPriority is Wait for a request of priority p, which goes ahead of lower
+// priorities in the key's queue.
+func (f *GCRA) WaitPriority(key string, p internal.Priority) bool {
+	return f.waitN(context.Background(), key, 1, p) == nil
+}
+
+func (f *GCRA) WaitContext(ctx context.Context, key string) error {
+	return f.waitN(ctx, key, 1, internal.PriorityHigh)
+}
+
+// waitN queues up for the key and then waits until n units fit on top of
+// priority p's headroom, taking them.
+func (f *GCRA) waitN(ctx context.Context, key string, n int64, p internal.Priority) error {
+	return f.queue.DoPriority(ctx, key, p, func(deadline time.Time) error {
+		return internal.WaitUntil(ctx, f.clock, deadline, func() time.Duration {
+			c, now := f.config.Load(), f.clock.Now().UnixNano()
+			if n > c.capacity {
+				// the capacity went down below n since the wait started
+				return internal.InfDuration
+			}
+			_, readyAt, _ := f.take(c, key, n, c.headroom(p), now, false)
+			return time.Duration(readyAt - now)
+		})
+	})
+}
+
+// Reserve takes n units and reports when they fit, pushing the TAT past the
+// tolerance if need be so that later requests wait for it to come back.
+func (f *GCRA) Reserve(key string, n int) *internal.Reservation {
+	c := f.config.Load()
+	if n <= 0 || int64(n) > c.capacity {
+		return internal.NewReservation(f.clock, false, time.Time{}, nil)
+	}
+
+	now := f.clock.Now().UnixNano()
+	tat := f.tat(key)
+	t, readyAt, _ := c.take(tat, int64(n), 0, now, true)
+	for t == dropped {
+		f.drop(key, tat)
+		tat = f.tat(key)
+		t, readyAt, _ = c.take(tat, int64(n), 0, now, true)
+	}
+
+	return internal.NewReservation(f.clock, true, time.Unix(0, readyAt), func() {
+		f.cancel(tat, int64(n), readyAt)
+	}).OnCommit(func(actual int) {
+		f.commit(key, tat, int64(actual-n))
+	})
+}
+
+// Refund gives n units back to the key, as when a request turned out not to
+// count.
+func (f *GCRA) Refund(key string, n int) {
+	if n <= 0 {
+		return
+	}
+
+	if tat, ok := f.tats.Load(key); ok {
+		f.refund(tat.(*atomic.Int64), int64(n))
+	}
+}
+
+func (f *GCRA) Rate() float64 {
+	return f.config.Load().rate
+}
+
+func (f *GCRA) Token(key string) int {
+	c := f.config.Load()
+	tat, ok := f.tats.Load(key)
+	if !ok {
+		return int(c.capacity)
+	}
+
+	return c.remaining(tat.(*atomic.Int64).Load(), f.clock.Now().UnixNano())
+}
+
+func (f *GCRA) Keys() []string {
+	keys := make([]string, 0, f.Len())
+	f.tats.Range(func(key, _ any) bool {
+		keys = append(keys, key.(string))
+		return true
+	})
+	return keys
+}
+
+func (f *GCRA) Len() int {
+	return int(f.count.Load())
+}
+
+// Snapshot reports the TAT as EmptyAt, and the intervals until then as Level.
+func (f *GCRA) Snapshot(key string) (internal.Snapshot, bool) {
+	c := f.config.Load()
+	tat, ok := f.tats.Load(key)
+	if !ok {
+		return internal.Snapshot{}, false
+	}
+
+	now := f.clock.Now().UnixNano()
+	t := max(tat.(*atomic.Int64).Load(), now)
+	return internal.Snapshot{
+		Key:       key,
+		Remaining: c.remaining(t, now),
+		Level:     int((t - now + c.interval - 1) / c.interval),
+		EmptyAt:   time.Unix(0, t),
+	}, true
+}
+
+// Reset drops the key's TAT. Outstanding reservations cancelled afterwards
+// refund the dropped one, not the new one.
+func (f *GCRA) Reset(key string) {
+	if _, loaded := f.tats.LoadAndDelete(key); loaded {
+		f.count.Add(-1)
+	}
+}
+
+func (f *GCRA) ResetAll() {
+	f.tats.Range(func(key, _ any) bool {
+		f.Reset(key.(string))
+		return true
+	})
+}
+
+// Reconfigure switches to the Capacity, RefillAmount, RefillDuration and
+// PriorityReserve in option. Each key's TAT is kept as is, so units already
+// taken come back when they were due to, and only later ones at the new rate.
+func (f *GCRA) Reconfigure(option internal.Options) error {
+	f.config.Store(newConfig(option))
+	return nil
+}
+
+// Close stops the janitor dropping idle keys.
+func (f *GCRA) Close() error {
+	f.janitor.Stop()
+	return nil
+}
+
+func (f *GCRA) tat(key string) *atomic.Int64 {
+	if tat, ok := f.tats.Load(key); ok {
+		return tat.(*atomic.Int64)
+	}
+
+	actual, loaded := f.tats.LoadOrStore(key, new(atomic.Int64))
+	if !loaded {
+		f.count.Add(1)
+	}
+	return actual.(*atomic.Int64)
+}
+
+// has reports whether n units fit the key's TAT, without creating it.
+func (f *GCRA) has(c *config, key string, n, now int64) bool {
+	if n > c.capacity {
+		return false
+	}
+
+	tat, ok := f.tats.Load(key)
+	if !ok {
+		return true
+	}
+	old := tat.(*atomic.Int64).Load()
+	return old == dropped || c.next(old, n, now) <= now
+}
+
+// take is config.take on the key's TAT, starting over with a new one when the
+// key turns out to be dropped.
+func (f *GCRA) take(c *config, key string, n, headroom, now int64, debt bool) (int64, int64, bool) {
+	for {
+		tat := f.tat(key)
+		if t, readyAt, ok := c.take(tat, n, headroom, now, debt); t != dropped {
+			return t, readyAt, ok
+		}
+		f.drop(key, tat)
+	}
+}
+
+// take pushes the TAT n intervals further out if that keeps it within the
+// tolerance, with headroom to spare, or unconditionally when debt is allowed.
+// It returns the TAT left and when the n units fit, or fitted, or dropped if
+// the TAT was.
+func (c *config) take(tat *atomic.Int64, n, headroom, now int64, debt bool) (int64, int64, bool) {
+	for {
+		old := tat.Load()
+		if old == dropped {
+			return dropped, 0, false
+		}
+
+		readyAt := c.next(old, n+headroom, now)
+		if readyAt > now && !debt {
+			return old, readyAt, false
+		}
+
+		updated := max(old, now) + n*c.interval
+		if tat.CompareAndSwap(old, updated) {
+			return updated, c.next(old, n, now), true
+		}
+	}
+}
+
+// refundAll gives back the units AllowAll took from keys.
+func (f *GCRA) refundAll(keys []string, counts []int) {
+	for index, key := range keys {
+		f.Refund(key, counts[index])
+	}
+}
+
+func (f *GCRA) cancel(tat *atomic.Int64, n, readyAt int64) {
+	if readyAt > f.clock.Now().UnixNano() {
+		f.refund(tat, n)
+	}
+}
+
+// commit takes delta more units for a committed reservation, past the
+// tolerance if need be, or refunds them when negative. Units are charged to
+// the key's next TAT if its own was dropped in the meantime.
+func (f *GCRA) commit(key string, tat *atomic.Int64, delta int64) {
+	if delta < 0 {
+		f.refund(tat, -delta)
+		return
+	}
+
+	c, now := f.config.Load(), f.clock.Now().UnixNano()
+	if t, _, _ := c.take(tat, delta, 0, now, true); t == dropped {
+		f.take(c, key, delta, 0, now, true)
+	}
+}
+
+// refund pulls the TAT n intervals back in, no further than now. A dropped TAT
+// is in the past, and so left alone.
+func (f *GCRA) refund(tat *atomic.Int64, n int64) {
+	c := f.config.Load()
+	now := f.clock.Now().UnixNano()
+	for {
+		old := tat.Load()
+		if old <= now || tat.CompareAndSwap(old, max(now, old-n*c.interval)) {
+			return
+		}
+	}
+}
+
+// drop forgets the key's TAT, if it is still tat.
+func (f *GCRA) drop(key string, tat *atomic.Int64) {
+	if f.tats.CompareAndDelete(key, tat) {
+		f.count.Add(-1)
+	}
+}
+
+// sweep drops the keys whose TAT has been in the past for idleTTL. Marking
+// the TAT dropped first keeps a concurrent take from landing on it unseen.
+func (f *GCRA) sweep(now time.Time) {
+	idle := now.Add(-f.idleTTL).UnixNano()
+	f.tats.Range(func(key, value any) bool {
+		tat := value.(*atomic.Int64)
+		if old := tat.Load(); old <= idle && tat.CompareAndSwap(old, dropped) {
+			f.drop(key.(string), tat)
+		}
+		return true
+	})
+}
+
+// headroom is how much of the capacity priority p has to leave untouched.
+func (c *config) headroom(p internal.Priority) int64 {
+	return int64(internal.Headroom(int(c.capacity), c.reserve, p))
+}
+
+// next returns when n more units fit given the TAT, the earliest arrival that
+// keeps the TAT they leave within the tolerance.
+func (c *config) next(tat, n, now int64) int64 {
+	return max(now, max(tat, now)+n*c.interval-c.tolerance)
+}
+
+// remaining is how many units fit right away given the TAT.
+func (c *config) remaining(tat, now int64) int {
+	return int(min(c.capacity, max(0, (now+c.tolerance-max(tat, now))/c.interval)))
+}
@@ -0,0 +1,436 @@
+package gcra
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	internal "github.com/sirius1b/go-rate-limit/internal"
+)
+
+func TestGCRA_Allow(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewGCRALimiter(internal.Options{
+		Capacity:       3,
+		RefillAmount:   10,
+		RefillDuration: time.Second,
+		Clock:          clock,
+	})
+
+	key := "test_key"
+	if !limiter.AllowN(key, 3) {
+		t.Error("Expected a burst up to the capacity to be allowed")
+	}
+	if limiter.Allow(key) {
+		t.Error("Expected the burst to use up the tolerance")
+	}
+
+	// a unit comes back every 100ms
+	clock.Advance(time.Millisecond * 99)
+	if limiter.Allow(key) {
+		t.Error("Expected no unit before an interval passed")
+	}
+	clock.Advance(time.Millisecond)
+	if !limiter.Allow(key) || limiter.Allow(key) {
+		t.Error("Expected exactly one unit back")
+	}
+
+	clock.Advance(time.Second)
+	if limiter.Token(key) != 3 {
+		t.Errorf("Expected the key back at full capacity, got %d", limiter.Token(key))
+	}
+	if limiter.Rate() != 10 {
+		t.Errorf("Expected a rate of 10, got %v", limiter.Rate())
+	}
+}
+
+func TestGCRA_AllowDetailed(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewGCRALimiter(internal.Options{
+		Capacity:       2,
+		RefillAmount:   1,
+		RefillDuration: time.Second,
+		Clock:          clock,
+	})
+
+	key := "test_key"
+	start := clock.Now()
+
+	d := limiter.AllowDetailed(key)
+	if !d.Allowed || d.Limit != 2 || d.Remaining != 1 || d.RetryAfter != 0 {
+		t.Errorf("Unexpected first decision: %+v", d)
+	}
+	if !d.ResetAt.Equal(start.Add(time.Second)) {
+		t.Errorf("Expected ResetAt to be the TAT, was: %v", d.ResetAt)
+	}
+
+	limiter.Allow(key)
+	clock.Advance(time.Millisecond * 300)
+	d = limiter.AllowDetailed(key)
+	if d.Allowed || d.Remaining != 0 {
+		t.Errorf("Expected denial with nothing remaining: %+v", d)
+	}
+	if d.RetryAfter != time.Millisecond*700 {
+		t.Errorf("Expected RetryAfter to be exact, was: %v", d.RetryAfter)
+	}
+	if !d.ResetAt.Equal(start.Add(time.Second * 2)) {
+		t.Errorf("Expected a denied request not to move ResetAt, was: %v", d.ResetAt)
+	}
+
+	clock.Advance(d.RetryAfter)
+	if d := limiter.AllowDetailed(key); !d.Allowed {
+		t.Errorf("Expected the request to fit after RetryAfter: %+v", d)
+	}
+}
+
+func TestGCRA_Reserve(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewGCRALimiter(internal.Options{
+		Capacity:       2,
+		RefillAmount:   1,
+		RefillDuration: time.Second,
+		Clock:          clock,
+	})
+
+	key := "test_key"
+	start := clock.Now()
+
+	if r := limiter.Reserve(key, 2); !r.OK() || r.Delay() != 0 {
+		t.Errorf("First reservation should be usable right away, delay: %v", r.Delay())
+	}
+
+	r := limiter.Reserve(key, 2)
+	if !r.ReadyAt().Equal(start.Add(time.Second * 2)) {
+		t.Errorf("Expected the reservation to wait for two units, ready at %v", r.ReadyAt())
+	}
+	if limiter.Allow(key) {
+		t.Error("Expected Allow to be denied behind the reservation")
+	}
+
+	r.Cancel()
+	if tokens := limiter.Token(key); tokens != 0 {
+		t.Errorf("Expected cancelling to pull the TAT back, got %d", tokens)
+	}
+	clock.Advance(time.Second)
+	if tokens := limiter.Token(key); tokens != 1 {
+		t.Errorf("Expected a unit back after an interval, got %d", tokens)
+	}
+
+	if r := limiter.Reserve(key, 3); r.OK() {
+		t.Error("Expected reservation larger than capacity not to be OK")
+	}
+}
+
+func TestGCRA_WaitN(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewGCRALimiter(internal.Options{
+		Capacity:       2,
+		RefillAmount:   1,
+		RefillDuration: time.Millisecond * 100,
+		Clock:          clock,
+	})
+
+	key := "test_key"
+	limiter.AllowN(key, 2)
+
+	if limiter.WaitN(key, 3) {
+		t.Error("Expected WaitN larger than capacity to return false")
+	}
+
+	go func() {
+		clock.BlockUntil(1)
+		clock.Advance(time.Millisecond * 200)
+	}()
+	if !limiter.WaitN(key, 2) {
+		t.Error("Expected WaitN to return true")
+	}
+	if tokens := limiter.Token(key); tokens != 0 {
+		t.Errorf("Expected WaitN to take the units back, got %d", tokens)
+	}
+}
+
+func TestGCRA_WaitContext(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewGCRALimiter(internal.Options{
+		Capacity:       1,
+		RefillAmount:   1,
+		RefillDuration: time.Second,
+		Clock:          clock,
+	})
+
+	key := "test_key"
+	limiter.Allow(key)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- limiter.WaitContext(ctx, key)
+	}()
+	clock.BlockUntil(1)
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+
+	if err := limiter.WaitContext(context.Background(), "other_key"); err != nil || limiter.Allow("other_key") {
+		t.Errorf("Expected WaitContext to take the unit, got %v", err)
+	}
+}
+
+func TestGCRA_Concurrency(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewGCRALimiter(internal.Options{
+		Capacity:       1000,
+		RefillAmount:   1,
+		RefillDuration: time.Second,
+		Clock:          clock,
+	})
+
+	key := "test_key"
+	var allowed atomic.Int64
+	var wg sync.WaitGroup
+
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				if limiter.Allow(key) {
+					allowed.Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed.Load() != 1000 {
+		t.Errorf("Expected exactly the capacity to be allowed, got %d", allowed.Load())
+	}
+}
+
+func TestGCRA_AllowAllocs(t *testing.T) {
+	limiter := NewGCRALimiter(internal.Options{
+		Capacity:       10,
+		RefillAmount:   10,
+		RefillDuration: time.Millisecond,
+	})
+
+	key := "test_key"
+	limiter.Allow(key)
+
+	if allocs := testing.AllocsPerRun(1000, func() { limiter.Allow(key) }); allocs != 0 {
+		t.Errorf("Expected Allow not to allocate, got %v allocs", allocs)
+	}
+}
+
+func TestGCRA_Snapshot(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewGCRALimiter(internal.Options{
+		Capacity:       10,
+		RefillAmount:   1,
+		RefillDuration: time.Second,
+		Clock:          clock,
+	})
+
+	key := "test_key"
+	if _, ok := limiter.Snapshot(key); ok {
+		t.Error("Expected no snapshot for an unknown key")
+	}
+
+	start := clock.Now()
+	limiter.AllowN(key, 4)
+	clock.Advance(time.Millisecond * 1500)
+
+	snapshot, ok := limiter.Snapshot(key)
+	if !ok {
+		t.Fatal("Expected a snapshot")
+	}
+	if snapshot.Level != 3 || snapshot.Remaining != 7 || !snapshot.EmptyAt.Equal(start.Add(time.Second*4)) {
+		t.Errorf("Expected the TAT 2.5 intervals out, got %+v", snapshot)
+	}
+
+	limiter.Reset(key)
+	if limiter.Len() != 0 || limiter.Token(key) != 10 {
+		t.Error("Expected Reset to forget the key")
+	}
+}
+
+func TestGCRA_Reconfigure(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewGCRALimiter(internal.Options{
+		Capacity:       4,
+		RefillAmount:   1,
+		RefillDuration: time.Second,
+		Clock:          clock,
+	})
+
+	key := "test_key"
+	limiter.AllowN(key, 4)
+
+	// the TAT stays 4s out, which is 8 intervals at the new rate
+	limiter.Reconfigure(internal.Options{Capacity: 8, RefillAmount: 2, RefillDuration: time.Second})
+	if tokens := limiter.Token(key); tokens != 0 {
+		t.Errorf("Expected the units taken to come back when due, got %d", tokens)
+	}
+	if rate := limiter.Rate(); rate != 2 {
+		t.Errorf("Expected rate of the new config, got %v", rate)
+	}
+
+	clock.Advance(time.Millisecond * 500)
+	if !limiter.Allow(key) || limiter.Allow(key) {
+		t.Error("Expected a unit back every 500ms")
+	}
+}
+
+func TestGCRA_AllowAll(t *testing.T) {
+	limiter := NewGCRALimiter(internal.Options{
+		Capacity:       2,
+		RefillAmount:   1,
+		RefillDuration: time.Minute,
+	})
+
+	if !limiter.AllowAll("a", "b", "b") {
+		t.Error("Expected keys with capacity to be allowed")
+	}
+	if limiter.AllowAll("a", "b") {
+		t.Error("Expected denial when one key is out of capacity")
+	}
+	if limiter.Token("a") != 1 {
+		t.Error("Expected a denied AllowAll to refund what it took")
+	}
+
+	// checked before anything is taken, so the new key isn't even created
+	if limiter.AllowAll("0", "b") || limiter.Len() != 2 {
+		t.Errorf("Expected a denied AllowAll not to touch the other keys, got %d keys", limiter.Len())
+	}
+}
+
+func TestGCRA_AllowPriority(t *testing.T) {
+	limiter := NewGCRALimiter(internal.Options{
+		Capacity:        10,
+		RefillAmount:    1,
+		RefillDuration:  time.Minute,
+		PriorityReserve: 0.2,
+	})
+
+	key := "test_key"
+	for range 6 {
+		limiter.AllowPriority(key, internal.PriorityLow)
+	}
+	if limiter.Token(key) != 4 {
+		t.Errorf("Expected low priority to leave 4 units, got %d", limiter.Token(key))
+	}
+	if !limiter.AllowPriority(key, internal.PriorityNormal) || !limiter.AllowPriority(key, internal.PriorityNormal) {
+		t.Error("Expected normal priority to use its share")
+	}
+	if limiter.AllowPriority(key, internal.PriorityNormal) || !limiter.AllowPriority(key, internal.PriorityHigh) {
+		t.Error("Expected the last units to be kept for high priority")
+	}
+}
+
+func TestGCRA_Commit(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewGCRALimiter(internal.Options{
+		Capacity:       10,
+		RefillAmount:   1,
+		RefillDuration: time.Minute,
+		Clock:          clock,
+	})
+
+	key := "test_key"
+	limiter.Reserve(key, 5).Commit(2)
+	if tokens := limiter.Token(key); tokens != 8 {
+		t.Errorf("Expected the unused estimate to be refunded, got %d", tokens)
+	}
+
+	limiter.Reserve(key, 2).Commit(9)
+	if tokens := limiter.Token(key); tokens != 0 || limiter.Allow(key) {
+		t.Errorf("Expected usage beyond the estimate to be charged, got %d", tokens)
+	}
+
+	limiter.Refund(key, 3)
+	if tokens := limiter.Token(key); tokens != 2 {
+		t.Errorf("Expected the debt to be paid back first, got %d", tokens)
+	}
+}
+
+func TestGCRA_Janitor(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewGCRALimiter(internal.Options{
+		Capacity:        2,
+		RefillAmount:    1,
+		RefillDuration:  time.Minute,
+		IdleTTL:         time.Minute,
+		CleanupInterval: time.Second,
+		Clock:           clock,
+	})
+
+	limiter.AllowN("busy", 2)
+	limiter.Allow("idle")
+
+	clock.BlockUntil(1)
+	clock.Advance(2 * time.Minute)
+
+	deadline := time.Now().Add(time.Second)
+	for limiter.Len() != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if limiter.Len() != 1 {
+		t.Fatalf("Expected the janitor to drop the idle key only, got %d keys", limiter.Len())
+	}
+	if _, ok := limiter.Snapshot("busy"); !ok {
+		t.Error("Expected the key still refilling to be kept")
+	}
+
+	limiter.Close()
+	limiter.Close()
+
+	for clock.Timers() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if clock.Timers() != 0 {
+		t.Errorf("Expected janitor timer to be stopped, got %d", clock.Timers())
+	}
+}
+
+func TestGCRA_Dropped(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewGCRALimiter(internal.Options{
+		Capacity:       1,
+		RefillAmount:   1,
+		RefillDuration: time.Minute,
+		Clock:          clock,
+	})
+
+	// a sweep marked the TAT but has yet to delete it
+	key := "test_key"
+	limiter.tat(key).Store(dropped)
+
+	if !limiter.Allow(key) {
+		t.Error("Expected a dropped key to start over")
+	}
+	if limiter.Allow(key) {
+		t.Error("Expected the new TAT to be taken from")
+	}
+	if limiter.Len() != 1 {
+		t.Errorf("Expected the dropped TAT to be replaced, got %d keys", limiter.Len())
+	}
+}
+
+func BenchmarkGCRA_Allow(b *testing.B) {
+	limiter := NewGCRALimiter(internal.Options{
+		Capacity:       1_000_000,
+		RefillAmount:   1_000_000,
+		RefillDuration: time.Millisecond,
+	})
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			limiter.Allow("global")
+		}
+	})
+}
@@ -0,0 +1,486 @@
+package leakyBucket
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	internal "github.com/sirius1b/go-rate-limit/internal"
+)
+
+// LeakyBucket fills a bucket of Capacity units per key with every request and
+// leaks RefillAmount units out of it every RefillDuration, one at a time. In
+// meter mode requests go through right away as long as they fit in the bucket.
+// In queue mode they wait in the bucket for their turn to leak out, so they
+// are let through at a constant rate whatever the bursts.
+type LeakyBucket struct {
+	config atomic.Pointer[config]
+	store  *internal.Store[bucket]
+	queue  *internal.Queue
+
+	clock   internal.Clock
+	maxWait time.Duration
+}
+
+// config describes a key's bucket. It is never changed in place; Reconfigure
+// stores a new one and keys migrate to it lazily.
+type config struct {
+	capacity int
+	// interval is the time a unit takes to leak out
+	interval time.Duration
+	rate     float64
+	queue    bool
+	reserve  float64
+
+	tiers internal.Tiers[config]
+}
+
+type bucket struct {
+	// emptyAt is when everything in the bucket will have leaked out, the
+	// level being the time until then in intervals
+	emptyAt time.Time
+
+	// config the state was last brought up to date with, resolved from the
+	// limiter's config root; both nil while fresh
+	config *config
+	root   *config
+}
+
+func NewLeakyBucketLimiter(option internal.Options) *LeakyBucket {
+	f := &LeakyBucket{
+		clock:   option.ClockOrDefault(),
+		maxWait: option.MaxWait,
+	}
+	f.config.Store(newConfig(option))
+	f.store = internal.NewStore(option, f.fresh)
+	f.queue = internal.NewQueue(option)
+	return f
+}
+
+func newConfig(option internal.Options) *config {
+	c := &config{
+		capacity: option.Capacity,
+		interval: max(1, option.RefillDuration/time.Duration(option.RefillAmount)),
+		rate:     float64(option.RefillAmount) / option.RefillDuration.Seconds(),
+		queue:    option.LeakyBucketMode == internal.LeakyBucketQueue,
+		reserve:  option.PriorityReserve,
+	}
+	c.tiers = internal.NewTiers(option, c, newConfig)
+	return c
+}
+
+// headroom is how much of the capacity priority p has to leave untouched.
+func (c *config) headroom(p internal.Priority) int {
+	return internal.Headroom(c.capacity, c.reserve, p)
+}
+
+func (f *LeakyBucket) Allow(key string) bool {
+	return f.AllowN(key, 1)
+}
+
+// AllowN puts n units in the key's bucket if they fit. In queue mode they
+// also have to leak out right away, as Allow can't hold the caller back; use
+// Wait or Reserve to queue.
+func (f *LeakyBucket) AllowN(key string, n int) bool {
+	e, c := f.lock(key)
+	defer e.Unlock()
+	b := &e.State
+
+	if n <= 0 || n > c.capacity {
+		return false
+	}
+
+	now := f.clock.Now()
+	if readyAt, ok := c.next(b, n, now); ok && !readyAt.After(now) {
+		c.fill(b, n, now)
+		return true
+	}
+
+	return false
+}
+
+// AllowAll puts a unit in each of keys' buckets, two in a key listed twice,
+// but only if they fit in every one of them.
+func (f *LeakyBucket) AllowAll(keys ...string) bool {
+	keys, counts := internal.Tally(keys)
+	entries := f.store.LockAll(keys)
+	defer internal.UnlockAll(entries)
+
+	now := f.clock.Now()
+	configs := make([]*config, len(entries))
+	for index, e := range entries {
+		c := f.sync(keys[index], &e.State, now)
+		if readyAt, ok := c.next(&e.State, counts[index], now); !ok || readyAt.After(now) {
+			return false
+		}
+		configs[index] = c
+	}
+
+	for index, e := range entries {
+		configs[index].fill(&e.State, counts[index], now)
+	}
+	return true
+}
+
+// AllowPriority is Allow for a request of priority p, denied while the unit
+// would fill the share of the bucket PriorityReserve keeps for higher
+// priorities.
+func (f *LeakyBucket) AllowPriority(key string, p internal.Priority) bool {
+	e, c := f.lock(key)
+	defer e.Unlock()
+	b := &e.State
+
+	now := f.clock.Now()
+	if readyAt, ok := c.next(b, 1+c.headroom(p), now); ok && !readyAt.After(now) {
+		c.fill(b, 1, now)
+		return true
+	}
+
+	return false
+}
+
+func (f *LeakyBucket) AllowDetailed(key string) internal.Decision {
+	e, c := f.lock(key)
+	defer e.Unlock()
+	b := &e.State
+
+	return c.admit(b, 1, internal.PriorityHigh, f.clock.Now())
+}
+
+// HoldOrder implements internal.Holder.
+func (f *LeakyBucket) HoldOrder() uint64 {
+	return f.store.Order()
+}
+
+// Hold implements internal.Holder, deciding for each key as AllowDetailed does.
+func (f *LeakyBucket) Hold(keys []string, counts []int, p internal.Priority) *internal.Held {
+	now := f.clock.Now()
+	return f.store.Hold(keys, func(index int, b *bucket) (bucket, internal.Decision) {
+		c := f.sync(keys[index], b, now)
+
+		held := *b
+		decision := c.admit(&held, counts[index], p, now)
+		return held, decision
+	})
+}
+
+// Wait blocks until the unit is let through and returns true. In meter mode
+// that is once it fits in the bucket; the key is not locked while sleeping,
+// and the unit is put in on waking up, starting over if another caller got
+// to the room first, and Wait returns false when the key's queue is full. In
+// queue mode the unit joins the bucket straight away and the caller sleeps
+// until it leaks out, or Wait returns false when the bucket is full. Either
+// way it returns false when the wait would exceed MaxWait.
+func (f *LeakyBucket) Wait(key string) bool {
+	return f.WaitN(key, 1)
+}
+
+func (f *LeakyBucket) WaitN(key string, n int) bool {
+	if n <= 0 {
+		return false
+	}
+
+	return f.wait(context.Background(), key, n, internal.PriorityHigh) == nil
+}
+
+// WaitContext is Wait, giving up with ctx's error once ctx is done. In queue
+// mode the unit is taken back out of the bucket then, and a full bucket is
+// ErrQueueFull.
+func (f *LeakyBucket) WaitContext(ctx context.Context, key string) error {
+	return f.wait(ctx, key, 1, internal.PriorityHigh)
+}
+
+// WaitPriority is Wait for a request of priority p, which may not fill the
+// share of the bucket PriorityReserve keeps for higher priorities. In meter
+// mode it also goes ahead of lower priorities in the key's queue.
+func (f *LeakyBucket) WaitPriority(key string, p internal.Priority) bool {
+	return f.wait(context.Background(), key, 1, p) == nil
+}
+
+// Reserve puts n units in the key's bucket and reports when they are let
+// through. In meter mode the bucket may overflow, the excess leaking out
+// before the reservation comes due. In queue mode the reservation is not OK
+// when the units don't fit.
+func (f *LeakyBucket) Reserve(key string, n int) *internal.Reservation {
+	return f.reserve(key, n, internal.PriorityHigh)
+}
+
+// Refund takes n units back out of the key's bucket, as when a request turned
+// out not to count.
+func (f *LeakyBucket) Refund(key string, n int) {
+	if n <= 0 {
+		return
+	}
+
+	e, c := f.lock(key)
+	defer e.Unlock()
+
+	c.drain(&e.State, n, f.clock.Now())
+}
+
+// Rate is how many units leak out per second.
+func (f *LeakyBucket) Rate() float64 {
+	return f.config.Load().rate
+}
+
+// Token reports how many more units fit in the key's bucket.
+func (f *LeakyBucket) Token(key string) int {
+	e, ok := f.store.Peek(key)
+	if !ok {
+		return f.config.Load().tiers.Resolve(key).capacity
+	}
+	defer e.Unlock()
+
+	now := f.clock.Now()
+	c := f.sync(key, &e.State, now)
+	return max(0, c.capacity-c.level(&e.State, now))
+}
+
+func (f *LeakyBucket) Keys() []string {
+	return f.store.Keys()
+}
+
+func (f *LeakyBucket) Len() int {
+	return f.store.Len()
+}
+
+func (f *LeakyBucket) Snapshot(key string) (internal.Snapshot, bool) {
+	e, ok := f.store.Peek(key)
+	if !ok {
+		return internal.Snapshot{}, false
+	}
+	defer e.Unlock()
+
+	now := f.clock.Now()
+	b := &e.State
+	c := f.sync(key, b, now)
+
+	level := c.level(b, now)
+	return internal.Snapshot{
+		Key:       key,
+		Remaining: max(0, c.capacity-level),
+		Level:     level,
+		EmptyAt:   maxTime(b.emptyAt, now),
+	}, true
+}
+
+func (f *LeakyBucket) Reset(key string) {
+	f.store.Delete(key)
+}
+
+func (f *LeakyBucket) ResetAll() {
+	f.store.Clear()
+}
+
+// Reconfigure switches to the Capacity, RefillAmount, RefillDuration,
+// LeakyBucketMode and overrides in option. Each key keeps its level, clamped
+// to its new capacity, the next time the key is used; units already queued
+// keep their turn.
+func (f *LeakyBucket) Reconfigure(option internal.Options) error {
+	f.config.Store(newConfig(option))
+	return nil
+}
+
+func (f *LeakyBucket) Close() error {
+	return f.store.Close()
+}
+
+// lock returns the key's entry locked, with its state migrated to the current
+// config.
+func (f *LeakyBucket) lock(key string) (*internal.Entry[bucket], *config) {
+	e := f.store.Lock(key)
+	return e, f.sync(key, &e.State, f.clock.Now())
+}
+
+// sync brings b up to date with the key's current config and returns it.
+func (f *LeakyBucket) sync(key string, b *bucket, now time.Time) *config {
+	root := f.config.Load()
+	if b.root == root {
+		return b.config
+	}
+
+	c := root.tiers.Resolve(key)
+	if old := b.config; old != nil && b.emptyAt.After(now) {
+		level := min(old.level(b, now), c.capacity)
+		b.emptyAt = now.Add(time.Duration(level) * c.interval)
+	}
+	b.config, b.root = c, root
+	return c
+}
+
+// wait has the caller wait for n units to be let through, holding them back
+// for priority p's headroom. In queue mode the units are queued in the bucket
+// itself, in meter mode the caller waits in the key's queue.
+func (f *LeakyBucket) wait(ctx context.Context, key string, n int, p internal.Priority) error {
+	if f.config.Load().queue {
+		return f.enqueue(ctx, key, n, p)
+	}
+
+	return f.queue.DoPriority(ctx, key, p, func(deadline time.Time) error {
+		return internal.WaitUntil(ctx, f.clock, deadline, func() time.Duration {
+			return f.delay(key, n, p)
+		})
+	})
+}
+
+// enqueue puts n units in the key's bucket and sleeps until they leak out,
+// taking them back out if the wait fails.
+func (f *LeakyBucket) enqueue(ctx context.Context, key string, n int, p internal.Priority) error {
+	r := f.reserve(key, n, p)
+	if !r.OK() {
+		return internal.ErrQueueFull
+	}
+
+	var deadline time.Time
+	if f.maxWait > 0 {
+		deadline = f.clock.Now().Add(f.maxWait)
+	}
+
+	err := internal.WaitUntil(ctx, f.clock, deadline, r.Delay)
+	if err != nil {
+		r.Cancel()
+	}
+	return err
+}
+
+// delay reports how long until n units would be let through in meter mode,
+// putting them in the bucket right away when they would already. Priority p
+// has to leave its headroom in the bucket.
+func (f *LeakyBucket) delay(key string, n int, p internal.Priority) time.Duration {
+	e, c := f.lock(key)
+	defer e.Unlock()
+	b := &e.State
+
+	if n > c.capacity {
+		// the capacity went down below n since the wait started
+		return internal.InfDuration
+	}
+
+	now := f.clock.Now()
+	readyAt, _ := c.next(b, n+c.headroom(p), now)
+	if readyAt.After(now) {
+		return readyAt.Sub(now)
+	}
+
+	c.fill(b, n, now)
+	return 0
+}
+
+// reserve puts n units in the key's bucket for a request of priority p.
+func (f *LeakyBucket) reserve(key string, n int, p internal.Priority) *internal.Reservation {
+	e, c := f.lock(key)
+	defer e.Unlock()
+	b := &e.State
+
+	if n <= 0 || n > c.capacity {
+		return internal.NewReservation(f.clock, false, time.Time{}, nil)
+	}
+
+	now := f.clock.Now()
+	readyAt, ok := c.next(b, n+c.headroom(p), now)
+	if !ok {
+		return internal.NewReservation(f.clock, false, time.Time{}, nil)
+	}
+	c.fill(b, n, now)
+
+	return internal.NewReservation(f.clock, true, readyAt, func() {
+		f.cancel(key, n, readyAt)
+	}).OnCommit(func(actual int) {
+		f.commit(key, actual-n)
+	})
+}
+
+// admit puts n units in b for a request of priority p if they would be let
+// through right away, and describes b afterwards. More than the capacity never
+// fits, so that is denied without a RetryAfter.
+func (c *config) admit(b *bucket, n int, p internal.Priority, now time.Time) internal.Decision {
+	decision := internal.Decision{Limit: c.capacity}
+
+	readyAt, ok := c.next(b, n+c.headroom(p), now)
+	switch {
+	case n > c.capacity:
+	case readyAt.After(now):
+		decision.RetryAfter = readyAt.Sub(now)
+	case ok:
+		c.fill(b, n, now)
+		decision.Allowed = true
+	}
+
+	decision.Remaining = c.capacity - c.level(b, now)
+	decision.ResetAt = maxTime(b.emptyAt, now)
+
+	return decision
+}
+
+// next returns when n more units would be let through, assuming nothing else
+// is put in the bucket in the meantime: once they fit in meter mode, and once
+// the units ahead of them have leaked out in queue mode. In queue mode ok is
+// false when the units don't fit in the bucket now.
+func (c *config) next(b *bucket, n int, now time.Time) (readyAt time.Time, ok bool) {
+	emptyAt := maxTime(b.emptyAt, now)
+	if c.queue {
+		return emptyAt, emptyAt.Sub(now)+time.Duration(n)*c.interval <= time.Duration(c.capacity)*c.interval
+	}
+	return maxTime(emptyAt.Add(time.Duration(n-c.capacity)*c.interval), now), true
+}
+
+// level is the number of units left in the bucket, counting one partly
+// leaked out.
+func (c *config) level(b *bucket, now time.Time) int {
+	if !b.emptyAt.After(now) {
+		return 0
+	}
+	return int((b.emptyAt.Sub(now) + c.interval - 1) / c.interval)
+}
+
+// fill puts n units in the bucket.
+func (c *config) fill(b *bucket, n int, now time.Time) {
+	b.emptyAt = maxTime(b.emptyAt, now).Add(time.Duration(n) * c.interval)
+}
+
+// drain takes up to n units back out of the bucket.
+func (c *config) drain(b *bucket, n int, now time.Time) {
+	if b.emptyAt.After(now) {
+		b.emptyAt = maxTime(b.emptyAt.Add(-time.Duration(n)*c.interval), now)
+	}
+}
+
+func (f *LeakyBucket) cancel(key string, n int, readyAt time.Time) {
+	e, c := f.lock(key)
+	defer e.Unlock()
+
+	now := f.clock.Now()
+	if !readyAt.After(now) {
+		return
+	}
+
+	c.drain(&e.State, n, now)
+}
+
+// commit puts delta more units in the bucket for a committed reservation, even
+// past its capacity, or takes them back out when negative.
+func (f *LeakyBucket) commit(key string, delta int) {
+	e, c := f.lock(key)
+	defer e.Unlock()
+
+	now := f.clock.Now()
+	if delta < 0 {
+		c.drain(&e.State, -delta, now)
+		return
+	}
+	c.fill(&e.State, delta, now)
+}
+
+// fresh reports whether the bucket is empty, allowing the store to drop the
+// key.
+func (f *LeakyBucket) fresh(key string, b *bucket, now time.Time) bool {
+	f.sync(key, b, now)
+	return !b.emptyAt.After(now)
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
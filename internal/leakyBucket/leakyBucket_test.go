@@ -0,0 +1,438 @@
+package leakyBucket
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	internal "github.com/sirius1b/go-rate-limit/internal"
+)
+
+func TestLeakyBucket_Allow(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewLeakyBucketLimiter(internal.Options{
+		Capacity:       3,
+		RefillAmount:   10,
+		RefillDuration: time.Second,
+		Clock:          clock,
+	})
+
+	key := "test_key"
+	if !limiter.AllowN(key, 3) {
+		t.Error("Expected a burst up to the capacity to be allowed")
+	}
+	if limiter.Allow(key) {
+		t.Error("Expected a full bucket to overflow")
+	}
+
+	// a unit leaks out every 100ms
+	clock.Advance(time.Millisecond * 99)
+	if limiter.Allow(key) {
+		t.Error("Expected no room before a unit leaked out")
+	}
+	clock.Advance(time.Millisecond)
+	if !limiter.Allow(key) || limiter.Allow(key) {
+		t.Error("Expected room for exactly one unit")
+	}
+
+	clock.Advance(time.Second)
+	if limiter.Token(key) != 3 {
+		t.Errorf("Expected the bucket to have drained, got %d free", limiter.Token(key))
+	}
+	if limiter.Rate() != 10 {
+		t.Errorf("Expected a rate of 10, got %v", limiter.Rate())
+	}
+}
+
+func TestLeakyBucket_Concurrency(t *testing.T) {
+	limiter := NewLeakyBucketLimiter(internal.Options{
+		Capacity:       10,
+		RefillAmount:   1,
+		RefillDuration: time.Minute,
+	})
+
+	key := "test_key"
+	var allowed int
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if limiter.Allow(key) {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed != 10 {
+		t.Errorf("Expected exactly the capacity to be allowed, got %d", allowed)
+	}
+}
+
+func TestLeakyBucket_Wait(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewLeakyBucketLimiter(internal.Options{
+		Capacity:       2,
+		RefillAmount:   1,
+		RefillDuration: time.Second,
+		Clock:          clock,
+	})
+
+	key := "test_key"
+	limiter.AllowN(key, 2)
+
+	done := make(chan bool)
+	go func() {
+		done <- limiter.Wait(key)
+	}()
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	if !<-done {
+		t.Fatal("Expected Wait to succeed once a unit leaked out")
+	}
+	if limiter.Allow(key) {
+		t.Error("Expected Wait to fill the room it waited for")
+	}
+}
+
+func TestLeakyBucket_WaitContext(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewLeakyBucketLimiter(internal.Options{
+		Capacity:       1,
+		RefillAmount:   1,
+		RefillDuration: time.Second,
+		Clock:          clock,
+	})
+
+	key := "test_key"
+	limiter.Allow(key)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- limiter.WaitContext(ctx, key)
+	}()
+	clock.BlockUntil(1)
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+
+	if err := limiter.WaitContext(context.Background(), "other_key"); err != nil || limiter.Allow("other_key") {
+		t.Errorf("Expected WaitContext to take the unit, got %v", err)
+	}
+}
+
+func TestLeakyBucket_Queue(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewLeakyBucketLimiter(internal.Options{
+		Capacity:        3,
+		RefillAmount:    10,
+		RefillDuration:  time.Second,
+		LeakyBucketMode: internal.LeakyBucketQueue,
+		Clock:           clock,
+	})
+
+	key := "test_key"
+	start := clock.Now()
+	if !limiter.Allow(key) {
+		t.Error("Expected a request on an empty bucket to go through")
+	}
+	if limiter.Allow(key) {
+		t.Error("Expected Allow not to queue behind a unit still leaking out")
+	}
+
+	// a burst is spread out one interval apart
+	for i := 1; i <= 2; i++ {
+		r := limiter.Reserve(key, 1)
+		if want := start.Add(time.Millisecond * 100 * time.Duration(i)); !r.OK() || !r.ReadyAt().Equal(want) {
+			t.Errorf("Expected reservation %d to leak out at %v, got %v", i, want, r.ReadyAt())
+		}
+	}
+	if r := limiter.Reserve(key, 1); r.OK() {
+		t.Error("Expected a full bucket to turn the reservation away")
+	}
+	if limiter.Wait(key) {
+		t.Error("Expected Wait to fail on a full bucket")
+	}
+
+	clock.Advance(time.Millisecond * 100)
+	done := make(chan bool)
+	go func() {
+		done <- limiter.Wait(key)
+	}()
+
+	// behind the two reserved units, one of which is leaking out
+	clock.BlockUntil(1)
+	clock.Advance(time.Millisecond * 199)
+	clock.BlockUntil(1)
+	clock.Advance(time.Millisecond)
+	if !<-done {
+		t.Fatal("Expected Wait to succeed")
+	}
+	if !clock.Now().Equal(start.Add(time.Millisecond * 300)) {
+		t.Errorf("Expected Wait to return on its turn, returned at %v", clock.Now().Sub(start))
+	}
+}
+
+func TestLeakyBucket_QueueMaxWait(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewLeakyBucketLimiter(internal.Options{
+		Capacity:        10,
+		RefillAmount:    1,
+		RefillDuration:  time.Second,
+		LeakyBucketMode: internal.LeakyBucketQueue,
+		MaxWait:         time.Second * 2,
+		Clock:           clock,
+	})
+
+	key := "test_key"
+	limiter.Reserve(key, 3)
+	if limiter.Wait(key) {
+		t.Error("Expected a turn beyond MaxWait to be turned away")
+	}
+	if tokens := limiter.Token(key); tokens != 7 {
+		t.Errorf("Expected the turned away unit to leave the bucket, got %d free", tokens)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := limiter.WaitContext(ctx, key); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if tokens := limiter.Token(key); tokens != 7 {
+		t.Errorf("Expected the cancelled unit to leave the bucket, got %d free", tokens)
+	}
+
+	limiter.Reserve(key, 7)
+	r := limiter.Reserve(key, 1)
+	if r.OK() {
+		t.Error("Expected a full bucket to turn the reservation away")
+	}
+	if err := limiter.WaitContext(context.Background(), key); !errors.Is(err, internal.ErrQueueFull) {
+		t.Errorf("Expected a full bucket to be ErrQueueFull, got %v", err)
+	}
+}
+
+func TestLeakyBucket_Reserve(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewLeakyBucketLimiter(internal.Options{
+		Capacity:       2,
+		RefillAmount:   1,
+		RefillDuration: time.Second,
+		Clock:          clock,
+	})
+
+	key := "test_key"
+	start := clock.Now()
+
+	if r := limiter.Reserve(key, 2); !r.OK() || r.Delay() != 0 {
+		t.Errorf("First reservation should be usable right away, delay: %v", r.Delay())
+	}
+
+	// the bucket overflows until the excess leaked out
+	r := limiter.Reserve(key, 2)
+	if !r.ReadyAt().Equal(start.Add(time.Second * 2)) {
+		t.Errorf("Expected the reservation to wait for room, ready at %v", r.ReadyAt())
+	}
+	r.Cancel()
+	if tokens := limiter.Token(key); tokens != 0 {
+		t.Errorf("Expected cancelling to take the units back out, got %d free", tokens)
+	}
+
+	if r := limiter.Reserve(key, 3); r.OK() || r.Delay() != internal.InfDuration {
+		t.Error("Reservation larger than the capacity should not be OK")
+	}
+}
+
+func TestLeakyBucket_AllowDetailed(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewLeakyBucketLimiter(internal.Options{
+		Capacity:       2,
+		RefillAmount:   1,
+		RefillDuration: time.Second,
+		Clock:          clock,
+	})
+
+	key := "test_key"
+	start := clock.Now()
+
+	d := limiter.AllowDetailed(key)
+	if !d.Allowed || d.Limit != 2 || d.Remaining != 1 || !d.ResetAt.Equal(start.Add(time.Second)) {
+		t.Errorf("Unexpected first decision: %+v", d)
+	}
+
+	limiter.Allow(key)
+	clock.Advance(time.Millisecond * 400)
+	d = limiter.AllowDetailed(key)
+	if d.Allowed || d.Remaining != 0 || d.RetryAfter != time.Millisecond*600 {
+		t.Errorf("Expected to retry once a unit leaked out: %+v", d)
+	}
+	if !d.ResetAt.Equal(start.Add(time.Second * 2)) {
+		t.Errorf("Expected ResetAt when the bucket is empty, was: %v", d.ResetAt)
+	}
+}
+
+func TestLeakyBucket_Snapshot(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewLeakyBucketLimiter(internal.Options{
+		Capacity:       10,
+		RefillAmount:   1,
+		RefillDuration: time.Second,
+		Clock:          clock,
+	})
+
+	key := "test_key"
+	if _, ok := limiter.Snapshot(key); ok {
+		t.Error("Expected no snapshot for an unknown key")
+	}
+
+	start := clock.Now()
+	limiter.AllowN(key, 4)
+	clock.Advance(time.Millisecond * 1500)
+
+	snapshot, ok := limiter.Snapshot(key)
+	if !ok {
+		t.Fatal("Expected a snapshot")
+	}
+	if snapshot.Level != 3 || snapshot.Remaining != 7 || !snapshot.EmptyAt.Equal(start.Add(time.Second*4)) {
+		t.Errorf("Expected a partly leaked unit to count, got %+v", snapshot)
+	}
+}
+
+func TestLeakyBucket_Fresh(t *testing.T) {
+	limiter := NewLeakyBucketLimiter(internal.Options{
+		Capacity:       2,
+		RefillAmount:   1,
+		RefillDuration: time.Second,
+	})
+
+	key := "test_key"
+	now := time.Now()
+	b := &bucket{emptyAt: now.Add(time.Second)}
+
+	if limiter.fresh(key, b, now) {
+		t.Error("Bucket with units in it should not be fresh")
+	}
+	if !limiter.fresh(key, b, now.Add(time.Second)) {
+		t.Error("Bucket should be fresh once drained")
+	}
+}
+
+func TestLeakyBucket_Reconfigure(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewLeakyBucketLimiter(internal.Options{
+		Capacity:       10,
+		RefillAmount:   1,
+		RefillDuration: time.Second,
+		Clock:          clock,
+	})
+
+	key := "test_key"
+	limiter.AllowN(key, 5)
+
+	limiter.Reconfigure(internal.Options{Capacity: 4, RefillAmount: 2, RefillDuration: time.Second})
+	if tokens := limiter.Token(key); tokens != 0 {
+		t.Errorf("Expected the level to be clamped to the new capacity, got %d free", tokens)
+	}
+	if rate := limiter.Rate(); rate != 2 {
+		t.Errorf("Expected rate of the new config, got %v", rate)
+	}
+
+	// leaking at the new rate
+	clock.Advance(time.Millisecond * 500)
+	if !limiter.Allow(key) || limiter.Allow(key) {
+		t.Error("Expected a unit to leak out every 500ms")
+	}
+}
+
+func TestLeakyBucket_Overrides(t *testing.T) {
+	limiter := NewLeakyBucketLimiter(internal.Options{
+		Capacity:       2,
+		RefillAmount:   1,
+		RefillDuration: time.Second,
+		Overrides: map[string]internal.Options{
+			"pro": {Capacity: 5},
+		},
+	})
+
+	if !limiter.AllowN("pro", 5) || limiter.Allow("pro") {
+		t.Error("Expected the override to apply to its key")
+	}
+	if limiter.AllowN("free", 3) {
+		t.Error("Expected other keys to keep the default capacity")
+	}
+}
+
+func TestLeakyBucket_AllowAll(t *testing.T) {
+	limiter := NewLeakyBucketLimiter(internal.Options{
+		Capacity:       2,
+		RefillAmount:   1,
+		RefillDuration: time.Minute,
+	})
+
+	if !limiter.AllowAll("a", "b", "b") {
+		t.Error("Expected keys with room to be allowed")
+	}
+	if limiter.AllowAll("a", "b") {
+		t.Error("Expected denial when one bucket is full")
+	}
+	if limiter.Token("a") != 1 {
+		t.Error("Expected a denied AllowAll to fill nothing")
+	}
+}
+
+func TestLeakyBucket_AllowPriority(t *testing.T) {
+	limiter := NewLeakyBucketLimiter(internal.Options{
+		Capacity:        10,
+		RefillAmount:    1,
+		RefillDuration:  time.Minute,
+		PriorityReserve: 0.2,
+	})
+
+	key := "test_key"
+	for range 6 {
+		limiter.AllowPriority(key, internal.PriorityLow)
+	}
+	if limiter.Token(key) != 4 {
+		t.Errorf("Expected low priority to leave 4 units, got %d", limiter.Token(key))
+	}
+	if !limiter.AllowPriority(key, internal.PriorityNormal) || !limiter.AllowPriority(key, internal.PriorityNormal) {
+		t.Error("Expected normal priority to use its share")
+	}
+	if limiter.AllowPriority(key, internal.PriorityNormal) || !limiter.AllowPriority(key, internal.PriorityHigh) {
+		t.Error("Expected the last units to be kept for high priority")
+	}
+}
+
+func TestLeakyBucket_Commit(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewLeakyBucketLimiter(internal.Options{
+		Capacity:       10,
+		RefillAmount:   1,
+		RefillDuration: time.Minute,
+		Clock:          clock,
+	})
+
+	key := "test_key"
+	limiter.Reserve(key, 5).Commit(2)
+	if tokens := limiter.Token(key); tokens != 8 {
+		t.Errorf("Expected the unused estimate to be taken back out, got %d free", tokens)
+	}
+
+	limiter.Reserve(key, 2).Commit(9)
+	if tokens := limiter.Token(key); tokens != 0 || limiter.Allow(key) {
+		t.Errorf("Expected usage beyond the estimate to be put in, got %d free", tokens)
+	}
+
+	limiter.Refund(key, 3)
+	if tokens := limiter.Token(key); tokens != 2 {
+		t.Errorf("Expected a refund to take units back out, got %d free", tokens)
+	}
+}
@@ -1,109 +1,462 @@
 package slidingWindow
 
 import (
-	"sync"
+	"context"
+	"slices"
+	"sync/atomic"
 	"time"
 
 	internal "github.com/sirius1b/go-rate-limit/internal"
 )
 
 type SlidingWindow struct {
-	timeLogs map[string][]time.Time
-	limit    int
-	window   time.Duration
+	config atomic.Pointer[config]
+	store  *internal.Store[samples]
+	queue  *internal.Queue
 
-	mus      map[string]*sync.Mutex
-	globalMu *sync.Mutex
+	clock internal.Clock
 }
 
-func NewSlidingWindowLimiter(option internal.Options) *SlidingWindow {
-	return &SlidingWindow{
+// config is the limit and window a key's log is checked against, replaced
+// as a whole by Reconfigure.
+type config struct {
+	limit   int
+	window  time.Duration
+	reserve float64
+
+	tiers internal.Tiers[config]
+}
+
+type samples struct {
+	timeLogs []time.Time
 
-		limit:    option.Limit,
-		window:   option.Window,
-		timeLogs: make(map[string][]time.Time),
+	// config that applies to the key, resolved from the limiter's config
+	// root; both nil while fresh
+	config *config
+	root   *config
+}
 
-		mus:      make(map[string]*sync.Mutex),
-		globalMu: &sync.Mutex{},
+func NewSlidingWindowLimiter(option internal.Options) *SlidingWindow {
+	f := &SlidingWindow{
+		clock: option.ClockOrDefault(),
 	}
+	f.config.Store(newConfig(option))
+	f.store = internal.NewStore(option, f.fresh)
+	f.queue = internal.NewQueue(option)
+	return f
+}
+
+func newConfig(option internal.Options) *config {
+	c := &config{limit: option.Limit, window: option.Window, reserve: option.PriorityReserve}
+	c.tiers = internal.NewTiers(option, c, newConfig)
+	return c
+}
+
+// headroom is how much of the limit priority p has to leave untouched.
+func (c *config) headroom(p internal.Priority) int {
+	return internal.Headroom(c.limit, c.reserve, p)
 }
 
 func (f *SlidingWindow) Allow(key string) bool {
-	mu := f.getMutex(key)
-	mu.Lock()
-	defer mu.Unlock()
-	now := time.Now()
+	return f.AllowN(key, 1)
+}
+
+func (f *SlidingWindow) AllowN(key string, n int) bool {
+	e, c := f.lock(key)
+	defer e.Unlock()
+	l := &e.State
 
-	f.removeSamples(key, now)
+	if n <= 0 || n > c.limit {
+		return false
+	}
+	now := f.clock.Now()
+
+	c.removeSamples(l, now)
 
-	if len(f.timeLogs[key]) < f.limit {
-		f.timeLogs[key] = append(f.timeLogs[key], now)
+	if !c.next(l, n, now).After(now) {
+		f.addSamples(l, now, n)
 		return true
 	}
 
 	return false
 }
 
-func (f *SlidingWindow) Wait(key string) bool {
-	mu := f.getMutex(key)
-	mu.Lock()
-	defer mu.Unlock()
+// AllowAll takes a unit from each of keys, two from a key listed twice, but
+// only if every one of them has it.
+func (f *SlidingWindow) AllowAll(keys ...string) bool {
+	keys, counts := internal.Tally(keys)
+	entries := f.store.LockAll(keys)
+	defer internal.UnlockAll(entries)
+
+	now := f.clock.Now()
+	for index, e := range entries {
+		l := &e.State
+		c := f.sync(keys[index], l)
+		c.removeSamples(l, now)
+
+		if counts[index] > c.limit || c.next(l, counts[index], now).After(now) {
+			return false
+		}
+	}
+
+	for index, e := range entries {
+		f.addSamples(&e.State, now, counts[index])
+	}
+	return true
+}
+
+// AllowPriority is Allow for a request of priority p, denied while taking the
+// unit would eat into the share of the limit PriorityReserve keeps for
+// higher priorities.
+func (f *SlidingWindow) AllowPriority(key string, p internal.Priority) bool {
+	e, c := f.lock(key)
+	defer e.Unlock()
+	l := &e.State
+
+	now := f.clock.Now()
+	c.removeSamples(l, now)
+
+	if !c.next(l, 1+c.headroom(p), now).After(now) {
+		f.addSamples(l, now, 1)
+		return true
+	}
+
+	return false
+}
 
-	logs, exists := f.timeLogs[key]
-	now := time.Now()
+func (f *SlidingWindow) AllowDetailed(key string) internal.Decision {
+	e, c := f.lock(key)
+	defer e.Unlock()
+	l := &e.State
 
-	if exists {
-		lastLog := logs[0]
-		expiryTime := lastLog.Add(f.window)
+	now := f.clock.Now()
+	c.removeSamples(l, now)
 
-		if now.After(expiryTime) {
-			return true
+	return f.admit(c, l, 1, internal.PriorityHigh, now)
+}
+
+// HoldOrder implements internal.Holder.
+func (f *SlidingWindow) HoldOrder() uint64 {
+	return f.store.Order()
+}
+
+// Hold implements internal.Holder, deciding for each key as AllowDetailed does.
+func (f *SlidingWindow) Hold(keys []string, counts []int, p internal.Priority) *internal.Held {
+	now := f.clock.Now()
+	return f.store.Hold(keys, func(index int, l *samples) (samples, internal.Decision) {
+		c := f.sync(keys[index], l)
+		c.removeSamples(l, now)
+
+		// a copy of the log, the held one may share its backing array
+		held := *l
+		held.timeLogs = slices.Clip(held.timeLogs)
+		decision := f.admit(c, &held, counts[index], p, now)
+		return held, decision
+	})
+}
+
+// admit logs n samples for a request of priority p if they fit under c, and
+// describes l afterwards. More than the limit never fits, so that is denied
+// without a RetryAfter.
+func (f *SlidingWindow) admit(c *config, l *samples, n int, p internal.Priority, now time.Time) internal.Decision {
+	decision := internal.Decision{Limit: c.limit}
+
+	if n <= c.limit {
+		if readyAt := c.next(l, n+c.headroom(p), now); readyAt.After(now) {
+			decision.RetryAfter = readyAt.Sub(now)
+		} else {
+			f.addSamples(l, now, n)
+			decision.Allowed = true
 		}
+	}
 
-		sleepTime := time.Since(expiryTime)
-		time.Sleep(sleepTime)
+	logs := l.timeLogs
+	decision.Remaining = max(0, c.limit-len(logs))
+	decision.ResetAt = now
+	if len(logs) > 0 {
+		decision.ResetAt = logs[len(logs)-1].Add(c.window + time.Nanosecond)
 	}
 
-	return true
+	return decision
+}
+
+// Wait blocks until a unit is free and takes it. The key is not locked while
+// sleeping, and the unit is claimed on waking up, starting over if another
+// caller got to it first. It returns false when the key's queue is full or the
+// wait would exceed MaxWait.
+func (f *SlidingWindow) Wait(key string) bool {
+	return f.WaitN(key, 1)
+}
+
+func (f *SlidingWindow) WaitN(key string, n int) bool {
+	if n <= 0 {
+		return false
+	}
+
+	return f.wait(context.Background(), key, n, internal.PriorityHigh) == nil
+}
+
+func (f *SlidingWindow) WaitContext(ctx context.Context, key string) error {
+	return f.wait(ctx, key, 1, internal.PriorityHigh)
+}
+
+// WaitPriority is Wait for a request of priority p, which goes ahead of lower
+// priorities in the key's queue.
+func (f *SlidingWindow) WaitPriority(key string, p internal.Priority) bool {
+	return f.wait(context.Background(), key, 1, p) == nil
+}
+
+func (f *SlidingWindow) Reserve(key string, n int) *internal.Reservation {
+	e, c := f.lock(key)
+	defer e.Unlock()
+	l := &e.State
+
+	if n <= 0 || n > c.limit {
+		return internal.NewReservation(f.clock, false, time.Time{}, nil)
+	}
+
+	now := f.clock.Now()
+	c.removeSamples(l, now)
+
+	// samples are logged at the time they become usable, which may be ahead of now
+	readyAt := c.next(l, n, now)
+	f.addSamples(l, readyAt, n)
+
+	return internal.NewReservation(f.clock, true, readyAt, func() {
+		f.cancel(key, n, readyAt)
+	}).OnCommit(func(actual int) {
+		f.commit(key, actual-n, readyAt)
+	})
+}
+
+// Reconfigure switches to the Limit, Window and overrides in option. The logged
+// samples are kept as they are and judged against the new settings from then
+// on.
+func (f *SlidingWindow) Reconfigure(option internal.Options) error {
+	f.config.Store(newConfig(option))
+	return nil
+}
+
+// Refund removes the key's n most recent samples, as when a request turned out
+// not to count. Samples logged ahead of now by reservations are left alone.
+func (f *SlidingWindow) Refund(key string, n int) {
+	if n <= 0 {
+		return
+	}
+
+	e := f.store.Lock(key)
+	defer e.Unlock()
+	l := &e.State
+
+	now := f.clock.Now()
+	logs := l.timeLogs
+	for index := len(logs) - 1; index >= 0 && n > 0; index-- {
+		if !logs[index].After(now) {
+			logs = append(logs[:index], logs[index+1:]...)
+			n--
+		}
+	}
+	l.timeLogs = logs
+}
+
+func (f *SlidingWindow) Close() error {
+	return f.store.Close()
+}
+
+// lock returns the key's entry locked, along with the config that applies to
+// it.
+func (f *SlidingWindow) lock(key string) (*internal.Entry[samples], *config) {
+	e := f.store.Lock(key)
+	return e, f.sync(key, &e.State)
+}
+
+// sync returns the key's current config, resolving it again only after
+// Reconfigure.
+func (f *SlidingWindow) sync(key string, l *samples) *config {
+	root := f.config.Load()
+	if l.root != root {
+		l.config, l.root = root.tiers.Resolve(key), root
+	}
+	return l.config
 }
 
 func (f *SlidingWindow) Rate() float64 {
-	return float64(f.limit) / float64(f.window.Seconds())
+	c := f.config.Load()
+	return float64(c.limit) / float64(c.window.Seconds())
 }
 
 func (f *SlidingWindow) Token(key string) int {
-	mu := f.getMutex(key)
-	mu.Lock()
-	defer mu.Unlock()
+	e, ok := f.store.Peek(key)
+	if !ok {
+		return f.config.Load().tiers.Resolve(key).limit
+	}
+	defer e.Unlock()
+	c := f.sync(key, &e.State)
+
+	l := samples{timeLogs: e.State.timeLogs}
+	c.removeSamples(&l, f.clock.Now())
+	return max(0, c.limit-len(l.timeLogs))
+}
 
-	return f.limit - len(f.timeLogs[key])
+func (f *SlidingWindow) Keys() []string {
+	return f.store.Keys()
 }
 
-func (s *SlidingWindow) getMutex(key string) *sync.Mutex {
-	s.globalMu.Lock()
-	defer s.globalMu.Unlock()
-	if _, exists := s.mus[key]; !exists {
-		s.mus[key] = &sync.Mutex{}
+func (f *SlidingWindow) Len() int {
+	return f.store.Len()
+}
+
+func (f *SlidingWindow) Snapshot(key string) (internal.Snapshot, bool) {
+	e, ok := f.store.Peek(key)
+	if !ok {
+		return internal.Snapshot{}, false
 	}
-	return s.mus[key]
+	defer e.Unlock()
+	c := f.sync(key, &e.State)
+
+	l := samples{timeLogs: e.State.timeLogs}
+	c.removeSamples(&l, f.clock.Now())
+
+	return internal.Snapshot{
+		Key:       key,
+		Remaining: max(0, c.limit-len(l.timeLogs)),
+		// copied, the log keeps being appended to in place
+		Logs: append([]time.Time(nil), l.timeLogs...),
+	}, true
+}
+
+func (f *SlidingWindow) Reset(key string) {
+	f.store.Delete(key)
+}
+
+func (f *SlidingWindow) ResetAll() {
+	f.store.Clear()
 }
 
-func (r *SlidingWindow) removeSamples(key string, now time.Time) {
+// wait queues up for the key and then waits until delay reports no more
+// waiting is needed.
+func (f *SlidingWindow) wait(ctx context.Context, key string, n int, p internal.Priority) error {
+	return f.queue.DoPriority(ctx, key, p, func(deadline time.Time) error {
+		return internal.WaitUntil(ctx, f.clock, deadline, func() time.Duration {
+			return f.delay(key, n, p)
+		})
+	})
+}
+
+// delay reports how long until n samples fit in the key's log, recording them
+// right away when they already fit. Priority p has to leave its headroom
+// untouched.
+func (f *SlidingWindow) delay(key string, n int, p internal.Priority) time.Duration {
+	e, c := f.lock(key)
+	defer e.Unlock()
+	l := &e.State
+
+	if n > c.limit {
+		// the limit went down below n since the wait started
+		return internal.InfDuration
+	}
+
+	now := f.clock.Now()
+	c.removeSamples(l, now)
+
+	readyAt := c.next(l, n+c.headroom(p), now)
+	if readyAt.After(now) {
+		return readyAt.Sub(now)
+	}
 
-	_, exists := r.timeLogs[key]
-	if !exists {
-		r.timeLogs[key] = make([]time.Time, 0)
-	} else {
-		threshold := now.Add(-r.window)
-		removeIndex := -1
-		for index := len(r.timeLogs[key]) - 1; index >= 0; index-- {
-			if threshold.After(r.timeLogs[key][index]) {
-				removeIndex = index
-				break
-			}
+	f.addSamples(l, now, n)
+	return 0
+}
+
+// next returns the earliest time n samples can be logged without
+// exceeding the limit. The log is kept sorted, so this is never before the
+// latest sample, which can lie in the future for reservations. More samples
+// than the limit never fit.
+func (c *config) next(l *samples, n int, now time.Time) time.Time {
+	logs := l.timeLogs
+	if n > c.limit {
+		return now.Add(internal.InfDuration)
+	}
+
+	at := now
+	if len(logs) > 0 && logs[len(logs)-1].After(at) {
+		at = logs[len(logs)-1]
+	}
+
+	if over := len(logs) + n - c.limit; over > 0 {
+		// samples are only dropped once they are strictly older than the window
+		expiry := logs[over-1].Add(c.window + time.Nanosecond)
+		if expiry.After(at) {
+			at = expiry
 		}
-		if removeIndex != -1 {
-			r.timeLogs[key] = r.timeLogs[key][removeIndex+1:]
+	}
+
+	return at
+}
+
+func (f *SlidingWindow) cancel(key string, n int, readyAt time.Time) {
+	e := f.store.Lock(key)
+	defer e.Unlock()
+	l := &e.State
+
+	if !readyAt.After(f.clock.Now()) {
+		return
+	}
+
+	logs := l.timeLogs
+	for index := len(logs) - 1; index >= 0 && n > 0; index-- {
+		if logs[index].Equal(readyAt) {
+			logs = append(logs[:index], logs[index+1:]...)
+			n--
+		}
+	}
+	l.timeLogs = logs
+}
+
+// commit logs delta more samples at readyAt for a committed reservation, or
+// drops that many of the ones logged there when negative.
+func (f *SlidingWindow) commit(key string, delta int, readyAt time.Time) {
+	e, c := f.lock(key)
+	defer e.Unlock()
+	l := &e.State
+
+	c.removeSamples(l, f.clock.Now())
+
+	// keep the log sorted, later reservations may have logged samples after
+	// readyAt
+	index, _ := slices.BinarySearchFunc(l.timeLogs, readyAt, time.Time.Compare)
+	for ; delta > 0; delta-- {
+		l.timeLogs = slices.Insert(l.timeLogs, index, readyAt)
+	}
+	for ; delta < 0 && index < len(l.timeLogs) && l.timeLogs[index].Equal(readyAt); delta++ {
+		l.timeLogs = slices.Delete(l.timeLogs, index, index+1)
+	}
+}
+
+func (c *config) removeSamples(l *samples, now time.Time) {
+
+	threshold := now.Add(-c.window)
+	removeIndex := -1
+	for index := len(l.timeLogs) - 1; index >= 0; index-- {
+		if threshold.After(l.timeLogs[index]) {
+			removeIndex = index
+			break
 		}
 	}
+	if removeIndex != -1 {
+		l.timeLogs = l.timeLogs[removeIndex+1:]
+	}
+}
+
+func (r *SlidingWindow) addSamples(l *samples, now time.Time, n int) {
+	for i := 0; i < n; i++ {
+		l.timeLogs = append(l.timeLogs, now)
+	}
+}
+
+// fresh reports whether every sample has left the window, allowing the store
+// to drop the key.
+func (f *SlidingWindow) fresh(key string, l *samples, now time.Time) bool {
+	f.sync(key, l).removeSamples(l, now)
+	return len(l.timeLogs) == 0
 }
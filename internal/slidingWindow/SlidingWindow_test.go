@@ -1,7 +1,12 @@
 package slidingWindow
 
 import (
+	"context"
+	"errors"
+	"slices"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -9,9 +14,11 @@ import (
 )
 
 func TestSlidingWindow_Allow(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
 	option := internal.Options{
 		Limit:  3,
 		Window: time.Second,
+		Clock:  clock,
 	}
 	limiter := NewSlidingWindowLimiter(option)
 
@@ -36,7 +43,7 @@ func TestSlidingWindow_Allow(t *testing.T) {
 	}
 
 	// Wait for the window to expire
-	time.Sleep(time.Second)
+	clock.Advance(time.Second + time.Millisecond)
 
 	// Should be able to allow again
 	if !limiter.Allow(key) {
@@ -98,6 +105,24 @@ func TestSlidingWindow_Token(t *testing.T) {
 	}
 }
 
+func TestSlidingWindow_TokenExpired(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewSlidingWindowLimiter(internal.Options{
+		Limit:  2,
+		Window: time.Second,
+		Clock:  clock,
+	})
+
+	key := "token_key"
+	limiter.AllowN(key, 2)
+	clock.Advance(time.Second * 2)
+
+	// expired samples don't count, even before the next Allow drops them
+	if snapshot, _ := limiter.Snapshot(key); limiter.Token(key) != 2 || snapshot.Remaining != 2 {
+		t.Errorf("Expected 2 tokens once the samples expired, but got %d", limiter.Token(key))
+	}
+}
+
 func TestSlidingWindow_Concurrency(t *testing.T) {
 	option := internal.Options{
 		Limit:  100,
@@ -138,7 +163,6 @@ func TestSlidingWindow_RemoveSamples(t *testing.T) {
 		Window: time.Second,
 	}
 	limiter := NewSlidingWindowLimiter(option)
-	key := "remove_key"
 
 	now := time.Now()
 	past1 := now.Add(-1 * time.Second)
@@ -146,29 +170,30 @@ func TestSlidingWindow_RemoveSamples(t *testing.T) {
 	past3 := now.Add(-3 * time.Second)
 
 	// Manually populate timeLogs with outdated timestamps
-	limiter.timeLogs[key] = []time.Time{past3, past2, past1}
+	logs := &samples{timeLogs: []time.Time{past3, past2, past1}}
 
-	limiter.removeSamples(key, now)
+	limiter.config.Load().removeSamples(logs, now)
 
 	// Only past1 should remain after removeSamples is called
-	if len(limiter.timeLogs[key]) != 1 {
-		t.Fatalf("Expected 1 log, got %d", len(limiter.timeLogs[key]))
+	if len(logs.timeLogs) != 1 {
+		t.Fatalf("Expected 1 log, got %d", len(logs.timeLogs))
 	}
 
 	// Test with no logs
-	key2 := "remove_key2"
-	limiter.removeSamples(key2, now)
+	empty := &samples{}
+	limiter.config.Load().removeSamples(empty, now)
 
-	// timeLogs[key2] should be initialized with an empty slice of Time{}
-	if len(limiter.timeLogs[key2]) != 0 {
-		t.Fatalf("Expected timeLogs to be initialized. Got length %d", len(limiter.timeLogs[key2]))
+	if len(empty.timeLogs) != 0 {
+		t.Fatalf("Expected timeLogs to stay empty. Got length %d", len(empty.timeLogs))
 	}
 }
 
 func TestSlidingWindow_Wait(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
 	option := internal.Options{
 		Limit:  1,
 		Window: time.Second,
+		Clock:  clock,
 	}
 	limiter := NewSlidingWindowLimiter(option)
 	key := "wait_key"
@@ -178,14 +203,446 @@ func TestSlidingWindow_Wait(t *testing.T) {
 		t.Error("Expected Allow to return true")
 	}
 
-	// next request would need to wait
-	start := time.Now()
+	// next request would need to wait for the first to leave the window
+	go func() {
+		clock.BlockUntil(1)
+		clock.Advance(time.Second + time.Nanosecond)
+	}()
+	start := clock.Now()
+
+	if !limiter.Wait(key) {
+		t.Error("Expected Wait to return true")
+	}
+
+	if duration := clock.Now().Sub(start); duration < time.Second {
+		t.Errorf("Wait time less than 1 seconds: %v", duration)
+	}
+	if limiter.Allow(key) {
+		t.Error("Expected Wait to consume the unit")
+	}
+}
+
+func TestSlidingWindow_WaitContext(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	option := internal.Options{
+		Limit:  2,
+		Window: time.Millisecond * 100,
+		Clock:  clock,
+	}
+	limiter := NewSlidingWindowLimiter(option)
+	key := "wait_key"
+
+	limiter.Allow(key)
+	clock.Advance(time.Millisecond * 50)
+	limiter.Allow(key)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	if err := limiter.WaitContext(ctx, key); !errors.Is(err, internal.ErrWaitExceedsDeadline) {
+		t.Errorf("Expected ErrWaitExceedsDeadline, got %v", err)
+	}
+
+	// Only the oldest sample has to expire, 50ms from now
+	go func() {
+		clock.BlockUntil(1)
+		clock.Advance(time.Millisecond*50 + time.Nanosecond)
+	}()
+	start := clock.Now()
+	if err := limiter.WaitContext(context.Background(), key); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	duration := clock.Now().Sub(start)
+
+	if duration != time.Millisecond*50+time.Nanosecond {
+		t.Errorf("Expected to wait for the oldest sample only, waited %v", duration)
+	}
+	if limiter.Allow(key) {
+		t.Error("Expected WaitContext to take the unit it waited for")
+	}
+}
+
+func TestSlidingWindow_AllowN(t *testing.T) {
+	option := internal.Options{
+		Limit:  5,
+		Window: time.Second,
+	}
+	limiter := NewSlidingWindowLimiter(option)
+	key := "weighted_key"
+
+	if !limiter.AllowN(key, 4) {
+		t.Error("Expected AllowN(4) to return true")
+	}
+	if limiter.AllowN(key, 2) {
+		t.Error("Expected AllowN(2) to return false")
+	}
+	if limiter.Token(key) != 1 {
+		t.Errorf("Expected 1 token, but got %d", limiter.Token(key))
+	}
+	if limiter.AllowN(key, 6) {
+		t.Error("Expected AllowN larger than the limit to return false")
+	}
+}
+
+func TestSlidingWindow_WaitN(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	option := internal.Options{
+		Limit:  3,
+		Window: time.Millisecond * 100,
+		Clock:  clock,
+	}
+	limiter := NewSlidingWindowLimiter(option)
+	key := "weighted_key"
+
+	if limiter.WaitN(key, 4) {
+		t.Error("Expected WaitN larger than the limit to return false")
+	}
+
+	limiter.AllowN(key, 3)
+
+	go func() {
+		clock.BlockUntil(1)
+		clock.Advance(time.Millisecond*100 + time.Nanosecond)
+	}()
+	start := clock.Now()
+	if !limiter.WaitN(key, 2) {
+		t.Error("Expected WaitN to return true")
+	}
+	duration := clock.Now().Sub(start)
+
+	if duration <= time.Millisecond*100 {
+		t.Errorf("Expected WaitN to wait for the window, waited %v", duration)
+	}
+	if limiter.Token(key) != 1 {
+		t.Errorf("Expected 1 token, but got %d", limiter.Token(key))
+	}
+}
+
+func TestSlidingWindow_Reserve(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	option := internal.Options{
+		Limit:  2,
+		Window: time.Millisecond * 100,
+		Clock:  clock,
+	}
+	limiter := NewSlidingWindowLimiter(option)
+	key := "reserve_key"
+
+	first := limiter.Reserve(key, 2)
+	if !first.OK() || first.Delay() != 0 {
+		t.Errorf("Expected first reservation to be ready, delay: %v", first.Delay())
+	}
+
+	// Both samples have to leave the window
+	r := limiter.Reserve(key, 2)
+	if !r.OK() {
+		t.Fatal("Expected second reservation to be OK")
+	}
+	if !r.ReadyAt().Equal(first.ReadyAt().Add(option.Window + time.Nanosecond)) {
+		t.Errorf("Expected reservation to be ready once the window passed, got %v", r.ReadyAt())
+	}
+
+	// Reservations are served in order
+	later := limiter.Reserve(key, 1)
+	if !later.ReadyAt().After(r.ReadyAt()) {
+		t.Errorf("Expected later reservation after %v, got %v", r.ReadyAt(), later.ReadyAt())
+	}
+
+	later.Cancel()
+	r.Cancel()
+	if logs := timeLogs(limiter, key); len(logs) != 2 {
+		t.Errorf("Expected cancelled samples to be removed, got %d logs", len(logs))
+	}
+
+	if r := limiter.Reserve(key, 3); r.OK() {
+		t.Error("Expected reservation larger than the limit not to be OK")
+	}
+}
+
+func TestSlidingWindow_AllowDetailed(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	option := internal.Options{
+		Limit:  2,
+		Window: time.Second,
+		Clock:  clock,
+	}
+	limiter := NewSlidingWindowLimiter(option)
+	key := "detailed_key"
+
+	d := limiter.AllowDetailed(key)
+	if !d.Allowed || d.Limit != 2 || d.Remaining != 1 || d.RetryAfter != 0 {
+		t.Errorf("Unexpected first decision: %+v", d)
+	}
+
+	clock.Advance(time.Millisecond * 10)
+	limiter.Allow(key)
+	last := timeLogs(limiter, key)[1]
+
+	d = limiter.AllowDetailed(key)
+	if d.Allowed || d.Remaining != 0 {
+		t.Errorf("Expected denial with nothing remaining: %+v", d)
+	}
+	// the oldest sample is 10ms old
+	if d.RetryAfter != time.Millisecond*990+time.Nanosecond {
+		t.Errorf("Expected RetryAfter until the oldest sample expires, got %v", d.RetryAfter)
+	}
+	if !d.ResetAt.Equal(last.Add(time.Second + time.Nanosecond)) {
+		t.Errorf("Expected ResetAt when the newest sample expires, got %v", d.ResetAt)
+	}
+}
+
+func timeLogs(limiter *SlidingWindow, key string) []time.Time {
+	e := limiter.store.Lock(key)
+	defer e.Unlock()
+
+	return e.State.timeLogs
+}
+
+func TestSlidingWindow_MaxKeys(t *testing.T) {
+	option := internal.Options{
+		Limit:   1,
+		Window:  time.Second,
+		MaxKeys: 1,
+	}
+	limiter := NewSlidingWindowLimiter(option)
+	defer limiter.Close()
+
+	limiter.Allow("key1")
+	limiter.Allow("key2")
+
+	if !limiter.Allow("key1") {
+		t.Error("Expected Allow to return true for an evicted key")
+	}
+}
+
+func TestSlidingWindow_Fresh(t *testing.T) {
+	option := internal.Options{
+		Limit:  2,
+		Window: time.Second,
+	}
+	limiter := NewSlidingWindowLimiter(option)
+
+	now := time.Now()
+	logs := &samples{timeLogs: []time.Time{now, now.Add(time.Millisecond * 500)}}
+
+	if limiter.fresh("test_key", logs, now.Add(time.Second+time.Millisecond)) {
+		t.Error("Expected log with samples in the window not to be fresh")
+	}
+	if !limiter.fresh("test_key", logs, now.Add(time.Second*2)) {
+		t.Error("Expected log to be fresh once all samples expired")
+	}
+}
+
+func TestSlidingWindow_Snapshot(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewSlidingWindowLimiter(internal.Options{
+		Limit:  5,
+		Window: time.Second,
+		Clock:  clock,
+	})
+
+	if limiter.Token("user1") != 5 || limiter.Len() != 0 {
+		t.Error("Expected Token not to start tracking the key")
+	}
+	if _, ok := limiter.Snapshot("user1"); ok {
+		t.Error("Expected no snapshot for an untracked key")
+	}
+
+	first := clock.Now()
+	limiter.Allow("user1")
+	clock.Advance(time.Millisecond * 500)
+	limiter.AllowN("user1", 2)
+	limiter.Allow("user2")
+
+	snapshot, ok := limiter.Snapshot("user1")
+	if !ok || len(snapshot.Logs) != 3 || snapshot.Remaining != 2 || !snapshot.Logs[0].Equal(first) {
+		t.Errorf("Unexpected snapshot: %+v", snapshot)
+	}
+
+	clock.Advance(time.Millisecond * 600)
+	if snapshot, _ := limiter.Snapshot("user1"); len(snapshot.Logs) != 2 {
+		t.Errorf("Expected expired samples to be left out, got %v", snapshot.Logs)
+	}
+	if keys := limiter.Keys(); len(keys) != 2 || limiter.Len() != 2 {
+		t.Errorf("Expected 2 keys, got %v", keys)
+	}
+
+	limiter.Reset("user1")
+	if limiter.Len() != 1 || limiter.Token("user1") != 5 {
+		t.Error("Expected Reset to forget the key")
+	}
 
-	limiter.Wait(key)
+	limiter.ResetAll()
+	if limiter.Len() != 0 || len(limiter.Keys()) != 0 {
+		t.Error("Expected ResetAll to forget every key")
+	}
+}
 
-	duration := time.Since(start)
+func TestSlidingWindow_Reconfigure(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewSlidingWindowLimiter(internal.Options{
+		Limit:  5,
+		Window: time.Minute,
+		Clock:  clock,
+	})
+
+	key := "test_key"
+	limiter.AllowN(key, 3)
+
+	limiter.Reconfigure(internal.Options{Limit: 2, Window: time.Second})
+	if limiter.Allow(key) {
+		t.Error("Expected the logged samples to count against the lower limit")
+	}
+
+	clock.Advance(time.Second + time.Nanosecond)
+	if !limiter.AllowN(key, 2) {
+		t.Error("Expected samples to expire after the shorter window")
+	}
+}
+
+func TestSlidingWindow_Overrides(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	calls := 0
+	options := internal.Options{
+		Limit:  2,
+		Window: time.Second,
+		Clock:  clock,
+		LimitFunc: func(key string) internal.Options {
+			calls++
+			if key == "pro" {
+				return internal.Options{Limit: 10}
+			}
+			return internal.Options{}
+		},
+	}
+	limiter := NewSlidingWindowLimiter(options)
+
+	if !limiter.AllowN("pro", 10) || limiter.Allow("pro") {
+		t.Error("Expected pro to get its own limit")
+	}
+	if !limiter.AllowN("free", 2) || limiter.Allow("free") {
+		t.Error("Expected free to get the default limit")
+	}
+	if calls != 2 {
+		t.Errorf("Expected LimitFunc to be asked once per key, got %d calls", calls)
+	}
+
+	// moving pro to a lower tier judges its samples against the new limit
+	options.Overrides = map[string]internal.Options{"pro": {Limit: 5}}
+	options.LimitFunc = nil
+	limiter.Reconfigure(options)
+	if tokens := limiter.Token("pro"); tokens != 0 {
+		t.Errorf("Expected pro to be over its new limit, got %d", tokens)
+	}
+	clock.Advance(time.Second + time.Nanosecond)
+	if !limiter.AllowN("pro", 5) || limiter.Allow("pro") {
+		t.Error("Expected pro to get the new override")
+	}
+}
+
+func TestSlidingWindow_AllowAll(t *testing.T) {
+	limiter := NewSlidingWindowLimiter(internal.Options{
+		Limit:  2,
+		Window: time.Minute,
+	})
+
+	if !limiter.AllowAll("ip", "api_key", "ip") {
+		t.Fatal("Expected every key to have room")
+	}
+	if limiter.AllowAll("api_key", "ip") {
+		t.Error("Expected the full ip window to deny")
+	}
+	if tokens := limiter.Token("api_key"); tokens != 1 {
+		t.Errorf("Expected nothing taken from api_key on denial, got %d left", tokens)
+	}
+}
+
+func TestSlidingWindow_AllowPriority(t *testing.T) {
+	limiter := NewSlidingWindowLimiter(internal.Options{
+		Limit:           10,
+		Window:          time.Minute,
+		PriorityReserve: 0.2,
+	})
+
+	key := "test_key"
+	allowed := map[internal.Priority]int{}
+	for _, p := range []internal.Priority{internal.PriorityLow, internal.PriorityNormal, internal.PriorityHigh} {
+		for limiter.AllowPriority(key, p) {
+			allowed[p]++
+		}
+	}
+	if allowed[internal.PriorityLow] != 6 || allowed[internal.PriorityNormal] != 2 || allowed[internal.PriorityHigh] != 2 {
+		t.Errorf("Expected low to stop at 4 left and normal at 2, got %v", allowed)
+	}
+}
+
+func TestSlidingWindow_Commit(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewSlidingWindowLimiter(internal.Options{
+		Limit:  4,
+		Window: time.Minute,
+		Clock:  clock,
+	})
+
+	key := "test_key"
+	limiter.Reserve(key, 3).Commit(1)
+	if tokens := limiter.Token(key); tokens != 3 {
+		t.Errorf("Expected the unused estimate to be refunded, got %d left", tokens)
+	}
+
+	// a reservation for the next window, followed by one further out
+	limiter.AllowN(key, 3)
+	later := limiter.Reserve(key, 2)
+	latest := limiter.Reserve(key, 1)
+	later.Commit(4)
+	latest.Commit(1)
+
+	snapshot, _ := limiter.Snapshot(key)
+	logs := snapshot.Logs
+	if !slices.IsSortedFunc(logs, time.Time.Compare) || len(logs) != 9 {
+		t.Errorf("Expected 9 samples in order, got %v", logs)
+	}
+}
+
+func TestSlidingWindow_Refund(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewSlidingWindowLimiter(internal.Options{
+		Limit:  3,
+		Window: time.Minute,
+		Clock:  clock,
+	})
+
+	key := "test_key"
+	first := clock.Now()
+	limiter.Allow(key)
+	clock.Advance(time.Second)
+	limiter.AllowN(key, 2)
+	r := limiter.Reserve(key, 1)
+
+	limiter.Refund(key, 2)
+	logs := timeLogs(limiter, key)
+	if len(logs) != 2 || !logs[0].Equal(first) || !logs[1].Equal(r.ReadyAt()) {
+		t.Errorf("Expected the newest samples up to now to be removed, got %v", logs)
+	}
+}
+
+// Run with -cpu 1,2,4,8 to see throughput scale over distinct keys.
+func BenchmarkSlidingWindow_Allow(b *testing.B) {
+	limiter := NewSlidingWindowLimiter(internal.Options{
+		Limit:  1000,
+		Window: time.Second,
+	})
 
-	if float64(time.Second)-float64(duration) < float64(time.Millisecond*10) {
-		t.Errorf("Wait time less than 1 seconds")
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = "key-" + strconv.Itoa(i)
 	}
+	var next atomic.Uint64
+
+	b.RunParallel(func(pb *testing.PB) {
+		i := next.Add(1) * 7919
+		for pb.Next() {
+			limiter.Allow(keys[i%uint64(len(keys))])
+			i++
+		}
+	})
 }
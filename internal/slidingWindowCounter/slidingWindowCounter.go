@@ -0,0 +1,509 @@
+package slidingWindowCounter
+
+import (
+	"context"
+	"math/bits"
+	"sync/atomic"
+	"time"
+
+	internal "github.com/sirius1b/go-rate-limit/internal"
+)
+
+// SlidingWindowCounter approximates a sliding window log with two counters per
+// key: the units taken in the current fixed window and in the previous one.
+// The previous window counts for the share of it the sliding window still
+// overlaps, assuming its units were spread evenly, so memory stays constant
+// whatever the limit.
+type SlidingWindowCounter struct {
+	config atomic.Pointer[config]
+	store  *internal.Store[counter]
+	queue  *internal.Queue
+
+	clock internal.Clock
+}
+
+// config holds the Limit and Window the two counters are weighed with.
+// Reconfigure swaps in a new one rather than change it in place.
+type config struct {
+	limit   int
+	window  time.Duration
+	reserve float64
+
+	tiers internal.Tiers[config]
+}
+
+type counter struct {
+	// start of the current window; windows follow each other back to back
+	// from the key's first use
+	start time.Time
+	prev  int
+	curr  int
+
+	// config the state was last brought up to date with, resolved from the
+	// limiter's config root; both nil while fresh
+	config *config
+	root   *config
+}
+
+func NewSlidingWindowCounterLimiter(option internal.Options) *SlidingWindowCounter {
+	f := &SlidingWindowCounter{
+		clock: option.ClockOrDefault(),
+	}
+	f.config.Store(newConfig(option))
+	f.store = internal.NewStore(option, f.fresh)
+	f.queue = internal.NewQueue(option)
+	return f
+}
+
+// headroom is how much of the limit priority p has to leave untouched.
+func (c *config) headroom(p internal.Priority) int {
+	return internal.Headroom(c.limit, c.reserve, p)
+}
+
+func newConfig(option internal.Options) *config {
+	c := &config{limit: option.Limit, window: option.Window, reserve: option.PriorityReserve}
+	c.tiers = internal.NewTiers(option, c, newConfig)
+	return c
+}
+
+func (f *SlidingWindowCounter) Allow(key string) bool {
+	return f.AllowN(key, 1)
+}
+
+func (f *SlidingWindowCounter) AllowN(key string, n int) bool {
+	e, c := f.lock(key)
+	defer e.Unlock()
+	s := &e.State
+
+	if n <= 0 || n > c.limit {
+		return false
+	}
+
+	now := f.clock.Now()
+	c.roll(s, now)
+
+	if c.used(s, now)+n <= c.limit {
+		s.curr += n
+		return true
+	}
+
+	return false
+}
+
+// AllowAll takes a unit from each of keys, two from a key listed twice, but
+// only if every one of them has it.
+func (f *SlidingWindowCounter) AllowAll(keys ...string) bool {
+	keys, counts := internal.Tally(keys)
+	entries := f.store.LockAll(keys)
+	defer internal.UnlockAll(entries)
+
+	now := f.clock.Now()
+	for index, e := range entries {
+		s := &e.State
+		c := f.sync(keys[index], s, now)
+		c.roll(s, now)
+
+		if c.used(s, now)+counts[index] > c.limit {
+			return false
+		}
+	}
+
+	for index, e := range entries {
+		e.State.curr += counts[index]
+	}
+	return true
+}
+
+// AllowPriority is Allow for a request of priority p, denied while taking the
+// unit would eat into the share of the limit PriorityReserve keeps for
+// higher priorities.
+func (f *SlidingWindowCounter) AllowPriority(key string, p internal.Priority) bool {
+	e, c := f.lock(key)
+	defer e.Unlock()
+	s := &e.State
+
+	now := f.clock.Now()
+	c.roll(s, now)
+
+	if c.used(s, now)+1+c.headroom(p) <= c.limit {
+		s.curr++
+		return true
+	}
+
+	return false
+}
+
+func (f *SlidingWindowCounter) AllowDetailed(key string) internal.Decision {
+	e, c := f.lock(key)
+	defer e.Unlock()
+	s := &e.State
+
+	now := f.clock.Now()
+	c.roll(s, now)
+
+	return c.admit(s, 1, internal.PriorityHigh, now)
+}
+
+// HoldOrder implements internal.Holder.
+func (f *SlidingWindowCounter) HoldOrder() uint64 {
+	return f.store.Order()
+}
+
+// Hold implements internal.Holder, deciding for each key as AllowDetailed does.
+func (f *SlidingWindowCounter) Hold(keys []string, counts []int, p internal.Priority) *internal.Held {
+	now := f.clock.Now()
+	return f.store.Hold(keys, func(index int, s *counter) (counter, internal.Decision) {
+		c := f.sync(keys[index], s, now)
+		c.roll(s, now)
+
+		held := *s
+		decision := c.admit(&held, counts[index], p, now)
+		return held, decision
+	})
+}
+
+// Wait blocks until a unit is free and takes it. The key is not locked while
+// sleeping, and the unit is claimed on waking up, starting over if another
+// caller got to it first. It returns false when the key's queue is full or the
+// wait would exceed MaxWait.
+func (f *SlidingWindowCounter) Wait(key string) bool {
+	return f.WaitN(key, 1)
+}
+
+func (f *SlidingWindowCounter) WaitN(key string, n int) bool {
+	if n <= 0 {
+		return false
+	}
+
+	return f.wait(context.Background(), key, n, internal.PriorityHigh) == nil
+}
+
+func (f *SlidingWindowCounter) WaitContext(ctx context.Context, key string) error {
+	return f.wait(ctx, key, 1, internal.PriorityHigh)
+}
+
+// WaitPriority is Wait for a request of priority p, which goes ahead of lower
+// priorities in the key's queue.
+func (f *SlidingWindowCounter) WaitPriority(key string, p internal.Priority) bool {
+	return f.wait(context.Background(), key, 1, p) == nil
+}
+
+func (f *SlidingWindowCounter) Reserve(key string, n int) *internal.Reservation {
+	e, c := f.lock(key)
+	defer e.Unlock()
+	s := &e.State
+
+	if n <= 0 || n > c.limit {
+		return internal.NewReservation(f.clock, false, time.Time{}, nil)
+	}
+
+	now := f.clock.Now()
+	c.roll(s, now)
+
+	// counted in the current window, units beyond the limit spill over into
+	// the following ones
+	readyAt := c.next(s, n, now)
+	s.curr += n
+
+	return internal.NewReservation(f.clock, true, readyAt, func() {
+		f.cancel(key, n, readyAt)
+	}).OnCommit(func(actual int) {
+		f.commit(key, actual-n)
+	})
+}
+
+// Refund gives n units back to the key, from the current window first, as when
+// a request turned out not to count.
+func (f *SlidingWindowCounter) Refund(key string, n int) {
+	if n <= 0 {
+		return
+	}
+
+	e, c := f.lock(key)
+	defer e.Unlock()
+	s := &e.State
+
+	c.roll(s, f.clock.Now())
+	s.refund(n)
+}
+
+func (f *SlidingWindowCounter) Rate() float64 {
+	c := f.config.Load()
+	return float64(c.limit) / float64(c.window.Seconds())
+}
+
+func (f *SlidingWindowCounter) Token(key string) int {
+	e, ok := f.store.Peek(key)
+	if !ok {
+		return f.config.Load().tiers.Resolve(key).limit
+	}
+	defer e.Unlock()
+
+	now := f.clock.Now()
+	s := &e.State
+	c := f.sync(key, s, now)
+	c.roll(s, now)
+	return max(0, c.limit-c.used(s, now))
+}
+
+func (f *SlidingWindowCounter) Keys() []string {
+	return f.store.Keys()
+}
+
+func (f *SlidingWindowCounter) Len() int {
+	return f.store.Len()
+}
+
+// Snapshot reports the weighted count of both windows as Count, and the start
+// of the current one as WindowStart.
+func (f *SlidingWindowCounter) Snapshot(key string) (internal.Snapshot, bool) {
+	e, ok := f.store.Peek(key)
+	if !ok {
+		return internal.Snapshot{}, false
+	}
+	defer e.Unlock()
+
+	now := f.clock.Now()
+	s := &e.State
+	c := f.sync(key, s, now)
+	c.roll(s, now)
+
+	used := c.used(s, now)
+	return internal.Snapshot{
+		Key:         key,
+		Remaining:   max(0, c.limit-used),
+		Count:       used,
+		WindowStart: s.start,
+	}, true
+}
+
+func (f *SlidingWindowCounter) Reset(key string) {
+	f.store.Delete(key)
+}
+
+func (f *SlidingWindowCounter) ResetAll() {
+	f.store.Clear()
+}
+
+// Reconfigure switches to the Limit, Window and overrides in option. Each key's
+// counts are rescaled to its new limit the next time the key is used.
+func (f *SlidingWindowCounter) Reconfigure(option internal.Options) error {
+	f.config.Store(newConfig(option))
+	return nil
+}
+
+func (f *SlidingWindowCounter) Close() error {
+	return f.store.Close()
+}
+
+// lock returns the key's entry locked, with its state migrated to the current
+// config.
+func (f *SlidingWindowCounter) lock(key string) (*internal.Entry[counter], *config) {
+	e := f.store.Lock(key)
+	return e, f.sync(key, &e.State, f.clock.Now())
+}
+
+// sync brings s up to date with the key's current config and returns it.
+func (f *SlidingWindowCounter) sync(key string, s *counter, now time.Time) *config {
+	root := f.config.Load()
+	if s.root == root {
+		return s.config
+	}
+
+	c := root.tiers.Resolve(key)
+	if old := s.config; old != nil {
+		old.roll(s, now)
+		// rounded up so that shrinking the limit never frees up units
+		s.prev = (s.prev*c.limit + old.limit - 1) / old.limit
+		s.curr = (s.curr*c.limit + old.limit - 1) / old.limit
+	}
+	s.config, s.root = c, root
+	return c
+}
+
+// wait queues up for the key and then waits until delay reports no more
+// waiting is needed.
+func (f *SlidingWindowCounter) wait(ctx context.Context, key string, n int, p internal.Priority) error {
+	return f.queue.DoPriority(ctx, key, p, func(deadline time.Time) error {
+		return internal.WaitUntil(ctx, f.clock, deadline, func() time.Duration {
+			return f.delay(key, n, p)
+		})
+	})
+}
+
+// delay reports how long until n units fit in the key's sliding window,
+// consuming them right away when they already fit. Priority p has to leave its
+// headroom untouched.
+func (f *SlidingWindowCounter) delay(key string, n int, p internal.Priority) time.Duration {
+	e, c := f.lock(key)
+	defer e.Unlock()
+	s := &e.State
+
+	if n > c.limit {
+		// the limit went down below n since the wait started
+		return internal.InfDuration
+	}
+
+	now := f.clock.Now()
+	c.roll(s, now)
+
+	readyAt := c.next(s, n+c.headroom(p), now)
+	if readyAt.After(now) {
+		return readyAt.Sub(now)
+	}
+
+	s.curr += n
+	return 0
+}
+
+// admit counts n units in s for a request of priority p if they fit, and
+// describes s afterwards. More than the limit never fits, so that is denied
+// without a RetryAfter.
+func (c *config) admit(s *counter, n int, p internal.Priority, now time.Time) internal.Decision {
+	decision := internal.Decision{Limit: c.limit}
+
+	readyAt := c.next(s, n+c.headroom(p), now)
+	switch {
+	case n > c.limit:
+	case readyAt.After(now):
+		decision.RetryAfter = readyAt.Sub(now)
+	default:
+		s.curr += n
+		decision.Allowed = true
+	}
+
+	decision.Remaining = max(0, c.limit-c.used(s, now))
+	decision.ResetAt = c.reset(s, now)
+
+	return decision
+}
+
+// used is the estimated number of units taken in the sliding window ending at
+// now: the current window's count plus the previous one's weighted by how much
+// of it the sliding window still covers, rounded up.
+func (c *config) used(s *counter, now time.Time) int {
+	return c.weigh(s.prev, now.Sub(s.start)) + s.curr
+}
+
+// weigh returns the part of prev still inside a sliding window that ends
+// elapsed into the current fixed window.
+func (c *config) weigh(prev int, elapsed time.Duration) int {
+	if prev == 0 || elapsed >= c.window {
+		return 0
+	}
+	return int(mulDivCeil(uint64(prev), uint64(c.window-elapsed), uint64(c.window)))
+}
+
+// next returns the earliest time n more units fit, assuming nothing else is
+// taken from the key in the meantime. As the previous window's weight drops
+// steadily, that may be partway through a window.
+func (c *config) next(s *counter, n int, now time.Time) time.Time {
+	start, prev, curr := s.start, s.prev, s.curr
+	for {
+		if free := c.limit - curr - n; free >= 0 {
+			if c.weigh(prev, now.Sub(start)) <= free {
+				return now
+			}
+			// weigh(prev, elapsed) <= free from here on
+			elapsed := time.Duration(mulDivCeil(uint64(c.window), uint64(prev-free), uint64(prev)))
+			if elapsed < c.window {
+				return start.Add(elapsed)
+			}
+		}
+		if prev == 0 && curr == 0 {
+			// n exceeds the limit
+			return start.Add(c.window)
+		}
+
+		start, prev, curr = start.Add(c.window), min(curr, c.limit), max(0, curr-c.limit)
+		now = start
+	}
+}
+
+// reset returns when every unit taken so far has left the sliding window.
+func (c *config) reset(s *counter, now time.Time) time.Time {
+	switch {
+	case s.curr > 0:
+		// the windows the current count spills into, then one to slide past
+		windows := (s.curr+c.limit-1)/c.limit + 1
+		return s.start.Add(time.Duration(windows) * c.window)
+	case s.prev > 0:
+		return s.start.Add(c.window)
+	default:
+		return now
+	}
+}
+
+func (f *SlidingWindowCounter) cancel(key string, n int, readyAt time.Time) {
+	e, c := f.lock(key)
+	defer e.Unlock()
+	s := &e.State
+
+	now := f.clock.Now()
+	if !readyAt.After(now) {
+		return
+	}
+
+	c.roll(s, now)
+	s.refund(n)
+}
+
+// commit charges the key delta more units for a committed reservation, or
+// refunds them when negative.
+func (f *SlidingWindowCounter) commit(key string, delta int) {
+	e, c := f.lock(key)
+	defer e.Unlock()
+	s := &e.State
+
+	c.roll(s, f.clock.Now())
+	if delta < 0 {
+		s.refund(-delta)
+		return
+	}
+	s.curr += delta
+}
+
+func (s *counter) refund(n int) {
+	fromCurr := min(n, s.curr)
+	s.curr -= fromCurr
+	s.prev = max(0, s.prev-(n-fromCurr))
+}
+
+// roll moves the current window forward to the one now falls in. Units beyond
+// the limit, which reservations may have taken, spill over into the windows
+// following the one they were counted in.
+func (c *config) roll(s *counter, now time.Time) {
+	if s.start.IsZero() {
+		s.start = now
+		return
+	}
+
+	for now.Sub(s.start) >= c.window {
+		if s.prev == 0 && s.curr == 0 {
+			// skip the idle windows at once, keeping the boundaries aligned
+			s.start = s.start.Add(now.Sub(s.start) / c.window * c.window)
+			return
+		}
+
+		s.start = s.start.Add(c.window)
+		s.prev, s.curr = min(s.curr, c.limit), max(0, s.curr-c.limit)
+	}
+}
+
+// fresh reports whether both windows are empty, allowing the store to drop the
+// key.
+func (f *SlidingWindowCounter) fresh(key string, s *counter, now time.Time) bool {
+	f.sync(key, s, now).roll(s, now)
+	return s.prev == 0 && s.curr == 0
+}
+
+// mulDivCeil returns a*b/d rounded up, without overflowing on the way. The
+// quotient must fit in 64 bits.
+func mulDivCeil(a, b, d uint64) uint64 {
+	hi, lo := bits.Mul64(a, b)
+	q, r := bits.Div64(hi, lo, d)
+	if r > 0 {
+		q++
+	}
+	return q
+}
@@ -0,0 +1,465 @@
+package slidingWindowCounter
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	internal "github.com/sirius1b/go-rate-limit/internal"
+	"github.com/sirius1b/go-rate-limit/internal/slidingWindow"
+)
+
+func TestSlidingWindowCounter_Allow(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewSlidingWindowCounterLimiter(internal.Options{
+		Limit:  4,
+		Window: time.Second,
+		Clock:  clock,
+	})
+
+	key := "test_key"
+	if !limiter.AllowN(key, 4) {
+		t.Error("Expected the first window to have the whole limit")
+	}
+	if limiter.Allow(key) {
+		t.Error("Expected the fifth request to be denied")
+	}
+
+	// a quarter into the next window, three quarters of the previous count
+	// still weigh in
+	clock.Advance(time.Millisecond * 1250)
+	if !limiter.Allow(key) || limiter.Allow(key) {
+		t.Error("Expected exactly one request to fit next to 3 weighted units")
+	}
+
+	// halfway, the previous window weighs 2 next to the current 1
+	clock.Advance(time.Millisecond * 250)
+	if !limiter.Allow(key) || limiter.Allow(key) {
+		t.Error("Expected exactly one more request to fit halfway through")
+	}
+
+	// two windows on, only the second one's 2 units weigh in, fully at first
+	clock.Advance(time.Millisecond * 500)
+	if !limiter.AllowN(key, 2) || limiter.Allow(key) {
+		t.Error("Expected the previous window's count to carry over")
+	}
+
+	// after an idle stretch the key starts over
+	clock.Advance(time.Minute)
+	if !limiter.AllowN(key, 4) {
+		t.Error("Expected an idle key to have the whole limit")
+	}
+}
+
+func TestSlidingWindowCounter_Concurrency(t *testing.T) {
+	limiter := NewSlidingWindowCounterLimiter(internal.Options{
+		Limit:  10,
+		Window: time.Minute,
+	})
+
+	key := "test_key"
+	var allowed int
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if limiter.Allow(key) {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed != 10 || limiter.Token(key) != 0 {
+		t.Errorf("Expected exactly the limit to be allowed, got %d", allowed)
+	}
+}
+
+func TestSlidingWindowCounter_Wait(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewSlidingWindowCounterLimiter(internal.Options{
+		Limit:  4,
+		Window: time.Second,
+		Clock:  clock,
+	})
+
+	key := "test_key"
+	limiter.AllowN(key, 4)
+
+	done := make(chan bool)
+	go func() {
+		done <- limiter.Wait(key)
+	}()
+
+	// the previous window's 4 units weigh 3 or less from a quarter in
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	clock.BlockUntil(1)
+	clock.Advance(time.Millisecond * 249)
+	clock.BlockUntil(1)
+	clock.Advance(time.Millisecond)
+	if !<-done {
+		t.Fatal("Expected Wait to succeed")
+	}
+	if limiter.Allow(key) {
+		t.Error("Expected Wait to consume the unit it waited for")
+	}
+}
+
+func TestSlidingWindowCounter_WaitContext(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewSlidingWindowCounterLimiter(internal.Options{
+		Limit:  1,
+		Window: time.Second,
+		Clock:  clock,
+	})
+
+	key := "test_key"
+	limiter.Allow(key)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- limiter.WaitContext(ctx, key)
+	}()
+	clock.BlockUntil(1)
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+
+	if err := limiter.WaitContext(context.Background(), "other_key"); err != nil {
+		t.Errorf("Expected an idle key not to wait, got %v", err)
+	}
+	if limiter.Allow("other_key") {
+		t.Error("Expected WaitContext to take the unit")
+	}
+}
+
+func TestSlidingWindowCounter_Reserve(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewSlidingWindowCounterLimiter(internal.Options{
+		Limit:  4,
+		Window: time.Second,
+		Clock:  clock,
+	})
+
+	key := "test_key"
+	start := clock.Now()
+
+	if r := limiter.Reserve(key, 4); !r.OK() || r.Delay() != 0 {
+		t.Errorf("First reservation should be usable right away, delay: %v", r.Delay())
+	}
+
+	// 2 units fit once the previous window's 4 weigh 2
+	r := limiter.Reserve(key, 2)
+	if !r.ReadyAt().Equal(start.Add(time.Millisecond * 1500)) {
+		t.Errorf("Expected the reservation to be ready halfway through the next window, was: %v", r.ReadyAt())
+	}
+
+	// the 2 units spill over into the next window, which the next
+	// reservation has to wait to slide past
+	r2 := limiter.Reserve(key, 4)
+	if !r2.ReadyAt().Equal(start.Add(time.Second * 3)) {
+		t.Errorf("Expected the reservation to wait out the spilled units, was: %v", r2.ReadyAt())
+	}
+
+	r2.Cancel()
+	r.Cancel()
+	if tokens := limiter.Token(key); tokens != 0 {
+		t.Errorf("Expected cancelling to hand the units back, got %d left", tokens)
+	}
+
+	clock.Advance(time.Millisecond * 1500)
+	if !limiter.AllowN(key, 2) || limiter.Allow(key) {
+		t.Error("Expected cancelled units not to count")
+	}
+
+	if r := limiter.Reserve(key, 5); r.OK() {
+		t.Error("Reservation larger than the limit should not be OK")
+	}
+}
+
+func TestSlidingWindowCounter_AllowDetailed(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewSlidingWindowCounterLimiter(internal.Options{
+		Limit:  2,
+		Window: time.Second,
+		Clock:  clock,
+	})
+
+	key := "test_key"
+	start := clock.Now()
+
+	d := limiter.AllowDetailed(key)
+	if !d.Allowed || d.Limit != 2 || d.Remaining != 1 || d.RetryAfter != 0 {
+		t.Errorf("Unexpected first decision: %+v", d)
+	}
+	if !d.ResetAt.Equal(start.Add(time.Second * 2)) {
+		t.Errorf("ResetAt should be when the window has slid past, was: %v", d.ResetAt)
+	}
+
+	limiter.Allow(key)
+	d = limiter.AllowDetailed(key)
+	if d.Allowed || d.Remaining != 0 {
+		t.Errorf("Third request should be denied with nothing remaining: %+v", d)
+	}
+	if d.RetryAfter != time.Millisecond*1500 {
+		t.Errorf("RetryAfter should be when the previous window weighs 1, was: %v", d.RetryAfter)
+	}
+
+	clock.Advance(time.Millisecond * 1500)
+	d = limiter.AllowDetailed(key)
+	if !d.Allowed || d.Remaining != 0 {
+		t.Errorf("Expected the request to be allowed once weighted down: %+v", d)
+	}
+}
+
+func TestSlidingWindowCounter_Snapshot(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewSlidingWindowCounterLimiter(internal.Options{
+		Limit:  10,
+		Window: time.Second,
+		Clock:  clock,
+	})
+
+	key := "test_key"
+	if _, ok := limiter.Snapshot(key); ok {
+		t.Error("Expected no snapshot for an unknown key")
+	}
+
+	start := clock.Now()
+	limiter.AllowN(key, 8)
+	clock.Advance(time.Millisecond * 1750)
+	limiter.Allow(key)
+
+	snapshot, ok := limiter.Snapshot(key)
+	if !ok {
+		t.Fatal("Expected a snapshot")
+	}
+	if snapshot.Count != 3 || snapshot.Remaining != 7 {
+		t.Errorf("Expected a quarter of 8 plus 1, got %+v", snapshot)
+	}
+	if !snapshot.WindowStart.Equal(start.Add(time.Second)) {
+		t.Errorf("Expected the start of the current window, got %v", snapshot.WindowStart)
+	}
+}
+
+func TestSlidingWindowCounter_Fresh(t *testing.T) {
+	limiter := NewSlidingWindowCounterLimiter(internal.Options{
+		Limit:  2,
+		Window: time.Second,
+	})
+
+	key := "test_key"
+	now := time.Now()
+	s := &counter{start: now, curr: 1}
+
+	if limiter.fresh(key, s, now.Add(time.Millisecond*1500)) {
+		t.Error("Counter should not be fresh while the previous window weighs in")
+	}
+	if !limiter.fresh(key, s, now.Add(time.Second*2)) {
+		t.Error("Counter should be fresh once both windows passed")
+	}
+
+	// reservations spilling over keep it alive for longer
+	s = &counter{start: now, curr: 3}
+	if limiter.fresh(key, s, now.Add(time.Second*2)) {
+		t.Error("Counter with spilled reservations should not be fresh")
+	}
+}
+
+func TestSlidingWindowCounter_Reconfigure(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewSlidingWindowCounterLimiter(internal.Options{
+		Limit:  10,
+		Window: time.Second,
+		Clock:  clock,
+	})
+
+	key := "test_key"
+	limiter.AllowN(key, 5)
+
+	limiter.Reconfigure(internal.Options{Limit: 4, Window: time.Minute})
+	if tokens := limiter.Token(key); tokens != 2 {
+		t.Errorf("Expected count to be rescaled to 2 of 4, leaving 2, got %d", tokens)
+	}
+	if rate := limiter.Rate(); rate != 4.0/60 {
+		t.Errorf("Expected rate of the new config, got %v", rate)
+	}
+
+	// the current window now lasts a minute
+	clock.Advance(time.Second * 30)
+	if !limiter.AllowN(key, 2) || limiter.Allow(key) {
+		t.Error("Expected the longer window to still be running")
+	}
+}
+
+func TestSlidingWindowCounter_Overrides(t *testing.T) {
+	limiter := NewSlidingWindowCounterLimiter(internal.Options{
+		Limit:  2,
+		Window: time.Second,
+		Overrides: map[string]internal.Options{
+			"premium": {Limit: 5},
+		},
+	})
+
+	if !limiter.AllowN("premium", 5) || limiter.Allow("premium") {
+		t.Error("Expected the override to apply to its key")
+	}
+	if limiter.AllowN("free", 3) {
+		t.Error("Expected other keys to keep the default limit")
+	}
+}
+
+func TestSlidingWindowCounter_AllowAll(t *testing.T) {
+	limiter := NewSlidingWindowCounterLimiter(internal.Options{
+		Limit:  2,
+		Window: time.Second,
+	})
+
+	if !limiter.AllowAll("a", "b", "b") {
+		t.Error("Expected keys with capacity to be allowed")
+	}
+	if limiter.AllowAll("a", "b") {
+		t.Error("Expected denial when one key is out of capacity")
+	}
+	if limiter.Token("a") != 1 {
+		t.Error("Expected a denied AllowAll to take nothing")
+	}
+}
+
+func TestSlidingWindowCounter_AllowPriority(t *testing.T) {
+	limiter := NewSlidingWindowCounterLimiter(internal.Options{
+		Limit:           10,
+		Window:          time.Second,
+		PriorityReserve: 0.2,
+	})
+
+	key := "test_key"
+	for range 6 {
+		limiter.AllowPriority(key, internal.PriorityLow)
+	}
+	if limiter.Token(key) != 4 {
+		t.Errorf("Expected low priority to leave 4 units, got %d", limiter.Token(key))
+	}
+	if !limiter.AllowPriority(key, internal.PriorityNormal) || !limiter.AllowPriority(key, internal.PriorityNormal) {
+		t.Error("Expected normal priority to use its share")
+	}
+	if limiter.AllowPriority(key, internal.PriorityNormal) || !limiter.AllowPriority(key, internal.PriorityHigh) {
+		t.Error("Expected the last units to be kept for high priority")
+	}
+}
+
+func TestSlidingWindowCounter_Refund(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewSlidingWindowCounterLimiter(internal.Options{
+		Limit:  4,
+		Window: time.Second,
+		Clock:  clock,
+	})
+
+	key := "test_key"
+	limiter.AllowN(key, 4)
+	clock.Advance(time.Second)
+	limiter.AllowN(key, 0)
+
+	// taken back from the previous window once the current one is empty
+	limiter.Refund(key, 2)
+	if tokens := limiter.Token(key); tokens != 2 {
+		t.Errorf("Expected 2 units back, got %d", tokens)
+	}
+	limiter.Refund(key, 10)
+	if tokens := limiter.Token(key); tokens != 4 {
+		t.Errorf("Expected refunds to stop at an empty key, got %d", tokens)
+	}
+}
+
+func TestSlidingWindowCounter_Commit(t *testing.T) {
+	limiter := NewSlidingWindowCounterLimiter(internal.Options{
+		Limit:  10,
+		Window: time.Minute,
+	})
+
+	key := "test_key"
+	limiter.Reserve(key, 5).Commit(2)
+	if tokens := limiter.Token(key); tokens != 8 {
+		t.Errorf("Expected the unused estimate to be refunded, got %d left", tokens)
+	}
+
+	limiter.Reserve(key, 2).Commit(9)
+	if tokens := limiter.Token(key); tokens != 0 || limiter.Allow(key) {
+		t.Errorf("Expected usage beyond the estimate to be charged, got %d left", tokens)
+	}
+}
+
+// TestSlidingWindowCounter_Error runs the same traffic through the counter and
+// a sliding window log, which counts exactly, and bounds how far apart the
+// number of requests they let through ends up.
+func TestSlidingWindowCounter_Error(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		interval func(r *rand.Rand) time.Duration
+		maxError float64
+	}{
+		// steady traffic is what the even spread assumption describes
+		{"steady", func(r *rand.Rand) time.Duration {
+			return time.Duration(r.ExpFloat64() * float64(time.Millisecond*5))
+		}, 0.02},
+		// bursts put the units of a window anywhere but evenly
+		{"bursty", func(r *rand.Rand) time.Duration {
+			if r.Intn(50) == 0 {
+				return time.Duration(r.Int63n(int64(time.Second * 2)))
+			}
+			return time.Duration(r.Int63n(int64(time.Millisecond)))
+		}, 0.05},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			clock := internal.NewFakeClock(time.Unix(0, 0))
+			option := internal.Options{Limit: 100, Window: time.Second, Clock: clock}
+			counter := NewSlidingWindowCounterLimiter(option)
+			log := slidingWindow.NewSlidingWindowLimiter(option)
+
+			r := rand.New(rand.NewSource(1))
+			key := "test_key"
+			var requests, byCounter, byLog int
+			for clock.Now().Before(time.Unix(600, 0)) {
+				requests++
+				if counter.Allow(key) {
+					byCounter++
+				}
+				if log.Allow(key) {
+					byLog++
+				}
+				clock.Advance(tc.interval(r))
+			}
+
+			relative := float64(byCounter-byLog) / float64(byLog)
+			t.Logf("%d requests, %d allowed by the log, %d by the counter (%+.2f%%)",
+				requests, byLog, byCounter, relative*100)
+			if relative > tc.maxError || relative < -tc.maxError {
+				t.Errorf("Expected the counter within %.0f%% of the log, was %+.2f%%", tc.maxError*100, relative*100)
+			}
+		})
+	}
+}
+
+func BenchmarkSlidingWindowCounter_Allow(b *testing.B) {
+	limiter := NewSlidingWindowCounterLimiter(internal.Options{
+		Limit:  1000,
+		Window: time.Second,
+	})
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			limiter.Allow("test_key")
+		}
+	})
+}
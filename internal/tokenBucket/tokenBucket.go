@@ -1,101 +1,432 @@
 package tokenBucket
 
 import (
-	"sync"
+	"context"
+	"sync/atomic"
 	"time"
 
 	internal "github.com/sirius1b/go-rate-limit/internal"
 )
 
 type TokenBucket struct {
+	config atomic.Pointer[config]
+	store  *internal.Store[bucket]
+	queue  *internal.Queue
+
+	clock internal.Clock
+}
+
+// config is what Reconfigure replaces: the bucket size, how fast it refills
+// and the reserve for high priorities.
+type config struct {
 	capacity       int
 	refillDuration time.Duration
 	refillAmount   int
-	tokens         map[string]int
-	lastRefills    map[string]time.Time
-	mus            map[string]*sync.Mutex
-	globalMu       *sync.Mutex
+	reserve        float64
+
+	tiers internal.Tiers[config]
 }
 
-func (s *TokenBucket) getMutex(key string) *sync.Mutex {
-	s.globalMu.Lock()
-	defer s.globalMu.Unlock()
-	if _, exists := s.mus[key]; !exists {
-		s.mus[key] = &sync.Mutex{}
-	}
-	return s.mus[key]
+type bucket struct {
+	tokens     int
+	lastRefill time.Time
+
+	// config the state was last brought up to date with, resolved from the
+	// limiter's config root; both nil while fresh
+	config *config
+	root   *config
 }
 
 func NewTokenBucketLimiter(option internal.Options) *TokenBucket {
-	return &TokenBucket{
+	f := &TokenBucket{
+		clock: option.ClockOrDefault(),
+	}
+	f.config.Store(newConfig(option))
+	f.store = internal.NewStore(option, f.fresh)
+	f.queue = internal.NewQueue(option)
+	return f
+}
+
+func newConfig(option internal.Options) *config {
+	c := &config{
 		capacity:       option.Capacity,
 		refillDuration: option.RefillDuration,
 		refillAmount:   option.RefillAmount,
-		tokens:         make(map[string]int),
-		lastRefills:    make(map[string]time.Time),
-		mus:            make(map[string]*sync.Mutex),
-		globalMu:       &sync.Mutex{},
+		reserve:        option.PriorityReserve,
 	}
+	c.tiers = internal.NewTiers(option, c, newConfig)
+	return c
+}
+
+// headroom is how much of the capacity priority p has to leave untouched.
+func (c *config) headroom(p internal.Priority) int {
+	return internal.Headroom(c.capacity, c.reserve, p)
 }
 
 func (f *TokenBucket) Allow(key string) bool {
-	mu := f.getMutex(key)
-	mu.Lock()
-	defer mu.Unlock()
+	return f.AllowN(key, 1)
+}
+
+func (f *TokenBucket) AllowN(key string, n int) bool {
+	e, c := f.lock(key)
+	defer e.Unlock()
+	b := &e.State
+
+	if n <= 0 || n > c.capacity {
+		return false
+	}
+
+	now := f.clock.Now()
+
+	c.refill(b, now)
+
+	if b.tokens >= n {
+		b.tokens -= n
+		return true
+	}
+
+	return false
+}
+
+// AllowAll takes a token from each of keys, two from a key listed twice, but
+// only if every one of them has it.
+func (f *TokenBucket) AllowAll(keys ...string) bool {
+	keys, counts := internal.Tally(keys)
+	entries := f.store.LockAll(keys)
+	defer internal.UnlockAll(entries)
+
+	now := f.clock.Now()
+	for index, e := range entries {
+		b := &e.State
+		f.sync(keys[index], b, now).refill(b, now)
+
+		if b.tokens < counts[index] {
+			return false
+		}
+	}
+
+	for index, e := range entries {
+		e.State.tokens -= counts[index]
+	}
+	return true
+}
 
-	now := time.Now()
+// AllowPriority is Allow for a request of priority p, denied while taking the
+// token would eat into the share of the capacity PriorityReserve keeps for
+// higher priorities.
+func (f *TokenBucket) AllowPriority(key string, p internal.Priority) bool {
+	e, c := f.lock(key)
+	defer e.Unlock()
+	b := &e.State
 
-	f.refill(key, now)
+	c.refill(b, f.clock.Now())
 
-	if f.tokens[key] > 0 {
-		f.tokens[key]--
+	if b.tokens-1 >= c.headroom(p) {
+		b.tokens--
 		return true
 	}
 
 	return false
 }
 
+func (f *TokenBucket) AllowDetailed(key string) internal.Decision {
+	e, c := f.lock(key)
+	defer e.Unlock()
+	b := &e.State
+
+	now := f.clock.Now()
+	c.refill(b, now)
+
+	return c.admit(b, 1, internal.PriorityHigh, now)
+}
+
+// HoldOrder implements internal.Holder.
+func (f *TokenBucket) HoldOrder() uint64 {
+	return f.store.Order()
+}
+
+// Hold implements internal.Holder, deciding for each key as AllowDetailed does.
+func (f *TokenBucket) Hold(keys []string, counts []int, p internal.Priority) *internal.Held {
+	now := f.clock.Now()
+	return f.store.Hold(keys, func(index int, b *bucket) (bucket, internal.Decision) {
+		f.sync(keys[index], b, now).refill(b, now)
+
+		held := *b
+		decision := b.config.admit(&held, counts[index], p, now)
+		return held, decision
+	})
+}
+
+// Wait blocks until a unit is free and takes it. The key is not locked while
+// sleeping, and the unit is claimed on waking up, starting over if another
+// caller got to it first. It returns false when the key's queue is full or the
+// wait would exceed MaxWait.
 func (f *TokenBucket) Wait(key string) bool {
-	mu := f.getMutex(key)
-	mu.Lock()
-	defer mu.Unlock()
+	return f.WaitN(key, 1)
+}
+
+func (f *TokenBucket) WaitN(key string, n int) bool {
+	if n <= 0 {
+		return false
+	}
 
-	now := time.Now()
+	return f.wait(context.Background(), key, n, internal.PriorityHigh) == nil
+}
 
-	f.refill(key, now)
+func (f *TokenBucket) WaitContext(ctx context.Context, key string) error {
+	return f.wait(ctx, key, 1, internal.PriorityHigh)
+}
 
-	elapsed := now.Sub(f.lastRefills[key])
-	if f.tokens[key] <= 0 {
-		sleepTime := f.refillDuration - elapsed
+// WaitPriority is Wait for a request of priority p, which goes ahead of lower
+// priorities in the key's queue.
+func (f *TokenBucket) WaitPriority(key string, p internal.Priority) bool {
+	return f.wait(context.Background(), key, 1, p) == nil
+}
 
-		time.Sleep(sleepTime)
+func (f *TokenBucket) Reserve(key string, n int) *internal.Reservation {
+	e, c := f.lock(key)
+	defer e.Unlock()
+	b := &e.State
+
+	if n <= 0 || n > c.capacity {
+		return internal.NewReservation(f.clock, false, time.Time{}, nil)
 	}
 
-	return true
+	now := f.clock.Now()
+	c.refill(b, now)
+
+	// the bucket may go into debt, later refills pay it back first
+	readyAt := c.next(b, n, now)
+	b.tokens -= n
+
+	return internal.NewReservation(f.clock, true, readyAt, func() {
+		f.cancel(key, n, readyAt)
+	}).OnCommit(func(actual int) {
+		f.commit(key, actual-n)
+	})
+}
+
+// Refund puts n tokens back into the key's bucket, up to its capacity, as when
+// a request turned out not to count.
+func (f *TokenBucket) Refund(key string, n int) {
+	if n <= 0 {
+		return
+	}
+
+	e, c := f.lock(key)
+	defer e.Unlock()
+	b := &e.State
+
+	c.refill(b, f.clock.Now())
+	b.tokens = min(c.capacity, b.tokens+n)
 }
 
 func (f *TokenBucket) Rate() float64 {
-	return float64(f.refillAmount) / float64(f.refillDuration.Seconds())
+	c := f.config.Load()
+	return float64(c.refillAmount) / float64(c.refillDuration.Seconds())
 }
 
 func (f *TokenBucket) Token(key string) int {
-	mu := f.getMutex(key)
-	mu.Lock()
-	defer mu.Unlock()
+	e, ok := f.store.Peek(key)
+	if !ok {
+		return f.config.Load().tiers.Resolve(key).capacity
+	}
+	defer e.Unlock()
+	b := &e.State
 
-	f.refill(key, time.Now())
+	now := f.clock.Now()
+	f.sync(key, b, now).refill(b, now)
 
-	return f.tokens[key]
+	return max(0, b.tokens)
 }
 
-func (f *TokenBucket) refill(key string, now time.Time) {
+func (f *TokenBucket) Keys() []string {
+	return f.store.Keys()
+}
+
+func (f *TokenBucket) Len() int {
+	return f.store.Len()
+}
+
+func (f *TokenBucket) Snapshot(key string) (internal.Snapshot, bool) {
+	e, ok := f.store.Peek(key)
+	if !ok {
+		return internal.Snapshot{}, false
+	}
+	defer e.Unlock()
+
+	now := f.clock.Now()
+	b := e.State
+	f.sync(key, &b, now).refill(&b, now)
+
+	return internal.Snapshot{
+		Key:        key,
+		Remaining:  max(0, b.tokens),
+		Tokens:     b.tokens,
+		LastRefill: b.lastRefill,
+	}, true
+}
+
+func (f *TokenBucket) Reset(key string) {
+	f.store.Delete(key)
+}
+
+func (f *TokenBucket) ResetAll() {
+	f.store.Clear()
+}
+
+// Reconfigure switches to the Capacity, RefillAmount, RefillDuration and
+// overrides in option. Each key is refilled under its old settings and its
+// tokens clamped to its new capacity the next time the key is used.
+func (f *TokenBucket) Reconfigure(option internal.Options) error {
+	f.config.Store(newConfig(option))
+	return nil
+}
+
+func (f *TokenBucket) Close() error {
+	return f.store.Close()
+}
+
+// lock returns the key's entry locked, with its state migrated to the current
+// config.
+func (f *TokenBucket) lock(key string) (*internal.Entry[bucket], *config) {
+	e := f.store.Lock(key)
+	return e, f.sync(key, &e.State, f.clock.Now())
+}
+
+// sync brings b up to date with the key's current config and returns it.
+func (f *TokenBucket) sync(key string, b *bucket, now time.Time) *config {
+	root := f.config.Load()
+	if b.root == root {
+		return b.config
+	}
+
+	c := root.tiers.Resolve(key)
+
+	if old := b.config; old != nil {
+		old.refill(b, now)
+		b.tokens = min(b.tokens, c.capacity)
+	}
+	b.config, b.root = c, root
+	return c
+}
+
+// wait queues up for the key and then waits until delay reports no more
+// waiting is needed.
+func (f *TokenBucket) wait(ctx context.Context, key string, n int, p internal.Priority) error {
+	return f.queue.DoPriority(ctx, key, p, func(deadline time.Time) error {
+		return internal.WaitUntil(ctx, f.clock, deadline, func() time.Duration {
+			return f.delay(key, n, p)
+		})
+	})
+}
+
+// delay reports how long until n tokens are in the key's bucket, consuming them
+// right away when they already are. Priority p has to leave its headroom in the
+// bucket.
+func (f *TokenBucket) delay(key string, n int, p internal.Priority) time.Duration {
+	e, c := f.lock(key)
+	defer e.Unlock()
+	b := &e.State
+
+	if n > c.capacity {
+		// the capacity went down below n since the wait started
+		return internal.InfDuration
+	}
+
+	now := f.clock.Now()
+	c.refill(b, now)
+
+	readyAt := c.next(b, n+c.headroom(p), now)
+	if readyAt.After(now) {
+		return readyAt.Sub(now)
+	}
+
+	b.tokens -= n
+	return 0
+}
+
+// admit takes n tokens from b for a request of priority p if they are there,
+// and describes b afterwards. More than the capacity is never there, so that
+// is denied without a RetryAfter.
+func (c *config) admit(b *bucket, n int, p internal.Priority, now time.Time) internal.Decision {
+	decision := internal.Decision{Limit: c.capacity}
+
+	readyAt := c.next(b, n+c.headroom(p), now)
+	switch {
+	case n > c.capacity:
+	case readyAt.After(now):
+		decision.RetryAfter = readyAt.Sub(now)
+	default:
+		b.tokens -= n
+		decision.Allowed = true
+	}
+
+	decision.Remaining = max(0, b.tokens)
+	decision.ResetAt = c.next(b, c.capacity, now)
+
+	return decision
+}
+
+// next returns when the bucket will hold n tokens, assuming nothing else is
+// taken from it in the meantime.
+func (c *config) next(b *bucket, n int, now time.Time) time.Time {
+	missing := n - b.tokens
+	if missing <= 0 {
+		return now
+	}
 
-	then := f.lastRefills[key]
+	refills := (missing + c.refillAmount - 1) / c.refillAmount
+	return b.lastRefill.Add(time.Duration(refills) * c.refillDuration)
+}
+
+// commit takes delta more tokens for a committed reservation, into debt if
+// need be, or puts them back up to the capacity when negative.
+func (f *TokenBucket) commit(key string, delta int) {
+	e, c := f.lock(key)
+	defer e.Unlock()
+	b := &e.State
+
+	c.refill(b, f.clock.Now())
+	b.tokens = min(c.capacity, b.tokens-delta)
+}
+
+func (f *TokenBucket) cancel(key string, n int, readyAt time.Time) {
+	e, c := f.lock(key)
+	defer e.Unlock()
+	b := &e.State
+
+	now := f.clock.Now()
+	if !readyAt.After(now) {
+		return
+	}
+
+	c.refill(b, now)
+	b.tokens = min(c.capacity, b.tokens+n)
+}
+
+func (c *config) refill(b *bucket, now time.Time) {
+
+	then := b.lastRefill
 	elapsed := now.Sub(then)
-	if elapsed >= f.refillDuration {
-		refills := int(elapsed / f.refillDuration)
-		f.tokens[key] = min(f.capacity, f.tokens[key]+refills*f.refillAmount)
-		f.lastRefills[key] = now
+	if elapsed >= c.refillDuration {
+		refills := int(elapsed / c.refillDuration)
+		b.tokens = min(c.capacity, b.tokens+refills*c.refillAmount)
+
+		// keep the progress towards the next refill unless the bucket is full
+		if b.tokens == c.capacity {
+			b.lastRefill = now
+		} else {
+			b.lastRefill = then.Add(time.Duration(refills) * c.refillDuration)
+		}
 	}
 
 }
+
+// fresh reports whether the bucket is full again, allowing the store to drop
+// the key.
+func (f *TokenBucket) fresh(key string, b *bucket, now time.Time) bool {
+	c := f.sync(key, b, now)
+	c.refill(b, now)
+	return b.tokens == c.capacity
+}
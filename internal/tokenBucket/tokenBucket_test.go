@@ -1,7 +1,11 @@
 package tokenBucket
 
 import (
+	"context"
+	"errors"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -9,10 +13,12 @@ import (
 )
 
 func TestTokenBucket_Allow(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
 	options := internal.Options{
 		Capacity:       10,
 		RefillDuration: time.Second,
 		RefillAmount:   1,
+		Clock:          clock,
 	}
 	tb := NewTokenBucketLimiter(options)
 
@@ -36,7 +42,7 @@ func TestTokenBucket_Allow(t *testing.T) {
 	}
 
 	// Wait for refill
-	time.Sleep(time.Second)
+	clock.Advance(time.Second)
 
 	// Should allow again after refill
 	if !tb.Allow(key) {
@@ -45,28 +51,36 @@ func TestTokenBucket_Allow(t *testing.T) {
 }
 
 func TestTokenBucket_Wait(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
 	options := internal.Options{
 		Capacity:       1,
 		RefillDuration: time.Millisecond * 100,
 		RefillAmount:   1,
+		Clock:          clock,
 	}
 	tb := NewTokenBucketLimiter(options)
 
 	key := "test_key"
 
 	// First wait should be immediate
-	start := time.Now()
+	start := clock.Now()
 	tb.Wait(key)
-	duration := time.Since(start)
+	duration := clock.Now().Sub(start)
 
 	if duration > time.Millisecond*10 {
 		t.Errorf("First wait took too long: %v", duration)
 	}
-	tb.Allow(key) // consuming token
+	if tokens := tb.Token(key); tokens != 0 {
+		t.Errorf("Expected Wait to consume the token, got %d left", tokens)
+	}
 	// Second wait should take refill duration
-	start = time.Now()
+	go func() {
+		clock.BlockUntil(1)
+		clock.Advance(time.Millisecond * 100)
+	}()
+	start = clock.Now()
 	tb.Wait(key)
-	duration = time.Since(start)
+	duration = clock.Now().Sub(start)
 
 	if duration < time.Millisecond*90 {
 		t.Errorf("Second wait took too short: %v", duration)
@@ -75,6 +89,9 @@ func TestTokenBucket_Wait(t *testing.T) {
 	if duration > time.Millisecond*150 {
 		t.Errorf("Second wait took too long: %v", duration)
 	}
+	if tb.Allow(key) {
+		t.Error("Expected the second Wait to consume the refilled token")
+	}
 }
 
 func TestTokenBucket_Limit(t *testing.T) {
@@ -104,10 +121,12 @@ func TestTokenBucket_Limit(t *testing.T) {
 }
 
 func TestTokenBucket_Token(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
 	options := internal.Options{
 		Capacity:       10,
 		RefillDuration: time.Second,
 		RefillAmount:   1,
+		Clock:          clock,
 	}
 	tb := NewTokenBucketLimiter(options)
 
@@ -131,7 +150,7 @@ func TestTokenBucket_Token(t *testing.T) {
 	}
 
 	// Wait for refill
-	time.Sleep(time.Second)
+	clock.Advance(time.Second)
 
 	// Check tokens after refill
 	tokens = tb.Token(key)
@@ -140,7 +159,7 @@ func TestTokenBucket_Token(t *testing.T) {
 	}
 
 	// Check token never exceeds capacity
-	time.Sleep(time.Second * 5)
+	clock.Advance(time.Second * 5)
 	tokens = tb.Token(key)
 	if tokens != 10 {
 		t.Errorf("Expected tokens to be 10, got %d", tokens)
@@ -179,3 +198,465 @@ func TestTokenBucket_Concurrency(t *testing.T) {
 		t.Errorf("Expected tokens to be between 0 and 10, got %d", tokens)
 	}
 }
+
+func TestTokenBucket_WaitContext(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	options := internal.Options{
+		Capacity:       1,
+		RefillDuration: time.Millisecond * 100,
+		RefillAmount:   1,
+		Clock:          clock,
+	}
+	tb := NewTokenBucketLimiter(options)
+
+	key := "test_key"
+	tb.Allow(key) // consuming token
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	if err := tb.WaitContext(ctx, key); !errors.Is(err, internal.ErrWaitExceedsDeadline) {
+		t.Errorf("Expected ErrWaitExceedsDeadline, got %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err := tb.WaitContext(ctx, key); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+
+	go func() {
+		clock.BlockUntil(1)
+		clock.Advance(time.Millisecond * 100)
+	}()
+	start := clock.Now()
+	if err := tb.WaitContext(context.Background(), key); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	duration := clock.Now().Sub(start)
+
+	if duration != time.Millisecond*100 {
+		t.Errorf("Wait took too short: %v", duration)
+	}
+	if tb.Allow(key) {
+		t.Errorf("Expected WaitContext to take the token it waited for")
+	}
+}
+
+func TestTokenBucket_AllowN(t *testing.T) {
+	options := internal.Options{
+		Capacity:       10,
+		RefillDuration: time.Second,
+		RefillAmount:   1,
+	}
+	tb := NewTokenBucketLimiter(options)
+
+	key := "test_key"
+
+	if !tb.AllowN(key, 7) {
+		t.Errorf("Expected request of 7 to be allowed")
+	}
+	if tb.AllowN(key, 4) {
+		t.Errorf("Expected request of 4 to be denied")
+	}
+	if tokens := tb.Token(key); tokens != 3 {
+		t.Errorf("Expected denied request not to consume, got %d tokens", tokens)
+	}
+	if tb.AllowN(key, 11) {
+		t.Errorf("Expected request larger than capacity to be denied")
+	}
+}
+
+func TestTokenBucket_WaitN(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	options := internal.Options{
+		Capacity:       4,
+		RefillDuration: time.Millisecond * 50,
+		RefillAmount:   1,
+		Clock:          clock,
+	}
+	tb := NewTokenBucketLimiter(options)
+
+	key := "test_key"
+
+	if tb.WaitN(key, 5) {
+		t.Errorf("Expected WaitN larger than capacity to return false")
+	}
+
+	tb.AllowN(key, 4)
+
+	// Needs two refills
+	go func() {
+		clock.BlockUntil(1)
+		clock.Advance(time.Millisecond * 100)
+	}()
+	start := clock.Now()
+	if !tb.WaitN(key, 2) {
+		t.Errorf("Expected WaitN to return true")
+	}
+	duration := clock.Now().Sub(start)
+
+	if duration != time.Millisecond*100 {
+		t.Errorf("WaitN took too short: %v", duration)
+	}
+	if tokens := tb.Token(key); tokens != 0 {
+		t.Errorf("Expected WaitN to consume the refilled tokens, got %d", tokens)
+	}
+}
+
+func TestTokenBucket_Reserve(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	options := internal.Options{
+		Capacity:       2,
+		RefillDuration: time.Millisecond * 100,
+		RefillAmount:   1,
+		Clock:          clock,
+	}
+	tb := NewTokenBucketLimiter(options)
+
+	key := "test_key"
+
+	r := tb.Reserve(key, 2)
+	if !r.OK() || r.Delay() != 0 {
+		t.Errorf("Expected first reservation to be ready, delay: %v", r.Delay())
+	}
+
+	// Bucket is empty, two refills are needed
+	r = tb.Reserve(key, 2)
+	if !r.OK() {
+		t.Fatal("Expected second reservation to be OK")
+	}
+	if r.Delay() != time.Millisecond*200 {
+		t.Errorf("Expected a delay of two refills, got %v", r.Delay())
+	}
+	if tokens := tb.Token(key); tokens != 0 {
+		t.Errorf("Expected no tokens while in debt, got %d", tokens)
+	}
+
+	// Cancelling pays back the debt
+	r.Cancel()
+	r = tb.Reserve(key, 1)
+	if r.Delay() != time.Millisecond*100 {
+		t.Errorf("Expected a delay of one refill after cancel, got %v", r.Delay())
+	}
+
+	clock.Advance(r.Delay())
+	if tb.Allow(key) {
+		t.Errorf("Expected the refilled token to belong to the reservation")
+	}
+
+	if r := tb.Reserve(key, 3); r.OK() {
+		t.Errorf("Expected reservation larger than capacity not to be OK")
+	}
+}
+
+func TestTokenBucket_AllowDetailed(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	options := internal.Options{
+		Capacity:       3,
+		RefillDuration: time.Second,
+		RefillAmount:   1,
+		Clock:          clock,
+	}
+	tb := NewTokenBucketLimiter(options)
+
+	key := "test_key"
+
+	d := tb.AllowDetailed(key)
+	if !d.Allowed || d.Limit != 3 || d.Remaining != 2 || d.RetryAfter != 0 {
+		t.Errorf("Unexpected first decision: %+v", d)
+	}
+	if want := clock.Now().Add(time.Second); !d.ResetAt.Equal(want) {
+		t.Errorf("Expected ResetAt %v, got %v", want, d.ResetAt)
+	}
+
+	tb.AllowN(key, 2)
+
+	d = tb.AllowDetailed(key)
+	if d.Allowed || d.Remaining != 0 {
+		t.Errorf("Expected denial with nothing remaining: %+v", d)
+	}
+	if d.RetryAfter != time.Second {
+		t.Errorf("Expected RetryAfter of one refill, got %v", d.RetryAfter)
+	}
+	if want := clock.Now().Add(3 * time.Second); !d.ResetAt.Equal(want) {
+		t.Errorf("Expected ResetAt %v, got %v", want, d.ResetAt)
+	}
+}
+
+func TestTokenBucket_MaxKeys(t *testing.T) {
+	options := internal.Options{
+		Capacity:       1,
+		RefillDuration: time.Second,
+		RefillAmount:   1,
+		MaxKeys:        1,
+	}
+	tb := NewTokenBucketLimiter(options)
+	defer tb.Close()
+
+	tb.Allow("key1")
+	tb.Allow("key2")
+
+	if !tb.Allow("key1") {
+		t.Errorf("Expected evicted key to start with a full bucket")
+	}
+}
+
+func TestTokenBucket_Fresh(t *testing.T) {
+	options := internal.Options{
+		Capacity:       2,
+		RefillDuration: time.Second,
+		RefillAmount:   1,
+	}
+	tb := NewTokenBucketLimiter(options)
+
+	now := time.Now()
+	b := &bucket{tokens: 0, lastRefill: now}
+
+	if tb.fresh("test_key", b, now.Add(time.Second)) {
+		t.Errorf("Expected a bucket that is not full not to be fresh")
+	}
+	if !tb.fresh("test_key", b, now.Add(time.Second*2)) {
+		t.Errorf("Expected a full bucket to be fresh")
+	}
+}
+
+func TestTokenBucket_Snapshot(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewTokenBucketLimiter(internal.Options{
+		Capacity:       5,
+		RefillDuration: time.Second,
+		RefillAmount:   1,
+		Clock:          clock,
+	})
+
+	if limiter.Token("user1") != 5 || limiter.Len() != 0 {
+		t.Error("Expected Token not to start tracking the key")
+	}
+	if _, ok := limiter.Snapshot("user1"); ok {
+		t.Error("Expected no snapshot for an untracked key")
+	}
+
+	limiter.AllowN("user1", 5)
+	limiter.Reserve("user1", 2)
+	limiter.Allow("user2")
+
+	snapshot, ok := limiter.Snapshot("user1")
+	if !ok || snapshot.Tokens != -2 || snapshot.Remaining != 0 || !snapshot.LastRefill.Equal(clock.Now()) {
+		t.Errorf("Unexpected snapshot: %+v", snapshot)
+	}
+	if keys := limiter.Keys(); len(keys) != 2 || limiter.Len() != 2 {
+		t.Errorf("Expected 2 keys, got %v", keys)
+	}
+
+	limiter.Reset("user1")
+	if limiter.Len() != 1 || limiter.Token("user1") != 5 {
+		t.Error("Expected Reset to forget the key")
+	}
+
+	limiter.ResetAll()
+	if limiter.Len() != 0 || len(limiter.Keys()) != 0 {
+		t.Error("Expected ResetAll to forget every key")
+	}
+}
+
+func TestTokenBucket_Reconfigure(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewTokenBucketLimiter(internal.Options{
+		Capacity:       10,
+		RefillDuration: time.Second,
+		RefillAmount:   1,
+		Clock:          clock,
+	})
+
+	key := "test_key"
+	limiter.AllowN(key, 10)
+	clock.Advance(time.Second * 8)
+
+	limiter.Reconfigure(internal.Options{Capacity: 5, RefillDuration: time.Minute, RefillAmount: 5})
+	if tokens := limiter.Token(key); tokens != 5 {
+		t.Errorf("Expected tokens refilled under the old config to be clamped to 5, got %d", tokens)
+	}
+
+	limiter.AllowN(key, 5)
+	clock.Advance(time.Second * 30)
+	if tokens := limiter.Token(key); tokens != 0 {
+		t.Errorf("Expected no refill before the new refill duration, got %d", tokens)
+	}
+	clock.Advance(time.Second * 30)
+	if tokens := limiter.Token(key); tokens != 5 {
+		t.Errorf("Expected a refill of the new amount, got %d", tokens)
+	}
+
+	limiter.Reconfigure(internal.Options{Capacity: 20, RefillDuration: time.Minute, RefillAmount: 5})
+	if tokens := limiter.Token(key); tokens != 5 {
+		t.Errorf("Expected a larger capacity not to add tokens right away, got %d", tokens)
+	}
+}
+
+func TestTokenBucket_Overrides(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewTokenBucketLimiter(internal.Options{
+		Capacity:       2,
+		RefillDuration: time.Second,
+		RefillAmount:   1,
+		Clock:          clock,
+		Overrides: map[string]internal.Options{
+			"pro": {Capacity: 10, RefillAmount: 5},
+		},
+		LimitFunc: func(key string) internal.Options {
+			if key == "enterprise" {
+				return internal.Options{Capacity: 100}
+			}
+			return internal.Options{}
+		},
+	})
+
+	for key, capacity := range map[string]int{"free": 2, "pro": 10, "enterprise": 100} {
+		if !limiter.AllowN(key, capacity) || limiter.Allow(key) {
+			t.Errorf("%s: expected a capacity of %d", key, capacity)
+		}
+	}
+
+	clock.Advance(time.Second)
+	if tokens := limiter.Token("pro"); tokens != 5 {
+		t.Errorf("Expected the pro refill amount, got %d", tokens)
+	}
+	if tokens := limiter.Token("enterprise"); tokens != 1 {
+		t.Errorf("Expected the default refill amount for enterprise, got %d", tokens)
+	}
+}
+
+func TestTokenBucket_AllowAll(t *testing.T) {
+	limiter := NewTokenBucketLimiter(internal.Options{
+		Capacity:       2,
+		RefillAmount:   1,
+		RefillDuration: time.Minute,
+	})
+
+	if !limiter.AllowAll("ip", "api_key", "ip") {
+		t.Fatal("Expected every key to have tokens")
+	}
+	if limiter.AllowAll("api_key", "ip") {
+		t.Error("Expected the empty ip bucket to deny")
+	}
+	if tokens := limiter.Token("api_key"); tokens != 1 {
+		t.Errorf("Expected nothing taken from api_key on denial, got %d left", tokens)
+	}
+}
+
+func TestTokenBucket_MaxQueue(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	limiter := NewTokenBucketLimiter(internal.Options{
+		Capacity:       1,
+		RefillAmount:   1,
+		RefillDuration: time.Second,
+		Clock:          clock,
+		MaxQueue:       1,
+	})
+
+	key := "test_key"
+	limiter.Allow(key)
+
+	done := make(chan bool)
+	go func() { done <- limiter.WaitN(key, 1) }()
+	clock.BlockUntil(1)
+
+	if limiter.WaitN(key, 1) {
+		t.Error("Expected WaitN to be turned away by the full queue")
+	}
+	err := limiter.WaitContext(context.Background(), key)
+	if !errors.Is(err, internal.ErrQueueFull) {
+		t.Errorf("Expected ErrQueueFull, got %v", err)
+	}
+
+	clock.Advance(time.Second)
+	if !<-done {
+		t.Error("Expected the queued WaitN to get its token")
+	}
+}
+
+func TestTokenBucket_AllowPriority(t *testing.T) {
+	limiter := NewTokenBucketLimiter(internal.Options{
+		Capacity:        10,
+		RefillAmount:    1,
+		RefillDuration:  time.Minute,
+		PriorityReserve: 0.2,
+	})
+
+	key := "test_key"
+	allowed := map[internal.Priority]int{}
+	for _, p := range []internal.Priority{internal.PriorityLow, internal.PriorityNormal, internal.PriorityHigh} {
+		for limiter.AllowPriority(key, p) {
+			allowed[p]++
+		}
+	}
+	if allowed[internal.PriorityLow] != 6 || allowed[internal.PriorityNormal] != 2 || allowed[internal.PriorityHigh] != 2 {
+		t.Errorf("Expected low to stop at 4 left and normal at 2, got %v", allowed)
+	}
+}
+
+func TestTokenBucket_Refund(t *testing.T) {
+	limiter := NewTokenBucketLimiter(internal.Options{
+		Capacity:       3,
+		RefillDuration: time.Minute,
+		RefillAmount:   1,
+	})
+
+	key := "test_key"
+	limiter.AllowN(key, 3)
+	limiter.Refund(key, 2)
+	if tokens := limiter.Token(key); tokens != 2 {
+		t.Errorf("Expected 2 tokens back, got %d", tokens)
+	}
+
+	limiter.Refund(key, 5)
+	if tokens := limiter.Token(key); tokens != 3 {
+		t.Errorf("Expected refunds not to exceed the capacity, got %d", tokens)
+	}
+}
+
+func TestTokenBucket_Commit(t *testing.T) {
+	limiter := NewTokenBucketLimiter(internal.Options{
+		Capacity:       10,
+		RefillDuration: time.Minute,
+		RefillAmount:   1,
+		Clock:          internal.NewFakeClock(time.Now()),
+	})
+
+	key := "test_key"
+	limiter.Reserve(key, 5).Commit(2)
+	if tokens := limiter.Token(key); tokens != 8 {
+		t.Errorf("Expected the unused estimate to be refunded, got %d left", tokens)
+	}
+
+	limiter.Reserve(key, 2).Commit(12)
+	if tokens := limiter.Token(key); tokens != 0 || limiter.Allow(key) {
+		t.Errorf("Expected usage beyond the estimate to be charged, got %d left", tokens)
+	}
+	if d := limiter.AllowDetailed(key); d.RetryAfter != 5*time.Minute {
+		t.Errorf("Expected the bucket to be 4 tokens in debt, retry after %v", d.RetryAfter)
+	}
+}
+
+// Run with -cpu 1,2,4,8 to see throughput scale over distinct keys.
+func BenchmarkTokenBucket_Allow(b *testing.B) {
+	limiter := NewTokenBucketLimiter(internal.Options{
+		Capacity:       1000,
+		RefillDuration: time.Second,
+		RefillAmount:   1000,
+	})
+
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = "key-" + strconv.Itoa(i)
+	}
+	var next atomic.Uint64
+
+	b.RunParallel(func(pb *testing.PB) {
+		i := next.Add(1) * 7919
+		for pb.Next() {
+			limiter.Allow(keys[i%uint64(len(keys))])
+			i++
+		}
+	})
+}
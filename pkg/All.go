@@ -0,0 +1,576 @@
+package pkg
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/sirius1b/go-rate-limit/internal"
+)
+
+// composite admits a request only when every one of its limiters does, each
+// checked with the key the path gives for it.
+type composite struct {
+	limiters []IRateLimiter
+	path     func(key string) []string
+}
+
+// All combines limiters into one that admits a request only when every one of
+// them does, as in "10 per second and 1000 per hour". Decision.Binding is the
+// index of the limiter that denied, or else of the one with the least
+// remaining.
+//
+// Allow, AllowN, AllowAll, AllowDetailed, AllowPriority and TryAcquire check the
+// limiters built by this package together, keeping the keys locked until all
+// of them have room, so a denied request never takes anything from them.
+// AtomicTokenBucket, GCRA and custom algorithms have no lock to keep: they are
+// asked first, one at a time, and refunded when another limiter denies, which
+// concurrent callers may notice in between. The waiting calls take from the
+// limiters one after the other, waiting for the permits of Acquirers only once
+// the rates have come through.
+//
+// Reconfigure the limiters passed in rather than the composite, which returns
+// ErrNotReconfigurable.
+func All(limiters ...IRateLimiter) IRateLimiter {
+	return &composite{limiters: limiters}
+}
+
+func (c *composite) Allow(key string) bool {
+	return c.AllowN(key, 1)
+}
+
+func (c *composite) AllowN(key string, n int) bool {
+	if n <= 0 {
+		return false
+	}
+
+	d, _ := admit(c.parts(key), n, PriorityHigh, false)
+	return d.Allowed
+}
+
+// AllowAll admits the request for every one of keys with every limiter, or for
+// none of them.
+func (c *composite) AllowAll(keys ...string) bool {
+	var parts []part
+	for _, key := range keys {
+		parts = append(parts, c.parts(key)...)
+	}
+
+	d, _ := admit(parts, 1, PriorityHigh, false)
+	return d.Allowed
+}
+
+func (c *composite) AllowDetailed(key string) Decision {
+	d, _ := admit(c.parts(key), 1, PriorityHigh, false)
+	return d
+}
+
+func (c *composite) AllowPriority(key string, p Priority) bool {
+	d, _ := admit(c.parts(key), 1, p, false)
+	return d.Allowed
+}
+
+func (c *composite) Wait(key string) bool {
+	return c.WaitN(key, 1)
+}
+
+// WaitN holds on to the units of the limiters that have them while waiting for
+// the others, and then waits for the permits of the Acquirers.
+func (c *composite) WaitN(key string, n int) bool {
+	return c.wait(context.Background(), key, n) == nil
+}
+
+// WaitPriority waits on the limiters in turn, holding on to the units of the
+// ones done while waiting for the next, and refunds them when one gives up.
+func (c *composite) WaitPriority(key string, p Priority) bool {
+	keys := c.keys(key)
+	for index, limiter := range c.limiters {
+		if keys[index] == "" {
+			continue
+		}
+		if !limiter.WaitPriority(keys[index], p) {
+			c.refund(keys, 1, index)
+			return false
+		}
+	}
+	return true
+}
+
+// WaitContext is WaitN for a unit, giving back what it holds when ctx is done
+// first.
+func (c *composite) WaitContext(ctx context.Context, key string) error {
+	return c.wait(ctx, key, 1)
+}
+
+// wait takes n units from every limiter, waiting for all the rates at once and
+// then for the permits of the Acquirers one after the other, which Reserve
+// can't promise. No permit is held while waiting on rates.
+func (c *composite) wait(ctx context.Context, key string, n int) error {
+	rateKeys, permitKeys := c.split(c.keys(key))
+
+	rs, refused := c.reserve(rateKeys, n)
+	if refused != nil {
+		return ErrReservationNotOK
+	}
+	if err := internal.CombineReservations(rs, nil).Wait(ctx); err != nil {
+		c.undo(rateKeys, n, rs)
+		return err
+	}
+
+	for index, limiter := range c.limiters {
+		if permitKeys[index] == "" {
+			continue
+		}
+		if err := waitFor(ctx, limiter, permitKeys[index], n); err != nil {
+			c.refund(permitKeys, n, index)
+			c.undo(rateKeys, n, rs)
+			return err
+		}
+	}
+	return nil
+}
+
+// waitFor waits for n units of limiter. Only a single unit can be waited for
+// with ctx, which is all WaitContext asks for; WaitN, which asks for more,
+// only needs to know that the wait failed.
+func waitFor(ctx context.Context, limiter IRateLimiter, key string, n int) error {
+	if n == 1 {
+		return limiter.WaitContext(ctx, key)
+	}
+	if !limiter.WaitN(key, n) {
+		return ErrReservationNotOK
+	}
+	return nil
+}
+
+func (c *composite) Reserve(key string, n int) *Reservation {
+	keys := c.keys(key)
+	rs, refused := c.reserve(keys, n)
+	if refused != nil {
+		return refused
+	}
+
+	// parts that are due already can't be cancelled, but the whole can until
+	// the last part comes due
+	var combined *Reservation
+	combined = internal.CombineReservations(rs, func() {
+		if combined.Delay() > 0 {
+			c.undo(keys, n, rs)
+		}
+	})
+	return combined
+}
+
+// Acquire takes a unit from the limiters that are not Acquirers, waiting for
+// all of them at once, and then a permit from those that are, one after the
+// other. No permit is held while waiting on rates. The function returned
+// releases the permits; the units stay taken.
+func (c *composite) Acquire(ctx context.Context, key string) (func(), error) {
+	rateKeys, permitKeys := c.split(c.keys(key))
+
+	rs, refused := c.reserve(rateKeys, 1)
+	if refused != nil {
+		return nil, ErrReservationNotOK
+	}
+	if err := internal.CombineReservations(rs, nil).Wait(ctx); err != nil {
+		c.undo(rateKeys, 1, rs)
+		return nil, err
+	}
+
+	var releases []func()
+	release := func() {
+		for _, r := range releases {
+			r()
+		}
+	}
+	for index, limiter := range c.limiters {
+		if permitKeys[index] == "" {
+			continue
+		}
+		r, err := limiter.(Acquirer).Acquire(ctx, permitKeys[index])
+		if err != nil {
+			release()
+			c.undo(rateKeys, 1, rs)
+			return nil, err
+		}
+		releases = append(releases, r)
+	}
+	return sync.OnceFunc(release), nil
+}
+
+// TryAcquire is Acquire without waiting, taking nothing when one of the
+// limiters comes up short.
+func (c *composite) TryAcquire(key string) (func(), bool) {
+	d, release := admit(c.parts(key), 1, PriorityHigh, true)
+	if !d.Allowed {
+		return nil, false
+	}
+	return sync.OnceFunc(release), true
+}
+
+func (c *composite) Refund(key string, n int) {
+	c.refund(c.keys(key), n, len(c.limiters))
+}
+
+// Rate is the lowest rate of the limiters.
+func (c *composite) Rate() float64 {
+	var rate float64
+	for index, limiter := range c.limiters {
+		if r := limiter.Rate(); index == 0 || r < rate {
+			rate = r
+		}
+	}
+	return rate
+}
+
+// Token is the lowest number of units left across the limiters.
+func (c *composite) Token(key string) int {
+	keys := c.keys(key)
+	tokens, checked := 0, false
+	for index, limiter := range c.limiters {
+		if keys[index] == "" {
+			continue
+		}
+		if t := limiter.Token(keys[index]); !checked || t < tokens {
+			tokens, checked = t, true
+		}
+	}
+	return tokens
+}
+
+// Keys lists the keys tracked by any of the limiters.
+func (c *composite) Keys() []string {
+	seen := make(map[string]struct{})
+	var keys []string
+	for _, limiter := range c.limiters {
+		for _, key := range limiter.Keys() {
+			if _, ok := seen[key]; !ok {
+				seen[key] = struct{}{}
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+func (c *composite) Len() int {
+	return len(c.Keys())
+}
+
+// Snapshot is the snapshot of the limiter with the least remaining for key.
+func (c *composite) Snapshot(key string) (Snapshot, bool) {
+	keys := c.keys(key)
+	var snapshot Snapshot
+	found := false
+	for index, limiter := range c.limiters {
+		if keys[index] == "" {
+			continue
+		}
+		s, ok := limiter.Snapshot(keys[index])
+		if ok && (!found || s.Remaining < snapshot.Remaining) {
+			snapshot, found = s, true
+		}
+	}
+	return snapshot, found
+}
+
+func (c *composite) Reset(key string) {
+	for _, limiter := range c.limiters {
+		limiter.Reset(key)
+	}
+}
+
+func (c *composite) ResetAll() {
+	for _, limiter := range c.limiters {
+		limiter.ResetAll()
+	}
+}
+
+func (c *composite) Reconfigure(Options) error {
+	return ErrNotReconfigurable
+}
+
+func (c *composite) Close() error {
+	var errs []error
+	for _, limiter := range c.limiters {
+		errs = append(errs, limiter.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// keys returns the key to check each limiter with, empty for those to skip.
+func (c *composite) keys(key string) []string {
+	keys := make([]string, len(c.limiters))
+	if c.path == nil {
+		for index := range keys {
+			keys[index] = key
+		}
+		return keys
+	}
+
+	copy(keys, c.path(key))
+	return keys
+}
+
+// split divides keys between the limiters that are Acquirers and the others,
+// leaving the keys of the other kind empty in each.
+func (c *composite) split(keys []string) (rateKeys, permitKeys []string) {
+	rateKeys = make([]string, len(keys))
+	permitKeys = make([]string, len(keys))
+	for index, limiter := range c.limiters {
+		if _, ok := limiter.(Acquirer); ok {
+			permitKeys[index] = keys[index]
+		} else {
+			rateKeys[index] = keys[index]
+		}
+	}
+	return rateKeys, permitKeys
+}
+
+// refund gives n units back to the first count limiters.
+func (c *composite) refund(keys []string, n, count int) {
+	for index, limiter := range c.limiters[:count] {
+		if keys[index] != "" {
+			limiter.Refund(keys[index], n)
+		}
+	}
+}
+
+// reserve reserves n units from every limiter, undoing the reservations made so
+// far when one of them can't ever grant them, and returning the reservation it
+// refused, on that limiter's clock. Skipped limiters get a nil entry.
+func (c *composite) reserve(keys []string, n int) ([]*Reservation, *Reservation) {
+	if n <= 0 {
+		return nil, c.refuse(keys, n)
+	}
+
+	rs := make([]*Reservation, 0, len(c.limiters))
+	for index, limiter := range c.limiters {
+		if keys[index] == "" {
+			rs = append(rs, nil)
+			continue
+		}
+		r := limiter.Reserve(keys[index], n)
+		if !r.OK() {
+			c.undo(keys, n, rs)
+			return nil, r
+		}
+		rs = append(rs, r)
+	}
+	return rs, nil
+}
+
+// refuse returns a reservation that is not OK for n units, on the clock of the
+// first limiter checked with keys if it refuses them as well.
+func (c *composite) refuse(keys []string, n int) *Reservation {
+	for index, limiter := range c.limiters {
+		if keys[index] == "" {
+			continue
+		}
+		r := limiter.Reserve(keys[index], n)
+		if !r.OK() {
+			return r
+		}
+		r.Cancel()
+		break
+	}
+	return internal.NewReservation(internal.RealClock{}, false, time.Time{}, nil)
+}
+
+// undo takes back reservations made with the first limiters. Those already due
+// are past cancelling, so their units are refunded instead.
+func (c *composite) undo(keys []string, n int, rs []*Reservation) {
+	for index, r := range rs {
+		switch {
+		case r == nil:
+		case r.Delay() > 0:
+			r.Cancel()
+		default:
+			c.limiters[index].Refund(keys[index], n)
+		}
+	}
+}
+
+// part is a limiter to check a request with, along with the key to check it
+// with. index is the position among the composite's limiters of the one the
+// part comes from, which may be a composite itself.
+type part struct {
+	index   int
+	limiter IRateLimiter
+	key     string
+}
+
+// parts lists the limiters to check key with, looking into nested composites.
+func (c *composite) parts(key string) []part {
+	var parts []part
+	for index, k := range c.keys(key) {
+		if k == "" {
+			continue
+		}
+
+		nested, ok := c.limiters[index].(*composite)
+		if !ok {
+			parts = append(parts, part{index, c.limiters[index], k})
+			continue
+		}
+		for _, p := range nested.parts(k) {
+			parts = append(parts, part{index, p.limiter, p.key})
+		}
+	}
+	return parts
+}
+
+// holderOf returns limiter as an internal.Holder, nil if it is none of this
+// package's or can't be held.
+func holderOf(limiter IRateLimiter) internal.Holder {
+	if b, ok := limiter.(interface{ holder() internal.Holder }); ok {
+		return b.holder()
+	}
+	return nil
+}
+
+// group is the parts, as indexes into those given to admit, checked with the
+// same internal.Holder, and what it held for them.
+type group struct {
+	holder  internal.Holder
+	parts   []int
+	held    *internal.Held
+	release func()
+}
+
+// admit takes n units of priority p from every one of parts, or from none.
+// The limiters of this package decide together, their keys locked until all of
+// them have; other limiters are asked first, one at a time, and refunded when
+// one of them denies. With permits set, Acquirers hand out permits released by
+// the function returned.
+//
+// The decision is that of the first part to deny, or else of the one with the
+// least remaining, its Binding being the index the part has in the composite.
+func admit(parts []part, n int, p Priority, permits bool) (Decision, func()) {
+	decisions := make([]Decision, len(parts))
+
+	var asked []int
+	var groups []*group
+	byHolder := make(map[internal.Holder]*group)
+	for index, part := range parts {
+		h := holderOf(part.limiter)
+		if h == nil {
+			asked = append(asked, index)
+			continue
+		}
+
+		g, ok := byHolder[h]
+		if !ok {
+			g = &group{holder: h}
+			byHolder[h] = g
+			groups = append(groups, g)
+		}
+		g.parts = append(g.parts, index)
+	}
+
+	var releases []func()
+	var refunds []part
+	release := func() {
+		for _, r := range releases {
+			r()
+		}
+	}
+	// undo gives back what the asked parts took
+	undo := func() {
+		release()
+		for _, part := range refunds {
+			part.limiter.Refund(part.key, n)
+		}
+	}
+
+	for _, index := range asked {
+		d, r := ask(parts[index], n, p, permits)
+		if !d.Allowed {
+			undo()
+			d.Binding = parts[index].index
+			return d, nil
+		}
+
+		if r != nil {
+			releases = append(releases, r)
+		} else {
+			refunds = append(refunds, parts[index])
+		}
+		decisions[index] = d
+	}
+
+	// holders are held in a set order so that concurrent calls can't deadlock
+	slices.SortFunc(groups, func(a, b *group) int {
+		return cmp.Compare(a.holder.HoldOrder(), b.holder.HoldOrder())
+	})
+	allowed := true
+	for _, g := range groups {
+		keys := make([]string, len(g.parts))
+		for i, index := range g.parts {
+			keys[i] = parts[index].key
+		}
+		keys, counts := internal.Tally(keys)
+		for i := range counts {
+			counts[i] *= n
+		}
+
+		if ph, ok := g.holder.(internal.PermitHolder); ok && permits {
+			g.held, g.release = ph.HoldPermits(keys, counts, p)
+		} else {
+			g.held = g.holder.Hold(keys, counts, p)
+		}
+
+		for _, index := range g.parts {
+			at, _ := slices.BinarySearch(keys, parts[index].key)
+			decisions[index] = g.held.Decisions[at]
+		}
+		allowed = allowed && g.held.Allowed()
+	}
+
+	for _, g := range groups {
+		if allowed {
+			g.held.Commit()
+			if g.release != nil {
+				releases = append(releases, g.release)
+			}
+		}
+		g.held.Unlock()
+	}
+	if !allowed {
+		undo()
+	}
+
+	decision, checked := Decision{Allowed: true}, false
+	for index, d := range decisions {
+		d.Binding = parts[index].index
+		if !d.Allowed {
+			return d, nil
+		}
+		if !checked || d.Remaining < decision.Remaining {
+			decision, checked = d, true
+		}
+	}
+	return decision, release
+}
+
+// ask takes n units of priority p from a part that can't be held, or a permit
+// along with the function releasing it when permits is set and the part hands
+// them out.
+func ask(part part, n int, p Priority, permits bool) (Decision, func()) {
+	if acquirer, ok := part.limiter.(Acquirer); ok && permits {
+		release, ok := acquirer.TryAcquire(part.key)
+		return Decision{Allowed: ok}, release
+	}
+
+	switch {
+	case p != PriorityHigh:
+		return Decision{Allowed: part.limiter.AllowPriority(part.key, p)}, nil
+	case n == 1:
+		return part.limiter.AllowDetailed(part.key), nil
+	default:
+		return Decision{Allowed: part.limiter.AllowN(part.key, n)}, nil
+	}
+}
@@ -0,0 +1,368 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func perSecondAndMinute(t *testing.T, clock *FakeClock) (IRateLimiter, IRateLimiter, IRateLimiter) {
+	t.Helper()
+
+	second, err := Require(FixedWindow, Options{Limit: 2, Window: time.Second, Clock: clock})
+	if err != nil {
+		t.Fatalf("Failed to create FixedWindow limiter: %v", err)
+	}
+	minute, err := Require(TokenBucket, Options{Capacity: 3, RefillAmount: 3, RefillDuration: time.Minute, Clock: clock})
+	if err != nil {
+		t.Fatalf("Failed to create TokenBucket limiter: %v", err)
+	}
+	return All(second, minute), second, minute
+}
+
+func TestAll(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	limiter, second, minute := perSecondAndMinute(t, clock)
+
+	key := "test_key"
+	if !limiter.AllowN(key, 2) {
+		t.Fatal("Expected both limits to admit 2")
+	}
+	if limiter.Allow(key) {
+		t.Error("Expected the per second limit to deny")
+	}
+	if tokens := minute.Token(key); tokens != 1 {
+		t.Errorf("Expected nothing to be taken from the per minute limit on denial, got %d left", tokens)
+	}
+
+	clock.Advance(time.Second)
+	if limiter.AllowN(key, 2) {
+		t.Error("Expected the per minute limit to deny")
+	}
+	if tokens := second.Token(key); tokens != 2 {
+		t.Errorf("Expected the per second limit to be refunded, got %d left", tokens)
+	}
+	if tokens := limiter.Token(key); tokens != 1 {
+		t.Errorf("Expected Token to be the lowest of the limits, got %d", tokens)
+	}
+}
+
+func TestAllAllowDetailed(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	limiter, _, minute := perSecondAndMinute(t, clock)
+
+	key := "test_key"
+	d := limiter.AllowDetailed(key)
+	if !d.Allowed || d.Binding != 0 || d.Remaining != 1 || d.Limit != 2 {
+		t.Errorf("Expected the per second limit to be the tightest: %+v", d)
+	}
+
+	minute.AllowN(key, 2)
+	d = limiter.AllowDetailed(key)
+	if d.Allowed || d.Binding != 1 || d.RetryAfter != time.Minute {
+		t.Errorf("Expected the per minute limit to deny: %+v", d)
+	}
+	if tokens := limiter.Token(key); tokens != 0 {
+		t.Errorf("Expected the denied request to be refunded, got %d", tokens)
+	}
+}
+
+func TestAllReserve(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	limiter, second, minute := perSecondAndMinute(t, clock)
+
+	key := "test_key"
+	limiter.AllowN(key, 2)
+
+	r := limiter.Reserve(key, 1)
+	if !r.OK() || r.Delay() != time.Second {
+		t.Errorf("Expected the reservation to wait for the per second limit, got %v", r.Delay())
+	}
+	r.Cancel()
+	if second.Token(key) != 0 || minute.Token(key) != 1 {
+		t.Error("Expected Cancel to give back the pending per second units")
+	}
+
+	if r := limiter.Reserve(key, 3); r.OK() {
+		t.Error("Expected a reservation above the per second limit not to be OK")
+	}
+	if minute.Token(key) != 1 {
+		t.Error("Expected the per minute reservation to be undone")
+	}
+
+	done := make(chan bool)
+	go func() { done <- limiter.WaitN(key, 1) }()
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	if !<-done {
+		t.Error("Expected WaitN to return true")
+	}
+	if minute.Token(key) != 0 {
+		t.Error("Expected WaitN to consume from every limit")
+	}
+}
+
+func TestAllWaitContext(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	limiter, second, minute := perSecondAndMinute(t, clock)
+
+	key := "test_key"
+	if err := limiter.WaitContext(context.Background(), key); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if second.Token(key) != 1 || minute.Token(key) != 2 {
+		t.Error("Expected WaitContext to take a unit from every limit")
+	}
+
+	second.Allow(key)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := limiter.WaitContext(ctx, key); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if tokens := minute.Token(key); tokens != 2 {
+		t.Errorf("Expected nothing to be held on to once ctx is done, got %d left", tokens)
+	}
+}
+
+func TestAllAllowAll(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	limiter, second, minute := perSecondAndMinute(t, clock)
+
+	if !limiter.AllowAll("ip", "api_key") {
+		t.Fatal("Expected both limits to admit both keys")
+	}
+	minute.AllowN("api_key", 2)
+	clock.Advance(time.Second)
+
+	if limiter.AllowAll("ip", "api_key") {
+		t.Error("Expected the per minute limit to deny api_key")
+	}
+	if second.Token("ip") != 2 || minute.Token("ip") != 2 {
+		t.Error("Expected nothing to be taken from ip on denial")
+	}
+}
+
+func TestAllCommit(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	limiter, second, minute := perSecondAndMinute(t, clock)
+
+	key := "test_key"
+	limiter.Reserve(key, 2).Commit(1)
+	if second.Token(key) != 1 || minute.Token(key) != 2 {
+		t.Error("Expected Commit to refund the unused unit to every limit")
+	}
+}
+
+func TestAllReconfigure(t *testing.T) {
+	limiter := All()
+	if !limiter.Allow("test_key") {
+		t.Error("Expected an empty composite to admit everything")
+	}
+	if err := limiter.Reconfigure(Options{}); !errors.Is(err, ErrNotReconfigurable) {
+		t.Errorf("Expected ErrNotReconfigurable, got %v", err)
+	}
+}
+
+func TestAllAcquire(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	rate, err := Require(FixedWindow, Options{Limit: 2, Window: time.Second, Clock: clock})
+	if err != nil {
+		t.Fatalf("Failed to create FixedWindow limiter: %v", err)
+	}
+	inFlight, err := Require(Concurrency, Options{Limit: 1, Clock: clock})
+	if err != nil {
+		t.Fatalf("Failed to create Concurrency limiter: %v", err)
+	}
+	limiter := All(rate, inFlight).(Acquirer)
+
+	key := "test_key"
+	release, err := limiter.Acquire(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, ok := limiter.TryAcquire(key); ok {
+		t.Error("Expected no permit while one is held")
+	}
+	if tokens := rate.Token(key); tokens != 1 {
+		t.Errorf("Expected the rate limit to be refunded on denial, got %d left", tokens)
+	}
+
+	release()
+	release()
+	release, ok := limiter.TryAcquire(key)
+	if !ok {
+		t.Fatal("Expected a permit once released")
+	}
+	release()
+	if _, ok := limiter.TryAcquire(key); ok {
+		t.Error("Expected the rate limit to deny")
+	}
+	if tokens := inFlight.Token(key); tokens != 1 {
+		t.Errorf("Expected no permit to be held on denial, got %d free", tokens)
+	}
+}
+
+func TestAllDeniedTakesNothing(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	resolving, resume := make(chan struct{}), make(chan struct{})
+	// created first, so the FixedWindow limit is locked after it and has to
+	// wait for it to decide
+	slow, _ := NewTokenBucket(Options{
+		Capacity:       2,
+		RefillAmount:   2,
+		RefillDuration: time.Minute,
+		Clock:          clock,
+		LimitFunc: func(string) Options {
+			close(resolving)
+			<-resume
+			return Options{Capacity: 1}
+		},
+	})
+	window, _ := NewFixedWindow(Options{Limit: 2, Window: time.Minute, Clock: clock})
+	limiter := All(window, slow)
+
+	key := "test_key"
+	admitted := make(chan bool)
+	go func() {
+		admitted <- limiter.AllowN(key, 2)
+	}()
+
+	<-resolving
+	if tokens := window.Token(key); tokens != 2 {
+		t.Errorf("Expected nothing to be taken from the FixedWindow limit before the TokenBucket one decides, got %d left", tokens)
+	}
+	close(resume)
+
+	if <-admitted {
+		t.Error("Expected the TokenBucket limit to deny")
+	}
+	if tokens := window.Token(key); tokens != 2 {
+		t.Errorf("Expected nothing to be taken from the FixedWindow limit on denial, got %d left", tokens)
+	}
+}
+
+func TestAllNotHeld(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	window, _ := NewFixedWindow(Options{Limit: 1, Window: time.Minute, Clock: clock})
+	gcra, _ := NewGCRA(Options{Capacity: 2, RefillAmount: 1, RefillDuration: time.Minute, Clock: clock})
+	limiter := All(window, gcra)
+
+	key := "test_key"
+	d := limiter.AllowDetailed(key)
+	if !d.Allowed || d.Binding != 0 {
+		t.Errorf("Expected the FixedWindow limit to be the tightest: %+v", d)
+	}
+	d = limiter.AllowDetailed(key)
+	if d.Allowed || d.Binding != 0 {
+		t.Errorf("Expected the FixedWindow limit to deny: %+v", d)
+	}
+	if tokens := gcra.Token(key); tokens != 1 {
+		t.Errorf("Expected GCRA to be refunded on denial, got %d left", tokens)
+	}
+
+	gcra.Allow(key)
+	clock.Advance(time.Minute)
+	if limiter.AllowN(key, 2) {
+		t.Error("Expected GCRA to deny")
+	}
+	if tokens := window.Token(key); tokens != 1 {
+		t.Errorf("Expected nothing to be taken from the FixedWindow limit, got %d left", tokens)
+	}
+}
+
+func TestAllNested(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	limiter, second, minute := perSecondAndMinute(t, clock)
+	nested := All(limiter, second)
+
+	key := "test_key"
+	d := nested.AllowDetailed(key)
+	if !d.Allowed || d.Binding != 0 || d.Remaining != 0 {
+		t.Errorf("Expected the per second limit to be taken from twice: %+v", d)
+	}
+	if d := nested.AllowDetailed(key); d.Allowed || d.Binding != 0 {
+		t.Errorf("Expected the nested composite to deny: %+v", d)
+	}
+	if tokens := minute.Token(key); tokens != 2 {
+		t.Errorf("Expected nothing to be taken from the per minute limit on denial, got %d left", tokens)
+	}
+}
+
+func TestAllOverLimit(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	log, _ := NewSlidingWindowLog(Options{Limit: 2, Window: time.Second, Clock: clock})
+	window, _ := NewFixedWindow(Options{Limit: 2, Window: time.Second, Clock: clock})
+	limiter := All(log, window)
+
+	if limiter.AllowN("k", 3) {
+		t.Error("Expected more than the limit to be denied")
+	}
+	if limiter.AllowAll("j", "j", "j") {
+		t.Error("Expected a key listed more often than the limit to be denied")
+	}
+	if d := limiter.AllowDetailed("k"); !d.Allowed {
+		t.Errorf("Expected nothing to be taken on denial: %+v", d)
+	}
+
+	// the same key twice asks the log for twice the units
+	same := Hierarchy(func(key string) []string { return []string{key, key} }, log, log)
+	if same.AllowN("h", 2) {
+		t.Error("Expected the levels together to ask for more than the limit")
+	}
+}
+
+func TestAllWaitPermit(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	rate, _ := NewFixedWindow(Options{Limit: 5, Window: time.Minute, Clock: clock})
+	inFlight, _ := NewConcurrency(Options{Limit: 1, Clock: clock})
+	limiter := All(rate, inFlight)
+
+	key := "test_key"
+	inFlight.Allow(key)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- limiter.WaitContext(context.Background(), key)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Expected WaitContext to wait for the permit, got %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	inFlight.Refund(key, 1)
+	if err := <-done; err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if inFlight.Token(key) != 0 || rate.Token(key) != 4 {
+		t.Error("Expected WaitContext to take a permit and a unit")
+	}
+
+	waited := make(chan bool, 1)
+	go func() {
+		waited <- limiter.WaitN(key, 1)
+	}()
+	inFlight.Refund(key, 1)
+	if !<-waited {
+		t.Error("Expected WaitN to get the permit once released")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		done <- limiter.WaitContext(ctx, key)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if tokens := rate.Token(key); tokens != 3 {
+		t.Errorf("Expected the rate limit to be refunded once ctx is done, got %d left", tokens)
+	}
+
+	if r := limiter.Reserve(key, 1); r.OK() {
+		t.Error("Expected Reserve to be refused while the permit is held")
+	}
+}
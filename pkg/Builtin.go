@@ -0,0 +1,152 @@
+package pkg
+
+import (
+	"context"
+
+	"github.com/sirius1b/go-rate-limit/internal"
+	atb "github.com/sirius1b/go-rate-limit/internal/atomicTokenBucket"
+	cc "github.com/sirius1b/go-rate-limit/internal/concurrency"
+	fw "github.com/sirius1b/go-rate-limit/internal/fixedWindow"
+	"github.com/sirius1b/go-rate-limit/internal/gcra"
+	lb "github.com/sirius1b/go-rate-limit/internal/leakyBucket"
+	sw "github.com/sirius1b/go-rate-limit/internal/slidingWindow"
+	swc "github.com/sirius1b/go-rate-limit/internal/slidingWindowCounter"
+	tb "github.com/sirius1b/go-rate-limit/internal/tokenBucket"
+)
+
+// internalLimiter is what the limiters in the internal packages implement,
+// which differs from IRateLimiter only in taking internal.Options.
+type internalLimiter interface {
+	Allow(string) bool
+	AllowN(string, int) bool
+	AllowAll(...string) bool
+	AllowDetailed(string) Decision
+	AllowPriority(string, Priority) bool
+	Wait(string) bool
+	WaitPriority(string, Priority) bool
+	WaitN(string, int) bool
+	WaitContext(context.Context, string) error
+	Reserve(string, int) *Reservation
+	Refund(string, int)
+	Rate() float64
+	Token(string) int
+	Keys() []string
+	Len() int
+	Snapshot(string) (Snapshot, bool)
+	Reset(string)
+	ResetAll()
+	Reconfigure(internal.Options) error
+	Close() error
+}
+
+// builtin validates options passed to Reconfigure before handing them to the
+// internal limiter.
+type builtin struct {
+	internalLimiter
+	limiterType LimiterType
+}
+
+func (b *builtin) Reconfigure(option Options) error {
+	if err := option.validate(b.limiterType); err != nil {
+		return err
+	}
+	return b.internalLimiter.Reconfigure(option.toInternal())
+}
+
+// holder returns the internal limiter as an internal.Holder, nil if it can't
+// be held.
+func (b *builtin) holder() internal.Holder {
+	h, _ := b.internalLimiter.(internal.Holder)
+	return h
+}
+
+// NewFixedWindow returns a FixedWindow limiter, validating option first.
+func NewFixedWindow(option Options) (IRateLimiter, error) {
+	if err := option.validate(FixedWindow); err != nil {
+		return nil, err
+	}
+	return &builtin{fw.NewFixedWindowLimiter(option.toInternal()), FixedWindow}, nil
+}
+
+// NewTokenBucket returns a TokenBucket limiter, validating option first.
+func NewTokenBucket(option Options) (IRateLimiter, error) {
+	if err := option.validate(TokenBucket); err != nil {
+		return nil, err
+	}
+	return &builtin{tb.NewTokenBucketLimiter(option.toInternal()), TokenBucket}, nil
+}
+
+// NewSlidingWindowLog returns a SlidingWindowLog limiter, validating option
+// first.
+func NewSlidingWindowLog(option Options) (IRateLimiter, error) {
+	if err := option.validate(SlidingWindowLog); err != nil {
+		return nil, err
+	}
+	return &builtin{sw.NewSlidingWindowLimiter(option.toInternal()), SlidingWindowLog}, nil
+}
+
+// NewAtomicTokenBucket returns an AtomicTokenBucket limiter, validating option
+// first.
+func NewAtomicTokenBucket(option Options) (IRateLimiter, error) {
+	if err := option.validate(AtomicTokenBucket); err != nil {
+		return nil, err
+	}
+	return &builtin{atb.NewAtomicTokenBucketLimiter(option.toInternal()), AtomicTokenBucket}, nil
+}
+
+// NewSlidingWindowCounter returns a SlidingWindowCounter limiter, validating
+// option first.
+func NewSlidingWindowCounter(option Options) (IRateLimiter, error) {
+	if err := option.validate(SlidingWindowCounter); err != nil {
+		return nil, err
+	}
+	return &builtin{swc.NewSlidingWindowCounterLimiter(option.toInternal()), SlidingWindowCounter}, nil
+}
+
+// NewLeakyBucket returns a LeakyBucket limiter, validating option first.
+func NewLeakyBucket(option Options) (IRateLimiter, error) {
+	if err := option.validate(LeakyBucket); err != nil {
+		return nil, err
+	}
+	return &builtin{lb.NewLeakyBucketLimiter(option.toInternal()), LeakyBucket}, nil
+}
+
+// NewGCRA returns a GCRA limiter, validating option first.
+func NewGCRA(option Options) (IRateLimiter, error) {
+	if err := option.validate(GCRA); err != nil {
+		return nil, err
+	}
+	return &builtin{gcra.NewGCRALimiter(option.toInternal()), GCRA}, nil
+}
+
+// acquiringBuiltin is a builtin that also hands out permits.
+type acquiringBuiltin struct {
+	builtin
+	Acquirer
+}
+
+// NewConcurrency returns a Concurrency limiter, validating option first. It
+// implements Acquirer.
+func NewConcurrency(option Options) (IRateLimiter, error) {
+	if err := option.validate(Concurrency); err != nil {
+		return nil, err
+	}
+	limiter := cc.NewConcurrencyLimiter(option.toInternal())
+	return &acquiringBuiltin{builtin{limiter, Concurrency}, limiter}, nil
+}
+
+// adaptiveBuiltin is an acquiringBuiltin that also learns its limits.
+type adaptiveBuiltin struct {
+	acquiringBuiltin
+	Adapter
+}
+
+// NewAdaptiveConcurrency returns an AdaptiveConcurrency limiter, validating
+// option first. It implements Acquirer and Adapter.
+func NewAdaptiveConcurrency(option Options) (IRateLimiter, error) {
+	if err := option.validate(AdaptiveConcurrency); err != nil {
+		return nil, err
+	}
+	limiter := cc.NewConcurrencyLimiter(option.toInternal())
+	return &adaptiveBuiltin{acquiringBuiltin{builtin{limiter, AdaptiveConcurrency}, limiter}, limiter}, nil
+}
@@ -0,0 +1,20 @@
+package pkg
+
+import (
+	"time"
+
+	"github.com/sirius1b/go-rate-limit/internal"
+)
+
+// Clock lets callers control the time seen by a limiter through Options.Clock.
+type Clock = internal.Clock
+
+type Timer = internal.Timer
+
+// FakeClock is a Clock for tests that only moves on Advance or Set, so rate
+// limit behaviour can be checked without sleeping.
+type FakeClock = internal.FakeClock
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return internal.NewFakeClock(now)
+}
@@ -0,0 +1,7 @@
+package pkg
+
+import "github.com/sirius1b/go-rate-limit/internal"
+
+// Decision is the result of AllowDetailed: whether the request was admitted,
+// how much of the limit is left, and when the key resets.
+type Decision = internal.Decision
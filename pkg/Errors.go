@@ -0,0 +1,57 @@
+package pkg
+
+import (
+	"errors"
+
+	"github.com/sirius1b/go-rate-limit/internal"
+)
+
+// ErrWaitExceedsDeadline is returned by WaitContext when the time needed for
+// capacity to free up already lies beyond the context's deadline.
+var ErrWaitExceedsDeadline = internal.ErrWaitExceedsDeadline
+
+var (
+	ErrInvalidLimiterType     = errors.New("invalid limiter type")
+	ErrInvalidLimit           = errors.New("invalid limit")
+	ErrInvalidWindow          = errors.New("invalid window")
+	ErrInvalidCapacity        = errors.New("invalid capacity")
+	ErrInvalidRefillAmount    = errors.New("invalid refill amount")
+	ErrInvalidRefillDuration  = errors.New("invalid refill duration")
+	ErrInvalidIdleTTL         = errors.New("invalid idle ttl")
+	ErrInvalidCleanupInterval = errors.New("invalid cleanup interval")
+	ErrInvalidMaxKeys         = errors.New("invalid max keys")
+	ErrInvalidShards          = errors.New("invalid shards")
+	ErrInvalidMaxQueue        = errors.New("invalid max queue")
+	ErrInvalidMaxWait         = errors.New("invalid max wait")
+	ErrInvalidPriorityReserve = errors.New("invalid priority reserve")
+	ErrInvalidLeakyBucketMode = errors.New("invalid leaky bucket mode")
+	ErrInvalidMaxHold         = errors.New("invalid max hold")
+	ErrInvalidStrategy        = errors.New("invalid strategy")
+	ErrInvalidMaxLimit        = errors.New("invalid max limit")
+
+	ErrInvalidRegistration   = errors.New("limiter type needs a name and a factory")
+	ErrLimiterTypeRegistered = errors.New("limiter type already registered")
+
+	ErrNotReconfigurable = errors.New("limiter can't be reconfigured as a whole")
+)
+
+// ErrQueueFull and ErrMaxWaitExceeded are returned by WaitContext when
+// Options.MaxQueue callers already wait on the key, or when capacity would not
+// free up within Options.MaxWait.
+var (
+	ErrQueueFull       = internal.ErrQueueFull
+	ErrMaxWaitExceeded = internal.ErrMaxWaitExceeded
+)
+
+// ErrReservationNotOK is returned by Reservation.Wait for a reservation that is
+// not OK.
+var ErrReservationNotOK = internal.ErrReservationNotOK
+
+// ErrUnsupportedOption is wrapped by an OptionError for a field that does not
+// apply to the limiter type, or can't be changed by Reconfigure.
+var ErrUnsupportedOption = internal.ErrUnsupportedOption
+
+// OptionError is returned by Require and Reconfigure when an Options field is
+// out of range or does not apply to the limiter type. It unwraps to one of the
+// ErrInvalid* sentinels, or ErrUnsupportedOption.
+type OptionError = internal.OptionError
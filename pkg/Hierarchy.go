@@ -0,0 +1,22 @@
+package pkg
+
+// Hierarchy combines limiters for nested scopes, such as the whole service, an
+// organisation and a user, into one that admits a request only when every
+// level has capacity. path resolves the key of a request to the key to check
+// at each level, path(key)[i] going with levels[i]:
+//
+//	limiter := Hierarchy(func(user string) []string {
+//		return []string{"global", orgOf(user), user}
+//	}, global, perOrg, perUser)
+//
+// A level whose key is empty, or missing from a short path, is skipped. Each
+// level keeps its own algorithm and options. Levels decide together as the
+// limiters of All do, so a request denied by the user level never takes from
+// the organisation's, not even for a moment. Decision.Binding is the index of
+// the level that denied, or else of the one with the least remaining.
+//
+// Reset, Keys and Len work on the keys of the levels as they are, without
+// resolving them, so Reset(orgKey) clears an organisation's level only.
+func Hierarchy(path func(key string) []string, levels ...IRateLimiter) IRateLimiter {
+	return &composite{limiters: levels, path: path}
+}
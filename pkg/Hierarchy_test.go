@@ -0,0 +1,128 @@
+package pkg
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHierarchy(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	global, _ := NewTokenBucket(Options{Capacity: 5, RefillAmount: 5, RefillDuration: time.Minute, Clock: clock})
+	perOrg, _ := NewFixedWindow(Options{Limit: 3, Window: time.Minute, Clock: clock})
+	perUser, _ := NewSlidingWindowLog(Options{Limit: 2, Window: time.Minute, Clock: clock})
+
+	// users are "org/user", users without an org skip the org level
+	limiter := Hierarchy(func(user string) []string {
+		org, _, found := strings.Cut(user, "/")
+		if !found {
+			return []string{"global", "", user}
+		}
+		return []string{"global", org, user}
+	}, global, perOrg, perUser)
+
+	if !limiter.AllowN("acme/alice", 2) {
+		t.Fatal("Expected every level to admit 2")
+	}
+	d := limiter.AllowDetailed("acme/alice")
+	if d.Allowed || d.Binding != 2 {
+		t.Errorf("Expected the user level to deny: %+v", d)
+	}
+
+	d = limiter.AllowDetailed("acme/bob")
+	if !d.Allowed || d.Binding != 1 || d.Remaining != 0 {
+		t.Errorf("Expected the org level to be the tightest: %+v", d)
+	}
+	d = limiter.AllowDetailed("acme/carol")
+	if d.Allowed || d.Binding != 1 {
+		t.Errorf("Expected the org level to deny: %+v", d)
+	}
+	if tokens := global.Token("global"); tokens != 2 {
+		t.Errorf("Expected the denied request to be refunded to the global level, got %d", tokens)
+	}
+
+	if !limiter.AllowN("dave", 2) {
+		t.Fatal("Expected a user without an org to skip the org level")
+	}
+	d = limiter.AllowDetailed("erin")
+	if d.Allowed || d.Binding != 0 {
+		t.Errorf("Expected the global level to deny: %+v", d)
+	}
+	if tokens := perUser.Token("erin"); tokens != 2 {
+		t.Errorf("Expected nothing to be taken from the user level, got %d left", tokens)
+	}
+
+	limiter.Reset("acme")
+	if tokens := perOrg.Token("acme"); tokens != 3 {
+		t.Errorf("Expected Reset to clear the org level, got %d left", tokens)
+	}
+	if tokens := perUser.Token("acme/alice"); tokens != 0 {
+		t.Errorf("Expected Reset to leave the users alone, got %d left", tokens)
+	}
+}
+
+func TestHierarchyDeniedTakesNothing(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	resolving, resume := make(chan struct{}), make(chan struct{})
+	// created first, so the org level is locked after it and has to wait for
+	// it to decide
+	perUser, _ := NewTokenBucket(Options{
+		Capacity:       2,
+		RefillAmount:   2,
+		RefillDuration: time.Hour,
+		Clock:          clock,
+		LimitFunc: func(user string) Options {
+			if user != "alice" {
+				return Options{}
+			}
+			close(resolving)
+			<-resume
+			return Options{Capacity: 1}
+		},
+	})
+	perOrg, _ := NewFixedWindow(Options{Limit: 2, Window: time.Second, Clock: clock})
+	limiter := Hierarchy(func(user string) []string {
+		return []string{"acme", user}
+	}, perOrg, perUser)
+
+	admitted := make(chan bool)
+	go func() {
+		admitted <- limiter.AllowN("alice", 2)
+	}()
+
+	<-resolving
+	if tokens := perOrg.Token("acme"); tokens != 2 {
+		t.Errorf("Expected nothing to be taken from the org level before the user level decides, got %d left", tokens)
+	}
+	close(resume)
+
+	if <-admitted {
+		t.Fatal("Expected the user level to deny")
+	}
+	if !limiter.AllowN("bob", 2) {
+		t.Error("Expected the org level to have room for bob")
+	}
+}
+
+func TestHierarchySameLimiter(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	perKey, _ := NewSlidingWindowLog(Options{Limit: 3, Window: time.Minute, Clock: clock})
+	// the org and the user share one limiter
+	limiter := Hierarchy(func(user string) []string {
+		org, _, _ := strings.Cut(user, "/")
+		return []string{org, user}
+	}, perKey, perKey)
+
+	if !limiter.AllowN("acme/alice", 2) {
+		t.Fatal("Expected both levels to admit 2")
+	}
+	if limiter.AllowN("acme/bob", 2) {
+		t.Error("Expected the org level to deny")
+	}
+	if tokens := perKey.Token("acme/bob"); tokens != 3 {
+		t.Errorf("Expected nothing to be taken from bob on denial, got %d left", tokens)
+	}
+	if tokens := perKey.Token("acme"); tokens != 1 {
+		t.Errorf("Expected nothing to be taken from the org on denial, got %d left", tokens)
+	}
+}
@@ -1,11 +1,9 @@
 package pkg
 
 import (
-	"errors"
-
-	fw "github.com/sirius1b/go-rate-limit/internal/fixedWindow"
-	sw "github.com/sirius1b/go-rate-limit/internal/slidingWindow"
-	tb "github.com/sirius1b/go-rate-limit/internal/tokenBucket"
+	"context"
+	"strconv"
+	"time"
 )
 
 type LimiterType int
@@ -14,27 +12,133 @@ const (
 	FixedWindow LimiterType = iota
 	TokenBucket
 	SlidingWindowLog
+	// AtomicTokenBucket is a lock-free TokenBucket. Refills are aligned to
+	// the limiter's creation time rather than each key's first use.
+	AtomicTokenBucket
+	// SlidingWindowCounter approximates SlidingWindowLog with two counts per
+	// key, the current fixed window's and the previous one's weighted by how
+	// much of it the sliding window still covers. It takes constant memory
+	// per key whatever the Limit.
+	SlidingWindowCounter
+	// LeakyBucket fills a bucket of Capacity units with every request and
+	// leaks RefillAmount of them every RefillDuration, evenly spaced. See
+	// Options.LeakyBucketMode for what happens to requests arriving faster.
+	LeakyBucket
+	// GCRA is the generic cell rate algorithm: TokenBucket semantics, with
+	// bursts of up to Capacity, from a single lock-free timestamp per key. It
+	// reports exact RetryAfter and ResetAt times.
+	GCRA
+	// Concurrency limits the number of requests in flight per key to Limit,
+	// whatever their rate. Its limiters are Acquirers.
+	Concurrency
+	// AdaptiveConcurrency is Concurrency with a limit per key that Strategy
+	// learns from the outcomes of requests, starting from Limit. Its limiters
+	// are Acquirers and Adapters.
+	AdaptiveConcurrency
 )
 
+// String returns the name the type was registered under.
+func (l LimiterType) String() string {
+	if r, ok := lookup(l); ok {
+		return r.name
+	}
+	return "LimiterType(" + strconv.Itoa(int(l)) + ")"
+}
+
 type IRateLimiter interface {
 	Allow(string) bool
+	AllowN(string, int) bool
+	// AllowAll takes a unit from each of the keys, as for a request limited
+	// by its caller, API key and target at once, only if all of them have it.
+	// The lock-free AtomicTokenBucket and GCRA only approximate this: when
+	// another call takes a key's last units between their check and their
+	// take, they refund the units already taken from the other keys, which a
+	// concurrent call may briefly find missing.
+	AllowAll(...string) bool
+	AllowDetailed(string) Decision
+	// AllowPriority and WaitPriority are Allow and Wait for a request of the
+	// given priority, see Options.PriorityReserve.
+	AllowPriority(string, Priority) bool
 	Wait(string) bool
+	WaitPriority(string, Priority) bool
+	WaitN(string, int) bool
+	// WaitContext is Wait that gives up with an error once ctx is done or
+	// the wait can't make its deadline. Otherwise it takes the unit.
+	WaitContext(context.Context, string) error
+	Reserve(string, int) *Reservation
+	// Refund gives back n units consumed from a key, for instance to undo
+	// an admission that a further check rejected.
+	Refund(string, int)
 	Rate() float64
 	Token(string) int
+
+	// Keys lists the tracked keys in no particular order, and Len counts
+	// them. Snapshot reports a key's state without creating it.
+	Keys() []string
+	Len() int
+	Snapshot(string) (Snapshot, bool)
+	// Reset forgets a key so that its next request starts from a fresh
+	// state; ResetAll does so for every key.
+	Reset(string)
+	ResetAll()
+
+	// Reconfigure changes the limiter's parameters in place, keeping the
+	// state of every key. IdleTTL, CleanupInterval, MaxKeys, Shards,
+	// MaxQueue, MaxWait, MaxHold, OnLeak and Clock keep the values the
+	// limiter was created with.
+	Reconfigure(Options) error
+
+	Close() error
 }
 
+// Require builds a limiter of a built-in or registered type.
 func Require(limiterType LimiterType, option Options) (IRateLimiter, error) {
-	var limiter IRateLimiter
-	switch limiterType {
-	case FixedWindow:
-		limiter = fw.NewFixedWindowLimiter(option.toInternal())
-	case TokenBucket:
-		limiter = tb.NewTokenBucketLimiter(option.toInternal())
-	case SlidingWindowLog:
-		limiter = sw.NewSlidingWindowLimiter(option.toInternal())
-	default:
-		return nil, errors.New("invalid case")
+	r, ok := lookup(limiterType)
+	if !ok {
+		return nil, ErrInvalidLimiterType
 	}
 
-	return limiter, nil
+	if err := option.validateShared(); err != nil {
+		return nil, err
+	}
+
+	return r.factory(option)
+}
+
+// Acquirer is implemented by limiters that hand out permits for the duration
+// of a request rather than units: Concurrency limiters, and All and Hierarchy
+// composites, whatever their limiters.
+//
+//	release, err := limiter.(Acquirer).Acquire(ctx, key)
+//	if err != nil {
+//		return err
+//	}
+//	defer release()
+type Acquirer interface {
+	// Acquire waits for a permit on the key and returns the function that
+	// releases it, which may be called more than once.
+	Acquire(context.Context, string) (func(), error)
+	// TryAcquire is Acquire without waiting, reporting false when no permit
+	// is free.
+	TryAcquire(string) (func(), bool)
+}
+
+// Adapter is implemented by AdaptiveConcurrency limiters, which learn each
+// key's limit from the outcome of its requests.
+//
+//	start := time.Now()
+//	if err := call(); errors.Is(err, context.DeadlineExceeded) {
+//		limiter.OnDrop(key)
+//	} else {
+//		limiter.OnSuccess(key, time.Since(start))
+//	}
+//	release()
+type Adapter interface {
+	// OnSuccess reports that a request completed after the given latency,
+	// and OnDrop that one failed or timed out because of overload. Both are
+	// to be called before the request's permit is released.
+	OnSuccess(string, time.Duration)
+	OnDrop(string)
+	// Limit reports the limit learned so far for the key.
+	Limit(string) int
 }
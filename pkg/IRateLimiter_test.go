@@ -1,6 +1,8 @@
 package pkg
 
 import (
+	"context"
+	"errors"
 	"testing"
 	"time"
 )
@@ -55,7 +57,199 @@ func TestRequireFixedWindow(t *testing.T) {
 		t.Errorf("Wait func returned too fast! It should wait 1s")
 	}
 
-	if !limiter.Allow(key) {
+	if limiter.Allow(key) {
 		t.Errorf("Allow func should return false after wait")
 	}
 }
+
+func TestRequireWaitContext(t *testing.T) {
+	limiter, err := Require(TokenBucket, Options{
+		Capacity:       1,
+		RefillAmount:   1,
+		RefillDuration: time.Second,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create TokenBucket limiter: %v", err)
+	}
+
+	key := "test_key"
+	limiter.Allow(key)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+
+	if err := limiter.WaitContext(ctx, key); !errors.Is(err, ErrWaitExceedsDeadline) {
+		t.Errorf("Expected ErrWaitExceedsDeadline, got %v", err)
+	}
+}
+
+func TestRequireReserve(t *testing.T) {
+	limiter, err := Require(SlidingWindowLog, Options{
+		Limit:  1,
+		Window: time.Second,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create SlidingWindowLog limiter: %v", err)
+	}
+
+	key := "test_key"
+	limiter.Allow(key)
+
+	r := limiter.Reserve(key, 1)
+	if !r.OK() || r.Delay() <= 0 {
+		t.Errorf("Expected a delayed reservation, got ok=%v delay=%v", r.OK(), r.Delay())
+	}
+
+	if r := limiter.Reserve(key, 2); r.OK() || r.Delay() != InfDuration {
+		t.Errorf("Expected reservation above the limit to fail")
+	}
+}
+
+func TestRequireFakeClock(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	limiter, err := Require(FixedWindow, Options{
+		Limit:  1,
+		Window: time.Hour,
+		Clock:  clock,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create FixedWindow limiter: %v", err)
+	}
+
+	key := "test_key"
+	if !limiter.Allow(key) {
+		t.Error("First request should be allowed")
+	}
+	if limiter.Allow(key) {
+		t.Error("Second request should be denied")
+	}
+
+	clock.Advance(time.Hour)
+
+	if !limiter.Allow(key) {
+		t.Error("Request should be allowed once the fake clock passed the window")
+	}
+}
+
+func TestRequireLeakyBucketQueue(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	limiter, err := Require(LeakyBucket, Options{
+		Capacity:        2,
+		RefillAmount:    1,
+		RefillDuration:  time.Second,
+		LeakyBucketMode: LeakyBucketQueue,
+		Clock:           clock,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create LeakyBucket limiter: %v", err)
+	}
+
+	key := "test_key"
+	first, second := limiter.Reserve(key, 1), limiter.Reserve(key, 1)
+	if first.Delay() != 0 || second.Delay() != time.Second {
+		t.Errorf("Expected requests a second apart, got %v and %v", first.Delay(), second.Delay())
+	}
+	if limiter.Allow(key) || limiter.Reserve(key, 1).OK() {
+		t.Error("Expected a full bucket to turn requests away")
+	}
+}
+
+func TestRequireAdaptiveConcurrency(t *testing.T) {
+	limiter, err := Require(AdaptiveConcurrency, Options{
+		Limit:    4,
+		Strategy: AIMD(1, 0.5),
+	})
+	if err != nil {
+		t.Fatalf("Failed to create AdaptiveConcurrency limiter: %v", err)
+	}
+
+	key := "test_key"
+	release, err := limiter.(Acquirer).Acquire(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	adapter := limiter.(Adapter)
+	adapter.OnDrop(key)
+	release()
+
+	if adapter.Limit(key) != 2 || limiter.Token(key) != 2 {
+		t.Errorf("Expected the drop to halve the limit, got %d", adapter.Limit(key))
+	}
+}
+
+func TestRequireNonPositiveCounts(t *testing.T) {
+	window := Options{Limit: 2, Window: time.Hour}
+	bucket := Options{Capacity: 2, RefillAmount: 1, RefillDuration: time.Hour}
+	for limiterType, options := range map[LimiterType]Options{
+		FixedWindow:          window,
+		TokenBucket:          bucket,
+		SlidingWindowLog:     window,
+		AtomicTokenBucket:    bucket,
+		SlidingWindowCounter: window,
+		LeakyBucket:          bucket,
+		GCRA:                 bucket,
+		Concurrency:          {Limit: 2},
+		AdaptiveConcurrency:  {Limit: 2, Strategy: AIMD(0, 0)},
+	} {
+		limiter, err := Require(limiterType, options)
+		if err != nil {
+			t.Fatalf("Failed to create %v limiter: %v", limiterType, err)
+		}
+
+		key := "test_key"
+		for _, n := range []int{0, -1} {
+			if limiter.AllowN(key, n) || limiter.WaitN(key, n) || limiter.Reserve(key, n).OK() {
+				t.Errorf("%v: expected a count of %d to be rejected", limiterType, n)
+			}
+		}
+
+		limiter.Allow(key)
+		limiter.Refund(key, -5)
+		if limiter.Token(key) != 1 {
+			t.Errorf("%v: expected a negative refund to be ignored, got %d left", limiterType, limiter.Token(key))
+		}
+
+		limiter.Reserve(key, 1).Commit(-5)
+		if limiter.Token(key) != 0 {
+			t.Errorf("%v: expected a negative commit to be ignored, got %d left", limiterType, limiter.Token(key))
+		}
+		limiter.Close()
+	}
+}
+
+func TestRequireWaitNReconfigured(t *testing.T) {
+	for _, limiterType := range []LimiterType{FixedWindow, TokenBucket, SlidingWindowLog, AtomicTokenBucket, SlidingWindowCounter, LeakyBucket, GCRA} {
+		clock := NewFakeClock(time.Now())
+		options := Options{Limit: 4, Window: time.Hour, Clock: clock}
+		if limiterType == TokenBucket || limiterType == AtomicTokenBucket || limiterType == LeakyBucket || limiterType == GCRA {
+			options = Options{Capacity: 4, RefillAmount: 1, RefillDuration: time.Hour, Clock: clock}
+		}
+		limiter, err := Require(limiterType, options)
+		if err != nil {
+			t.Fatalf("Failed to create %v limiter: %v", limiterType, err)
+		}
+
+		key := "test_key"
+		limiter.AllowN(key, 4)
+
+		done := make(chan bool)
+		go func() { done <- limiter.WaitN(key, 3) }()
+		clock.BlockUntil(1)
+
+		options.Limit, options.Capacity = min(options.Limit, 2), min(options.Capacity, 2)
+		if err := limiter.Reconfigure(options); err != nil {
+			t.Fatalf("%v: unexpected error: %v", limiterType, err)
+		}
+		clock.Advance(time.Hour * 24)
+
+		select {
+		case ok := <-done:
+			if ok {
+				t.Errorf("%v: expected WaitN to fail once the limit went below n", limiterType)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%v: expected WaitN to give up once the limit went below n", limiterType)
+		}
+		limiter.Close()
+	}
+}
@@ -0,0 +1,12 @@
+package pkg
+
+import "github.com/sirius1b/go-rate-limit/internal"
+
+// LeakyBucketMode selects what a LeakyBucket limiter does with requests
+// arriving faster than it leaks, see Options.LeakyBucketMode.
+type LeakyBucketMode = internal.LeakyBucketMode
+
+const (
+	LeakyBucketMeter = internal.LeakyBucketMeter
+	LeakyBucketQueue = internal.LeakyBucketQueue
+)
@@ -1,6 +1,8 @@
 package pkg
 
 import (
+	"math"
+	"strconv"
 	"time"
 
 	"github.com/sirius1b/go-rate-limit/internal"
@@ -13,9 +15,95 @@ type Options struct {
 	Capacity       int
 	RefillAmount   int
 	RefillDuration time.Duration
+
+	// LeakyBucketMode is what a LeakyBucket does with requests arriving faster
+	// than it leaks. LeakyBucketMeter, the default, lets them through while
+	// they fit in the bucket. LeakyBucketQueue holds them in the bucket until
+	// their turn to leak out, so Wait and Reserve let them through at a
+	// constant rate and Allow only while the bucket is empty. Requests that
+	// don't fit are turned away rather than wait for room, so the bucket is
+	// the queue and MaxQueue doesn't apply.
+	LeakyBucketMode LeakyBucketMode
+
+	// Overrides give the listed keys, such as a customer's tier, parameters of
+	// their own. Keys without one are passed to LimitFunc when it is set. In
+	// both cases only Limit, Window, Capacity, RefillAmount and RefillDuration
+	// apply, and those left at zero keep the values above. LimitFunc is asked
+	// about a key when its state is created, again after Reconfigure or Reset,
+	// and whenever Token or Limit looks at a key that isn't tracked. It may be
+	// called with the key locked and from several goroutines at once, and must
+	// not use the limiter. Both can be replaced at runtime with Reconfigure.
+	Overrides map[string]Options
+	LimitFunc func(key string) Options
+
+	// Clock defaults to the system clock when nil.
+	Clock Clock
+
+	// IdleTTL enables dropping keys that have not been used for this long and
+	// whose state is back to fresh. They are checked every CleanupInterval,
+	// which defaults to IdleTTL.
+	IdleTTL         time.Duration
+	CleanupInterval time.Duration
+	// MaxKeys caps the number of tracked keys. When it is exceeded, the key
+	// evicted is the least recently used one of a shard, the new key's shard
+	// first: recency is tracked per shard, not across all keys. Keys in use
+	// by a call at the time are not evicted. Zero means unlimited.
+	// Concurrency limiters don't support it, as their keys hold permits.
+	MaxKeys int
+
+	// Shards is the number of independently locked partitions of the key
+	// space, rounded up to a power of two. Defaults to 4 × GOMAXPROCS.
+	Shards int
+
+	// Callers waiting on the same key are served in arrival order. MaxQueue
+	// caps how many may line up per key and MaxWait how long each may wait,
+	// after which Wait and WaitN return false and WaitContext ErrQueueFull
+	// or ErrMaxWaitExceeded. Zero means unlimited. A LeakyBucket in
+	// LeakyBucketQueue mode queues in the bucket instead, up to its Capacity.
+	MaxQueue int
+	MaxWait  time.Duration
+
+	// PriorityReserve is the share of a key's limit or capacity kept back
+	// from PriorityNormal requests for PriorityHigh ones, and twice that from
+	// PriorityLow requests. Below 0.5, so every priority can still get
+	// through on an idle key.
+	PriorityReserve float64
+
+	// MaxHold is how long a Concurrency permit may be held before it is taken
+	// to have leaked, its release having been forgotten. Leaked permits are
+	// reclaimed and reported to OnLeak, which is called with the key locked
+	// and must not use the limiter. That happens when the key is next used,
+	// when a caller waiting on it gets to the permit's expiry, or when the
+	// janitor finds the key idle for IdleTTL, not the moment MaxHold runs
+	// out.
+	// Zero means permits are held until released.
+	MaxHold time.Duration
+	OnLeak  func(key string, heldFor time.Duration)
+
+	// Strategy learns the limit of each key of an AdaptiveConcurrency limiter,
+	// starting from Limit, from the outcomes reported through Adapter: AIMD,
+	// Vegas, Gradient or one of the caller's own. MaxLimit caps the limit it
+	// learns; zero means uncapped.
+	Strategy NewStrategy
+	MaxLimit int
 }
 
 func (o Options) toInternal() internal.Options {
+	var overrides map[string]internal.Options
+	if len(o.Overrides) > 0 {
+		overrides = make(map[string]internal.Options, len(o.Overrides))
+		for key, override := range o.Overrides {
+			overrides[key] = override.toInternal()
+		}
+	}
+
+	var limitFunc func(string) internal.Options
+	if o.LimitFunc != nil {
+		limitFunc = func(key string) internal.Options {
+			return o.LimitFunc(key).toInternal()
+		}
+	}
+
 	return internal.Options{
 		Limit:  o.Limit,
 		Window: o.Window,
@@ -23,5 +111,258 @@ func (o Options) toInternal() internal.Options {
 		Capacity:       o.Capacity,
 		RefillAmount:   o.RefillAmount,
 		RefillDuration: o.RefillDuration,
+
+		LeakyBucketMode: o.LeakyBucketMode,
+
+		Overrides: overrides,
+		LimitFunc: limitFunc,
+
+		Clock: o.Clock,
+
+		IdleTTL:         o.IdleTTL,
+		CleanupInterval: o.CleanupInterval,
+		MaxKeys:         o.MaxKeys,
+		Shards:          o.Shards,
+
+		MaxQueue: o.MaxQueue,
+		MaxWait:  o.MaxWait,
+
+		PriorityReserve: o.PriorityReserve,
+
+		MaxHold: o.MaxHold,
+		OnLeak:  o.OnLeak,
+
+		Strategy: o.Strategy,
+		MaxLimit: o.MaxLimit,
+	}
+}
+
+// validateShared checks the options that apply to every limiter type.
+func (o Options) validateShared() error {
+	if o.IdleTTL < 0 {
+		return &OptionError{Field: "IdleTTL", Reason: "must not be negative", Err: ErrInvalidIdleTTL}
+	}
+	if o.CleanupInterval < 0 {
+		return &OptionError{Field: "CleanupInterval", Reason: "must not be negative", Err: ErrInvalidCleanupInterval}
+	}
+	if o.CleanupInterval > 0 && o.IdleTTL == 0 {
+		return &OptionError{Field: "CleanupInterval", Reason: "requires IdleTTL", Err: ErrUnsupportedOption}
+	}
+	if o.MaxKeys < 0 {
+		return &OptionError{Field: "MaxKeys", Reason: "must not be negative", Err: ErrInvalidMaxKeys}
+	}
+	if o.Shards < 0 {
+		return &OptionError{Field: "Shards", Reason: "must not be negative", Err: ErrInvalidShards}
+	}
+	if o.MaxQueue < 0 {
+		return &OptionError{Field: "MaxQueue", Reason: "must not be negative", Err: ErrInvalidMaxQueue}
+	}
+	if o.MaxWait < 0 {
+		return &OptionError{Field: "MaxWait", Reason: "must not be negative", Err: ErrInvalidMaxWait}
+	}
+	if o.PriorityReserve < 0 || o.PriorityReserve >= 0.5 {
+		return &OptionError{Field: "PriorityReserve", Reason: "must be in [0, 0.5)", Err: ErrInvalidPriorityReserve}
+	}
+
+	return nil
+}
+
+func (o Options) validate(limiterType LimiterType) error {
+	if err := o.validateShared(); err != nil {
+		return err
 	}
+
+	switch limiterType {
+	case Concurrency, AdaptiveConcurrency:
+		if o.Limit <= 0 {
+			return notPositive("Limit", ErrInvalidLimit)
+		}
+		if o.MaxHold < 0 {
+			return &OptionError{Field: "MaxHold", Reason: "must not be negative", Err: ErrInvalidMaxHold}
+		}
+		if o.OnLeak != nil && o.MaxHold == 0 {
+			return &OptionError{Field: "OnLeak", Reason: "requires MaxHold", Err: ErrUnsupportedOption}
+		}
+		// evicting a key would forget the permits it holds
+		if o.MaxKeys != 0 {
+			return unsupported("MaxKeys", limiterType)
+		}
+		if o.Window != 0 {
+			return unsupported("Window", limiterType)
+		}
+		if o.Capacity != 0 {
+			return unsupported("Capacity", limiterType)
+		}
+		if o.RefillAmount != 0 {
+			return unsupported("RefillAmount", limiterType)
+		}
+		if o.RefillDuration != 0 {
+			return unsupported("RefillDuration", limiterType)
+		}
+	case FixedWindow, SlidingWindowLog, SlidingWindowCounter:
+		if o.Limit <= 0 {
+			return notPositive("Limit", ErrInvalidLimit)
+		}
+		if o.Window <= 0 {
+			return notPositive("Window", ErrInvalidWindow)
+		}
+		if o.Capacity != 0 {
+			return unsupported("Capacity", limiterType)
+		}
+		if o.RefillAmount != 0 {
+			return unsupported("RefillAmount", limiterType)
+		}
+		if o.RefillDuration != 0 {
+			return unsupported("RefillDuration", limiterType)
+		}
+	case TokenBucket, AtomicTokenBucket, LeakyBucket, GCRA:
+		if o.Capacity <= 0 {
+			return notPositive("Capacity", ErrInvalidCapacity)
+		}
+		if o.RefillAmount <= 0 {
+			return notPositive("RefillAmount", ErrInvalidRefillAmount)
+		}
+		if o.RefillDuration <= 0 {
+			return notPositive("RefillDuration", ErrInvalidRefillDuration)
+		}
+		if o.Limit != 0 {
+			return unsupported("Limit", limiterType)
+		}
+		if o.Window != 0 {
+			return unsupported("Window", limiterType)
+		}
+	}
+
+	if limiterType != Concurrency && limiterType != AdaptiveConcurrency {
+		if o.MaxHold != 0 {
+			return unsupported("MaxHold", limiterType)
+		}
+		if o.OnLeak != nil {
+			return unsupported("OnLeak", limiterType)
+		}
+	}
+
+	if limiterType == AdaptiveConcurrency {
+		if o.Strategy == nil {
+			return &OptionError{Field: "Strategy", Reason: "is required", Err: ErrInvalidStrategy}
+		}
+		if o.MaxLimit < 0 {
+			return &OptionError{Field: "MaxLimit", Reason: "must not be negative", Err: ErrInvalidMaxLimit}
+		}
+		if o.MaxLimit > 0 && o.MaxLimit < o.Limit {
+			return &OptionError{Field: "MaxLimit", Reason: "must not be below Limit", Err: ErrInvalidMaxLimit}
+		}
+	} else {
+		if o.Strategy != nil {
+			return unsupported("Strategy", limiterType)
+		}
+		if o.MaxLimit != 0 {
+			return unsupported("MaxLimit", limiterType)
+		}
+	}
+
+	if limiterType == LeakyBucket {
+		if o.LeakyBucketMode != LeakyBucketMeter && o.LeakyBucketMode != LeakyBucketQueue {
+			return &OptionError{Field: "LeakyBucketMode", Reason: "unknown mode", Err: ErrInvalidLeakyBucketMode}
+		}
+		// the bucket is the queue, bounded by Capacity
+		if o.LeakyBucketMode == LeakyBucketQueue && o.MaxQueue != 0 {
+			return unsupported("MaxQueue", limiterType)
+		}
+	} else if o.LeakyBucketMode != LeakyBucketMeter {
+		return unsupported("LeakyBucketMode", limiterType)
+	}
+
+	if limiterType == AtomicTokenBucket {
+		// tokens share a 64-bit word with the refill period
+		if o.Capacity > math.MaxInt32 {
+			return &OptionError{Field: "Capacity", Reason: "must not exceed math.MaxInt32", Err: ErrInvalidCapacity}
+		}
+	}
+
+	// lock-free limiters keep their keys in a plain map, with the same
+	// parameters for all
+	if limiterType == AtomicTokenBucket || limiterType == GCRA {
+		if o.MaxKeys != 0 {
+			return unsupported("MaxKeys", limiterType)
+		}
+		if o.Shards != 0 {
+			return unsupported("Shards", limiterType)
+		}
+		if len(o.Overrides) > 0 {
+			return unsupported("Overrides", limiterType)
+		}
+		if o.LimitFunc != nil {
+			return unsupported("LimitFunc", limiterType)
+		}
+	}
+
+	for key, override := range o.Overrides {
+		if err := o.validateOverride(override, limiterType); err != nil {
+			err.Field = "Overrides[" + strconv.Quote(key) + "]." + err.Field
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateOverride checks override as it applies on top of o.
+func (o Options) validateOverride(override Options, limiterType LimiterType) *OptionError {
+	perLimiter := []struct {
+		field string
+		set   bool
+	}{
+		{"Clock", override.Clock != nil},
+		{"IdleTTL", override.IdleTTL != 0},
+		{"CleanupInterval", override.CleanupInterval != 0},
+		{"MaxKeys", override.MaxKeys != 0},
+		{"Shards", override.Shards != 0},
+		{"MaxQueue", override.MaxQueue != 0},
+		{"MaxWait", override.MaxWait != 0},
+		{"PriorityReserve", override.PriorityReserve != 0},
+		{"LeakyBucketMode", override.LeakyBucketMode != 0},
+		{"MaxHold", override.MaxHold != 0},
+		{"OnLeak", override.OnLeak != nil},
+		{"Strategy", override.Strategy != nil},
+		{"MaxLimit", override.MaxLimit != 0},
+		{"Overrides", len(override.Overrides) > 0},
+		{"LimitFunc", override.LimitFunc != nil},
+	}
+	for _, option := range perLimiter {
+		if option.set {
+			return &OptionError{Field: option.field, Reason: "can't be set per key", Err: ErrUnsupportedOption}
+		}
+	}
+
+	merged := o
+	merged.Overrides, merged.LimitFunc = nil, nil
+	if override.Limit != 0 {
+		merged.Limit = override.Limit
+	}
+	if override.Window != 0 {
+		merged.Window = override.Window
+	}
+	if override.Capacity != 0 {
+		merged.Capacity = override.Capacity
+	}
+	if override.RefillAmount != 0 {
+		merged.RefillAmount = override.RefillAmount
+	}
+	if override.RefillDuration != 0 {
+		merged.RefillDuration = override.RefillDuration
+	}
+
+	if err := merged.validate(limiterType); err != nil {
+		return err.(*OptionError)
+	}
+	return nil
+}
+
+func notPositive(field string, err error) *OptionError {
+	return &OptionError{Field: field, Reason: "must be positive", Err: err}
+}
+
+func unsupported(field string, limiterType LimiterType) *OptionError {
+	return &OptionError{Field: field, Reason: "not used by " + limiterType.String(), Err: ErrUnsupportedOption}
 }
@@ -0,0 +1,167 @@
+package pkg
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRequireValidation(t *testing.T) {
+	tests := []struct {
+		name        string
+		limiterType LimiterType
+		options     Options
+		field       string
+		err         error
+	}{
+		{"fixed window zero limit", FixedWindow, Options{Window: time.Second}, "Limit", ErrInvalidLimit},
+		{"fixed window negative window", FixedWindow, Options{Limit: 1, Window: -time.Second}, "Window", ErrInvalidWindow},
+		{"sliding window zero window", SlidingWindowLog, Options{Limit: 1}, "Window", ErrInvalidWindow},
+		{"sliding window with capacity", SlidingWindowLog, Options{Limit: 1, Window: time.Second, Capacity: 5}, "Capacity", ErrUnsupportedOption},
+		{"sliding window counter with refill amount", SlidingWindowCounter, Options{Limit: 1, Window: time.Second, RefillAmount: 1}, "RefillAmount", ErrUnsupportedOption},
+		{"token bucket zero capacity", TokenBucket, Options{RefillAmount: 1, RefillDuration: time.Second}, "Capacity", ErrInvalidCapacity},
+		{"token bucket zero refill amount", TokenBucket, Options{Capacity: 1, RefillDuration: time.Second}, "RefillAmount", ErrInvalidRefillAmount},
+		{"token bucket zero refill duration", TokenBucket, Options{Capacity: 1, RefillAmount: 1}, "RefillDuration", ErrInvalidRefillDuration},
+		{"token bucket with window", TokenBucket, Options{Capacity: 1, RefillAmount: 1, RefillDuration: time.Second, Window: time.Second}, "Window", ErrUnsupportedOption},
+		{"negative idle ttl", FixedWindow, Options{Limit: 1, Window: time.Second, IdleTTL: -time.Second}, "IdleTTL", ErrInvalidIdleTTL},
+		{"cleanup interval without idle ttl", FixedWindow, Options{Limit: 1, Window: time.Second, CleanupInterval: time.Second}, "CleanupInterval", ErrUnsupportedOption},
+		{"negative shards", SlidingWindowLog, Options{Limit: 1, Window: time.Second, Shards: -1}, "Shards", ErrInvalidShards},
+		{"leaky bucket zero capacity", LeakyBucket, Options{RefillAmount: 1, RefillDuration: time.Second}, "Capacity", ErrInvalidCapacity},
+		{"leaky bucket unknown mode", LeakyBucket, Options{Capacity: 1, RefillAmount: 1, RefillDuration: time.Second, LeakyBucketMode: 2}, "LeakyBucketMode", ErrInvalidLeakyBucketMode},
+		{"leaky bucket queue with max queue", LeakyBucket, Options{Capacity: 1, RefillAmount: 1, RefillDuration: time.Second, LeakyBucketMode: LeakyBucketQueue, MaxQueue: 10}, "MaxQueue", ErrUnsupportedOption},
+		{"token bucket with leaky bucket mode", TokenBucket, Options{Capacity: 1, RefillAmount: 1, RefillDuration: time.Second, LeakyBucketMode: LeakyBucketQueue}, "LeakyBucketMode", ErrUnsupportedOption},
+		{"gcra with window", GCRA, Options{Capacity: 1, RefillAmount: 1, RefillDuration: time.Second, Window: time.Second}, "Window", ErrUnsupportedOption},
+		{"gcra with max keys", GCRA, Options{Capacity: 1, RefillAmount: 1, RefillDuration: time.Second, MaxKeys: 10}, "MaxKeys", ErrUnsupportedOption},
+		{"concurrency zero limit", Concurrency, Options{}, "Limit", ErrInvalidLimit},
+		{"concurrency with window", Concurrency, Options{Limit: 1, Window: time.Second}, "Window", ErrUnsupportedOption},
+		{"concurrency negative max hold", Concurrency, Options{Limit: 1, MaxHold: -time.Second}, "MaxHold", ErrInvalidMaxHold},
+		{"concurrency on leak without max hold", Concurrency, Options{Limit: 1, OnLeak: func(string, time.Duration) {}}, "OnLeak", ErrUnsupportedOption},
+		{"concurrency with max keys", Concurrency, Options{Limit: 1, MaxKeys: 10}, "MaxKeys", ErrUnsupportedOption},
+		{"adaptive concurrency with max keys", AdaptiveConcurrency, Options{Limit: 1, Strategy: AIMD(0, 0), MaxKeys: 10}, "MaxKeys", ErrUnsupportedOption},
+		{"token bucket with max hold", TokenBucket, Options{Capacity: 1, RefillAmount: 1, RefillDuration: time.Second, MaxHold: time.Second}, "MaxHold", ErrUnsupportedOption},
+		{"adaptive concurrency without strategy", AdaptiveConcurrency, Options{Limit: 1}, "Strategy", ErrInvalidStrategy},
+		{"adaptive concurrency max limit below limit", AdaptiveConcurrency, Options{Limit: 10, Strategy: AIMD(0, 0), MaxLimit: 5}, "MaxLimit", ErrInvalidMaxLimit},
+		{"concurrency with strategy", Concurrency, Options{Limit: 1, Strategy: Vegas(0, 0)}, "Strategy", ErrUnsupportedOption},
+		{"override with max limit", AdaptiveConcurrency, Options{Limit: 1, Strategy: Gradient(0), Overrides: map[string]Options{"pro": {MaxLimit: 5}}}, `Overrides["pro"].MaxLimit`, ErrUnsupportedOption},
+		{"atomic token bucket zero refill amount", AtomicTokenBucket, Options{Capacity: 1, RefillDuration: time.Second}, "RefillAmount", ErrInvalidRefillAmount},
+		{"atomic token bucket capacity too large", AtomicTokenBucket, Options{Capacity: math.MaxInt32 + 1, RefillAmount: 1, RefillDuration: time.Second}, "Capacity", ErrInvalidCapacity},
+		{"atomic token bucket with max keys", AtomicTokenBucket, Options{Capacity: 1, RefillAmount: 1, RefillDuration: time.Second, MaxKeys: 10}, "MaxKeys", ErrUnsupportedOption},
+		{"override with negative limit", FixedWindow, Options{Limit: 1, Window: time.Second, Overrides: map[string]Options{"pro": {Limit: -1}}}, `Overrides["pro"].Limit`, ErrInvalidLimit},
+		{"override with capacity", SlidingWindowLog, Options{Limit: 1, Window: time.Second, Overrides: map[string]Options{"pro": {Capacity: 5}}}, `Overrides["pro"].Capacity`, ErrUnsupportedOption},
+		{"override with idle ttl", TokenBucket, Options{Capacity: 1, RefillAmount: 1, RefillDuration: time.Second, Overrides: map[string]Options{"pro": {IdleTTL: time.Second}}}, `Overrides["pro"].IdleTTL`, ErrUnsupportedOption},
+		{"atomic token bucket with limit func", AtomicTokenBucket, Options{Capacity: 1, RefillAmount: 1, RefillDuration: time.Second, LimitFunc: func(string) Options { return Options{} }}, "LimitFunc", ErrUnsupportedOption},
+		{"negative max queue", FixedWindow, Options{Limit: 1, Window: time.Second, MaxQueue: -1}, "MaxQueue", ErrInvalidMaxQueue},
+		{"negative max wait", AtomicTokenBucket, Options{Capacity: 1, RefillAmount: 1, RefillDuration: time.Second, MaxWait: -time.Second}, "MaxWait", ErrInvalidMaxWait},
+		{"override with max wait", FixedWindow, Options{Limit: 1, Window: time.Second, Overrides: map[string]Options{"pro": {MaxWait: time.Second}}}, `Overrides["pro"].MaxWait`, ErrUnsupportedOption},
+		{"priority reserve too large", TokenBucket, Options{Capacity: 1, RefillAmount: 1, RefillDuration: time.Second, PriorityReserve: 0.5}, "PriorityReserve", ErrInvalidPriorityReserve},
+		{"negative max keys", TokenBucket, Options{Capacity: 1, RefillAmount: 1, RefillDuration: time.Second, MaxKeys: -1}, "MaxKeys", ErrInvalidMaxKeys},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter, err := Require(tt.limiterType, tt.options)
+			if limiter != nil {
+				t.Error("Expected no limiter for invalid options")
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("Expected %v, got %v", tt.err, err)
+			}
+
+			var optionErr *OptionError
+			if !errors.As(err, &optionErr) {
+				t.Fatalf("Expected an *OptionError, got %T", err)
+			}
+			if optionErr.Field != tt.field {
+				t.Errorf("Expected field %s, got %s", tt.field, optionErr.Field)
+			}
+		})
+	}
+}
+
+func TestRequireInvalidLimiterType(t *testing.T) {
+	_, err := Require(LimiterType(42), Options{})
+	if !errors.Is(err, ErrInvalidLimiterType) {
+		t.Errorf("Expected ErrInvalidLimiterType, got %v", err)
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	limiter, err := Require(TokenBucket, Options{Capacity: 10, RefillAmount: 1, RefillDuration: time.Second})
+	if err != nil {
+		t.Fatalf("Failed to create TokenBucket limiter: %v", err)
+	}
+
+	err = limiter.Reconfigure(Options{Capacity: 0, RefillAmount: 1, RefillDuration: time.Second})
+	if !errors.Is(err, ErrInvalidCapacity) {
+		t.Errorf("Expected Reconfigure to validate options, got %v", err)
+	}
+
+	limiter.AllowN("test_key", 4)
+	if err := limiter.Reconfigure(Options{Capacity: 2, RefillAmount: 1, RefillDuration: time.Second}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if tokens := limiter.Token("test_key"); tokens != 2 {
+		t.Errorf("Expected tokens to be clamped to the new capacity, got %d", tokens)
+	}
+
+	atomic, _ := Require(AtomicTokenBucket, Options{Capacity: 10, RefillAmount: 1, RefillDuration: time.Second})
+	err = atomic.Reconfigure(Options{Capacity: 10, RefillAmount: 1, RefillDuration: time.Minute})
+	var optionErr *OptionError
+	if !errors.As(err, &optionErr) || optionErr.Field != "RefillDuration" || !errors.Is(err, ErrUnsupportedOption) {
+		t.Errorf("Expected an OptionError for RefillDuration, got %v", err)
+	}
+}
+
+func TestReconfigureConcurrent(t *testing.T) {
+	limiter, err := Require(FixedWindow, Options{Limit: 100, Window: time.Second})
+	if err != nil {
+		t.Fatalf("Failed to create FixedWindow limiter: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				limiter.Allow("test_key")
+			}
+		}()
+	}
+	for limit := 1; limit <= 50; limit++ {
+		limiter.Reconfigure(Options{Limit: limit, Window: time.Second})
+	}
+	wg.Wait()
+
+	if tokens := limiter.Token("test_key"); tokens < 0 || tokens > 50 {
+		t.Errorf("Expected tokens within the final limit, got %d", tokens)
+	}
+}
+
+func TestRequireOverrides(t *testing.T) {
+	tiers := map[string]Options{
+		"free": {Limit: 1},
+		"pro":  {Limit: 5},
+	}
+	customers := map[string]string{"alice": "pro"}
+
+	limiter, err := Require(FixedWindow, Options{
+		Limit:  2,
+		Window: time.Minute,
+		LimitFunc: func(key string) Options {
+			return tiers[customers[key]]
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create FixedWindow limiter: %v", err)
+	}
+
+	if !limiter.AllowN("alice", 5) || limiter.Allow("alice") {
+		t.Error("Expected alice to get the pro tier")
+	}
+	if !limiter.AllowN("bob", 2) || limiter.Allow("bob") {
+		t.Error("Expected bob to get the default limit")
+	}
+}
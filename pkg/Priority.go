@@ -0,0 +1,13 @@
+package pkg
+
+import "github.com/sirius1b/go-rate-limit/internal"
+
+// Priority ranks requests sharing a key for AllowPriority and WaitPriority.
+// Calls that take no priority act as PriorityHigh.
+type Priority = internal.Priority
+
+const (
+	PriorityLow    = internal.PriorityLow
+	PriorityNormal = internal.PriorityNormal
+	PriorityHigh   = internal.PriorityHigh
+)
@@ -0,0 +1,97 @@
+package pkg
+
+import (
+	"sync"
+)
+
+// Factory builds a limiter for a registered LimiterType. Require checks the
+// options shared by every limiter (IdleTTL, CleanupInterval, MaxKeys, Shards,
+// MaxQueue, MaxWait and PriorityReserve) before calling it; everything else is
+// up to the factory.
+type Factory func(Options) (IRateLimiter, error)
+
+type registration struct {
+	name    string
+	factory Factory
+}
+
+var registry struct {
+	sync.RWMutex
+	once  sync.Once
+	types []registration
+}
+
+// builtins fills the registry on first use rather than in its initialiser,
+// which would be an initialisation cycle through validate.
+func builtins() {
+	// indexed by LimiterType, so the order must follow the constants
+	registry.types = []registration{
+		FixedWindow:          {"FixedWindow", NewFixedWindow},
+		TokenBucket:          {"TokenBucket", NewTokenBucket},
+		SlidingWindowLog:     {"SlidingWindowLog", NewSlidingWindowLog},
+		AtomicTokenBucket:    {"AtomicTokenBucket", NewAtomicTokenBucket},
+		SlidingWindowCounter: {"SlidingWindowCounter", NewSlidingWindowCounter},
+		LeakyBucket:          {"LeakyBucket", NewLeakyBucket},
+		GCRA:                 {"GCRA", NewGCRA},
+		Concurrency:          {"Concurrency", NewConcurrency},
+		AdaptiveConcurrency:  {"AdaptiveConcurrency", NewAdaptiveConcurrency},
+	}
+}
+
+// Register adds a limiter algorithm under a unique name and returns the
+// LimiterType to pass to Require. It is meant to be called from package
+// initialisation, typically through MustRegister.
+func Register(name string, factory Factory) (LimiterType, error) {
+	if name == "" || factory == nil {
+		return 0, ErrInvalidRegistration
+	}
+
+	registry.once.Do(builtins)
+	registry.Lock()
+	defer registry.Unlock()
+
+	for _, r := range registry.types {
+		if r.name == name {
+			return 0, ErrLimiterTypeRegistered
+		}
+	}
+
+	registry.types = append(registry.types, registration{name, factory})
+	return LimiterType(len(registry.types) - 1), nil
+}
+
+// MustRegister is like Register but panics on error, for use in package
+// level variable declarations.
+func MustRegister(name string, factory Factory) LimiterType {
+	limiterType, err := Register(name, factory)
+	if err != nil {
+		panic("go-rate-limit: registering " + name + ": " + err.Error())
+	}
+	return limiterType
+}
+
+// ParseLimiterType returns the LimiterType registered under name, built-in or
+// custom.
+func ParseLimiterType(name string) (LimiterType, bool) {
+	registry.once.Do(builtins)
+	registry.RLock()
+	defer registry.RUnlock()
+
+	for index, r := range registry.types {
+		if r.name == name {
+			return LimiterType(index), true
+		}
+	}
+	return 0, false
+}
+
+func lookup(limiterType LimiterType) (registration, bool) {
+	registry.once.Do(builtins)
+	registry.RLock()
+	defer registry.RUnlock()
+
+	if limiterType < 0 || int(limiterType) >= len(registry.types) {
+		return registration{}, false
+	}
+	return registry.types[limiterType], true
+}
@@ -0,0 +1,74 @@
+package pkg
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// doubleWindow is a custom algorithm built on the public constructors.
+func doubleWindow(option Options) (IRateLimiter, error) {
+	option.Limit *= 2
+	return NewFixedWindow(option)
+}
+
+var DoubleWindow = MustRegister("DoubleWindow", doubleWindow)
+
+func TestRegister(t *testing.T) {
+	if DoubleWindow.String() != "DoubleWindow" {
+		t.Errorf("Expected registered name, got %s", DoubleWindow)
+	}
+	if limiterType, ok := ParseLimiterType("DoubleWindow"); !ok || limiterType != DoubleWindow {
+		t.Errorf("Expected ParseLimiterType to find the custom type, got %v %v", limiterType, ok)
+	}
+	if limiterType, ok := ParseLimiterType("TokenBucket"); !ok || limiterType != TokenBucket {
+		t.Errorf("Expected ParseLimiterType to find built-in types, got %v %v", limiterType, ok)
+	}
+
+	limiter, err := Require(DoubleWindow, Options{Limit: 2, Window: time.Minute})
+	if err != nil {
+		t.Fatalf("Failed to create custom limiter: %v", err)
+	}
+	if !limiter.AllowN("test_key", 4) {
+		t.Error("Expected the custom factory to be used")
+	}
+}
+
+func TestRegisterErrors(t *testing.T) {
+	if _, err := Register("DoubleWindow", doubleWindow); !errors.Is(err, ErrLimiterTypeRegistered) {
+		t.Errorf("Expected ErrLimiterTypeRegistered, got %v", err)
+	}
+	if _, err := Register("FixedWindow", doubleWindow); !errors.Is(err, ErrLimiterTypeRegistered) {
+		t.Errorf("Expected built-in names to be taken, got %v", err)
+	}
+	if _, err := Register("", doubleWindow); !errors.Is(err, ErrInvalidRegistration) {
+		t.Errorf("Expected ErrInvalidRegistration for an empty name, got %v", err)
+	}
+	if _, err := Register("Nil", nil); !errors.Is(err, ErrInvalidRegistration) {
+		t.Errorf("Expected ErrInvalidRegistration for a nil factory, got %v", err)
+	}
+}
+
+func TestRequireSharedValidation(t *testing.T) {
+	_, err := Require(DoubleWindow, Options{Limit: 1, Window: time.Second, MaxKeys: -1})
+	if !errors.Is(err, ErrInvalidMaxKeys) {
+		t.Errorf("Expected shared options to be checked for custom types, got %v", err)
+	}
+
+	_, err = Require(DoubleWindow, Options{Window: time.Second})
+	if !errors.Is(err, ErrInvalidLimit) {
+		t.Errorf("Expected factory errors to be returned, got %v", err)
+	}
+}
+
+func TestNewConstructors(t *testing.T) {
+	limiter, err := NewTokenBucket(Options{Capacity: 1, RefillAmount: 1, RefillDuration: time.Second})
+	if err != nil || !limiter.Allow("test_key") {
+		t.Errorf("Expected a working TokenBucket, got %v", err)
+	}
+
+	limiter, err = NewSlidingWindowLog(Options{Limit: 1})
+	if limiter != nil || !errors.Is(err, ErrInvalidWindow) {
+		t.Errorf("Expected a nil limiter and ErrInvalidWindow, got %v %v", limiter, err)
+	}
+}
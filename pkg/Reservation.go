@@ -0,0 +1,25 @@
+package pkg
+
+import (
+	"time"
+
+	"github.com/sirius1b/go-rate-limit/internal"
+)
+
+// Reservation holds capacity taken from a limiter ahead of time. Callers act on
+// it once Delay has elapsed, or Cancel it to hand the capacity back. When the
+// real cost is only known afterwards, reserve an estimate and Commit the
+// actual amount.
+type Reservation = internal.Reservation
+
+// InfDuration is the Delay of a reservation that is not OK.
+const InfDuration = internal.InfDuration
+
+// NewReservation returns the reservation a registered algorithm hands out from
+// Reserve: due at readyAt on clock when ok, or never when it is not. The first
+// Cancel calls cancel, if not nil, to give the units back; it is up to cancel
+// to keep them once the reservation came due. Set what Commit does with
+// OnCommit.
+func NewReservation(clock Clock, ok bool, readyAt time.Time, cancel func()) *Reservation {
+	return internal.NewReservation(clock, ok, readyAt, cancel)
+}
@@ -0,0 +1,135 @@
+package pkg_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirius1b/go-rate-limit/pkg"
+)
+
+// quota is a custom algorithm written outside the package: each key gets
+// Limit units for good. It runs on Options.Clock, which the test always sets.
+type quota struct {
+	mu    sync.Mutex
+	limit int
+	used  map[string]int
+	clock pkg.Clock
+}
+
+var Quota = pkg.MustRegister("Quota", func(option pkg.Options) (pkg.IRateLimiter, error) {
+	return &quota{limit: option.Limit, used: make(map[string]int), clock: option.Clock}, nil
+})
+
+func (q *quota) Allow(key string) bool { return q.AllowN(key, 1) }
+
+func (q *quota) AllowN(key string, n int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if n <= 0 || q.used[key]+n > q.limit {
+		return false
+	}
+	q.used[key] += n
+	return true
+}
+
+func (q *quota) AllowAll(keys ...string) bool {
+	for index, key := range keys {
+		if !q.Allow(key) {
+			for _, k := range keys[:index] {
+				q.Refund(k, 1)
+			}
+			return false
+		}
+	}
+	return true
+}
+
+func (q *quota) AllowDetailed(key string) pkg.Decision {
+	return pkg.Decision{Allowed: q.Allow(key), Limit: q.limit, Remaining: q.Token(key)}
+}
+
+func (q *quota) AllowPriority(key string, _ pkg.Priority) bool { return q.Allow(key) }
+func (q *quota) Wait(key string) bool                          { return q.Allow(key) }
+func (q *quota) WaitPriority(key string, _ pkg.Priority) bool  { return q.Allow(key) }
+func (q *quota) WaitN(key string, n int) bool                  { return q.AllowN(key, n) }
+
+func (q *quota) WaitContext(ctx context.Context, key string) error {
+	if !q.Allow(key) {
+		return pkg.ErrReservationNotOK
+	}
+	return nil
+}
+
+// Reserve is OK when the units are left, which they will stay.
+func (q *quota) Reserve(key string, n int) *pkg.Reservation {
+	if !q.AllowN(key, n) {
+		return pkg.NewReservation(q.clock, false, time.Time{}, nil)
+	}
+	return pkg.NewReservation(q.clock, true, q.clock.Now(), func() {
+		q.Refund(key, n)
+	}).OnCommit(func(actual int) {
+		q.Refund(key, n-actual)
+	})
+}
+
+func (q *quota) Refund(key string, n int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.used[key] = min(q.limit, max(0, q.used[key]-n))
+}
+
+func (q *quota) Rate() float64 { return 0 }
+
+func (q *quota) Token(key string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.limit - q.used[key]
+}
+
+func (q *quota) Keys() []string                       { return nil }
+func (q *quota) Len() int                             { return 0 }
+func (q *quota) Snapshot(string) (pkg.Snapshot, bool) { return pkg.Snapshot{}, false }
+func (q *quota) Reset(key string)                     { q.Refund(key, q.limit) }
+func (q *quota) ResetAll()                            {}
+func (q *quota) Reconfigure(pkg.Options) error        { return pkg.ErrNotReconfigurable }
+func (q *quota) Close() error                         { return nil }
+
+func TestNewReservation(t *testing.T) {
+	clock := pkg.NewFakeClock(time.Now())
+	limiter, err := pkg.Require(Quota, pkg.Options{Limit: 3, Clock: clock})
+	if err != nil {
+		t.Fatalf("Failed to create custom limiter: %v", err)
+	}
+
+	key := "test_key"
+	r := limiter.Reserve(key, 2)
+	if !r.OK() || r.Delay() != 0 || !r.ReadyAt().Equal(clock.Now()) {
+		t.Fatalf("Expected a reservation due now, got ok=%v delay=%v", r.OK(), r.Delay())
+	}
+	if err := r.Wait(context.Background()); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	r.Commit(1)
+	if limiter.Token(key) != 2 {
+		t.Errorf("Expected Commit to refund the unused unit, got %d left", limiter.Token(key))
+	}
+
+	r = limiter.Reserve(key, 2)
+	r.Cancel()
+	if limiter.Token(key) != 2 {
+		t.Errorf("Expected Cancel to give the units back, got %d left", limiter.Token(key))
+	}
+
+	if r := limiter.Reserve(key, 3); r.OK() || r.Delay() != pkg.InfDuration {
+		t.Error("Expected a reservation beyond the quota not to be OK")
+	}
+
+	// the reservation works in composites like a built-in one
+	all := pkg.All(limiter, limiter)
+	if r := all.Reserve(key, 1); !r.OK() || limiter.Token(key) != 0 {
+		t.Errorf("Expected the composite to reserve from both, got %d left", limiter.Token(key))
+	}
+}
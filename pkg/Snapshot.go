@@ -0,0 +1,7 @@
+package pkg
+
+import "github.com/sirius1b/go-rate-limit/internal"
+
+// Snapshot is a point in time view of a key's state, as returned by
+// IRateLimiter.Snapshot.
+type Snapshot = internal.Snapshot
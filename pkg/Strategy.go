@@ -0,0 +1,31 @@
+package pkg
+
+import "github.com/sirius1b/go-rate-limit/internal"
+
+// Strategy learns an AdaptiveConcurrency limiter's limit for a key from the
+// Samples reported through Adapter, see Options.Strategy. Each key gets its
+// own from a NewStrategy.
+type Strategy = internal.Strategy
+
+type Sample = internal.Sample
+
+type NewStrategy = internal.NewStrategy
+
+// AIMD grows the limit additively, by increase per round trip, and backs off
+// multiplicatively on drops. Zero picks the defaults, 1 and 0.9.
+func AIMD(increase, backoff float64) NewStrategy {
+	return internal.AIMD(increase, backoff)
+}
+
+// Vegas keeps between alpha and beta requests queued, as estimated from how
+// much slower they are than the fastest one seen. Zero picks the defaults, 3
+// and 6.
+func Vegas(alpha, beta float64) NewStrategy {
+	return internal.Vegas(alpha, beta)
+}
+
+// Gradient follows the ratio between the long-term average latency and the
+// latest, blending each step in by smoothing. Zero picks the default, 0.2.
+func Gradient(smoothing float64) NewStrategy {
+	return internal.Gradient(smoothing)
+}